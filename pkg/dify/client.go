@@ -0,0 +1,281 @@
+// Package dify is a client for the Dify Service API (https://docs.dify.ai).
+package dify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client calls the Service API of a single Dify app. The API key decides
+// which app is addressed.
+type Client struct {
+	baseURL    string
+	apiKey     string
+	httpClient *http.Client
+	retry      RetryPolicy
+}
+
+// NewClient returns a client for the app behind apiKey. baseURL is the Dify
+// root without the /v1 suffix. A nil httpClient gets a fresh *http.Client.
+func NewClient(baseURL, apiKey string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{}
+	}
+	return &Client{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		apiKey:     apiKey,
+		httpClient: httpClient,
+	}
+}
+
+// ChatMessagesStream sends a chat message in streaming mode. The caller must
+// close the body of the returned response, which carries the event stream.
+func (c *Client) ChatMessagesStream(ctx context.Context, req *ChatRequest) (*http.Response, error) {
+	req.ResponseMode = ResponseModeStreaming
+	return c.post(ctx, "/v1/chat-messages", req, "text/event-stream", true)
+}
+
+// ChatMessages sends a chat message in blocking mode.
+func (c *Client) ChatMessages(ctx context.Context, req *ChatRequest) (*ChatResponse, error) {
+	req.ResponseMode = ResponseModeBlocking
+	var out ChatResponse
+	if err := c.postJSON(ctx, "/v1/chat-messages", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// CompletionMessagesStream sends a completion request in streaming mode. The
+// caller must close the body of the returned response.
+func (c *Client) CompletionMessagesStream(ctx context.Context, req *CompletionRequest) (*http.Response, error) {
+	req.ResponseMode = ResponseModeStreaming
+	return c.post(ctx, "/v1/completion-messages", req, "text/event-stream", true)
+}
+
+// CompletionMessages sends a completion request in blocking mode.
+func (c *Client) CompletionMessages(ctx context.Context, req *CompletionRequest) (*CompletionResponse, error) {
+	req.ResponseMode = ResponseModeBlocking
+	var out CompletionResponse
+	if err := c.postJSON(ctx, "/v1/completion-messages", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RunWorkflowStream runs a workflow in streaming mode. The caller must close
+// the body of the returned response.
+func (c *Client) RunWorkflowStream(ctx context.Context, req *WorkflowRunRequest) (*http.Response, error) {
+	req.ResponseMode = ResponseModeStreaming
+	return c.post(ctx, "/v1/workflows/run", req, "text/event-stream", true)
+}
+
+// RunWorkflow runs a workflow in blocking mode.
+func (c *Client) RunWorkflow(ctx context.Context, req *WorkflowRunRequest) (*WorkflowRunResponse, error) {
+	req.ResponseMode = ResponseModeBlocking
+	var out WorkflowRunResponse
+	if err := c.postJSON(ctx, "/v1/workflows/run", req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StopChatMessage stops a streaming chat message. Only the user that sent the
+// message may stop it.
+func (c *Client) StopChatMessage(ctx context.Context, taskID, user string) error {
+	return c.stop(ctx, "/v1/chat-messages/"+url.PathEscape(taskID)+"/stop", user)
+}
+
+// StopCompletionMessage stops a streaming completion. Only the user that
+// requested it may stop it.
+func (c *Client) StopCompletionMessage(ctx context.Context, taskID, user string) error {
+	return c.stop(ctx, "/v1/completion-messages/"+url.PathEscape(taskID)+"/stop", user)
+}
+
+// StopWorkflow stops a streaming workflow run. Only the user that started the
+// run may stop it.
+func (c *Client) StopWorkflow(ctx context.Context, taskID, user string) error {
+	return c.stop(ctx, "/v1/workflows/tasks/"+url.PathEscape(taskID)+"/stop", user)
+}
+
+func (c *Client) stop(ctx context.Context, path, user string) error {
+	var out struct {
+		Result string `json:"result"`
+	}
+	return c.postJSON(ctx, path, map[string]string{"user": user}, &out)
+}
+
+// Conversations lists a user's conversations, newest first by default.
+func (c *Client) Conversations(ctx context.Context, params ConversationsParams) (*ConversationList, error) {
+	q := url.Values{}
+	q.Set("user", params.User)
+	if params.LastID != "" {
+		q.Set("last_id", params.LastID)
+	}
+	if params.Limit > 0 {
+		q.Set("limit", strconv.Itoa(params.Limit))
+	}
+	if params.SortBy != "" {
+		q.Set("sort_by", params.SortBy)
+	}
+	var out ConversationList
+	if err := c.getJSON(ctx, "/v1/conversations", q, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Messages lists the messages of a conversation.
+func (c *Client) Messages(ctx context.Context, params MessagesParams) (*MessageList, error) {
+	q := url.Values{}
+	q.Set("user", params.User)
+	q.Set("conversation_id", params.ConversationID)
+	if params.FirstID != "" {
+		q.Set("first_id", params.FirstID)
+	}
+	if params.Limit > 0 {
+		q.Set("limit", strconv.Itoa(params.Limit))
+	}
+	var out MessageList
+	if err := c.getJSON(ctx, "/v1/messages", q, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Parameters returns the app's input form and feature settings.
+func (c *Client) Parameters(ctx context.Context, user string) (*Parameters, error) {
+	q := url.Values{}
+	if user != "" {
+		q.Set("user", user)
+	}
+	var out Parameters
+	if err := c.getJSON(ctx, "/v1/parameters", q, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Info returns the app's name and mode. Dify versions before 0.6.x answer 404.
+func (c *Client) Info(ctx context.Context) (*AppInfo, error) {
+	var out AppInfo
+	if err := c.getJSON(ctx, "/v1/info", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// UploadFile uploads a file for later use in a message or workflow run.
+func (c *Client) UploadFile(ctx context.Context, user, filename string, content io.Reader) (*UploadedFile, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	if err := mw.WriteField("user", user); err != nil {
+		return nil, err
+	}
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, content); err != nil {
+		return nil, err
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/v1/files/upload", nil, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var out UploadedFile
+	if err := c.doJSON(req, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// newRequest builds an authenticated request against the Dify API.
+func (c *Client) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	return req, nil
+}
+
+// do sends req and turns non-2xx responses into an *APIError.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newAPIError(resp)
+	}
+	return resp, nil
+}
+
+// post sends payload as JSON. With retry set, failures Dify cannot have acted
+// on are retried, see RetryableUnsent. Only requests that open a stream set
+// it.
+func (c *Client) post(ctx context.Context, path string, payload interface{}, accept string, retry bool) (*http.Response, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, path, nil, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", accept)
+	if retry {
+		return c.doRetry(req)
+	}
+	return c.do(req)
+}
+
+func (c *Client) postJSON(ctx context.Context, path string, payload, out interface{}) error {
+	resp, err := c.post(ctx, path, payload, "application/json", false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) getJSON(ctx context.Context, path string, query url.Values, out interface{}) error {
+	req, err := c.newRequest(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.doRetry(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *Client) doJSON(req *http.Request, out interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
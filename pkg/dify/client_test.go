@@ -0,0 +1,244 @@
+package dify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRunWorkflowStream tests the streaming workflow call
+func TestRunWorkflowStream(t *testing.T) {
+	testCases := []struct {
+		name           string
+		apiKey         string
+		inputs         map[string]interface{}
+		mockResponse   string
+		mockStatusCode int
+		expectAPIError bool
+	}{
+		{
+			name:           "successful API call",
+			apiKey:         "app-BY4mKffjRdOJemnxqX4d7ThY",
+			inputs:         map[string]interface{}{"inputs": map[string]interface{}{"query": "test query"}},
+			mockResponse:   `{"result": "success"}`,
+			mockStatusCode: 200,
+		},
+		{
+			name:           "API returns error",
+			apiKey:         "app-BY4mKffjRdOJemnxqX4d7ThY",
+			inputs:         map[string]interface{}{"inputs": map[string]interface{}{"query": "test query"}},
+			mockResponse:   `{"code": "invalid_param", "message": "invalid request", "status": 400}`,
+			mockStatusCode: 400,
+			expectAPIError: true,
+		},
+		{
+			name:           "empty request body",
+			apiKey:         "app-BY4mKffjRdOJemnxqX4d7ThY",
+			inputs:         map[string]interface{}{},
+			mockResponse:   `{"result": "success"}`,
+			mockStatusCode: 200,
+		},
+		{
+			name:           "request with custom fields",
+			apiKey:         "app-BY4mKffjRdOJemnxqX4d7ThY",
+			inputs:         map[string]interface{}{"custom_field": "value", "another_field": 123},
+			mockResponse:   `{"result": "success"}`,
+			mockStatusCode: 200,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" {
+					t.Errorf("Expected POST method, got %s", r.Method)
+				}
+				if r.URL.Path != "/v1/workflows/run" {
+					t.Errorf("Expected path /v1/workflows/run, got %s", r.URL.Path)
+				}
+				if r.Header.Get("Authorization") != "Bearer "+tc.apiKey {
+					t.Errorf("Expected Authorization header Bearer %s, got %s", tc.apiKey, r.Header.Get("Authorization"))
+				}
+				if r.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("Expected Content-Type application/json, got %s", r.Header.Get("Content-Type"))
+				}
+
+				var requestBody WorkflowRunRequest
+				if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
+					t.Errorf("Failed to decode request body: %v", err)
+				}
+				if requestBody.ResponseMode != ResponseModeStreaming {
+					t.Errorf("Expected streaming response mode, got %s", requestBody.ResponseMode)
+				}
+				if requestBody.User != "org1:admin" {
+					t.Errorf("Expected user org1:admin, got %s", requestBody.User)
+				}
+				if len(requestBody.Inputs) != len(tc.inputs) {
+					t.Errorf("Expected %d inputs, got %d", len(tc.inputs), len(requestBody.Inputs))
+				}
+
+				w.WriteHeader(tc.mockStatusCode)
+				w.Write([]byte(tc.mockResponse))
+			}))
+			defer server.Close()
+
+			client := NewClient(server.URL, tc.apiKey, nil)
+			resp, err := client.RunWorkflowStream(context.Background(), &WorkflowRunRequest{
+				Inputs: tc.inputs,
+				User:   "org1:admin",
+			})
+
+			if tc.expectAPIError {
+				var apiErr *APIError
+				if !errors.As(err, &apiErr) {
+					t.Fatalf("Expected *APIError, got %v", err)
+				}
+				if apiErr.StatusCode != tc.mockStatusCode || apiErr.Code != "invalid_param" || apiErr.Message != "invalid request" {
+					t.Errorf("Unexpected API error: %+v", apiErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != tc.mockStatusCode {
+				t.Errorf("Expected status code %d, got %d", tc.mockStatusCode, resp.StatusCode)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if !strings.Contains(string(body), tc.mockResponse) {
+				t.Errorf("Expected response body to contain %s, got %s", tc.mockResponse, body)
+			}
+		})
+	}
+}
+
+// TestClientErrorHandling tests errors raised before a request is sent
+func TestClientErrorHandling(t *testing.T) {
+	testCases := []struct {
+		name    string
+		baseURL string
+		inputs  map[string]interface{}
+	}{
+		{
+			name:    "invalid JSON marshaling",
+			baseURL: "https://api.dify.ai",
+			inputs:  map[string]interface{}{"query": make(chan int)},
+		},
+		{
+			name:    "invalid URL",
+			baseURL: "://invalid-url",
+			inputs:  map[string]interface{}{"query": "test"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewClient(tc.baseURL, "app-BY4mKffjRdOJemnxqX4d7ThY", nil)
+			resp, err := client.RunWorkflowStream(context.Background(), &WorkflowRunRequest{Inputs: tc.inputs})
+			if err == nil {
+				t.Error("Expected error but got none")
+			}
+			if resp != nil {
+				t.Error("Expected nil response when error occurs")
+			}
+		})
+	}
+}
+
+// TestBlockingCalls tests typed decoding of blocking and list endpoints
+func TestBlockingCalls(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/chat-messages":
+			var req ChatRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			if req.ResponseMode != ResponseModeBlocking {
+				t.Errorf("Expected blocking response mode, got %s", req.ResponseMode)
+			}
+			w.Write([]byte(`{"event": "message", "task_id": "t1", "message_id": "m1", "conversation_id": "c1",
+				"answer": "hello", "metadata": {"usage": {"total_tokens": 42, "total_price": "0.001", "currency": "USD"}}}`))
+		case "/v1/conversations":
+			if r.URL.Query().Get("user") != "u1" || r.URL.Query().Get("limit") != "5" {
+				t.Errorf("Unexpected query %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"limit": 5, "has_more": true, "data": [{"id": "c1", "name": "incident"}]}`))
+		case "/v1/messages":
+			if r.URL.Query().Get("conversation_id") != "c1" {
+				t.Errorf("Unexpected query %s", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"limit": 20, "has_more": false, "data": [{"id": "m1", "query": "q", "answer": "a"}]}`))
+		case "/v1/parameters":
+			w.Write([]byte(`{"opening_statement": "hi", "suggested_questions": ["why?"]}`))
+		case "/v1/files/upload":
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Errorf("ParseMultipartForm: %v", err)
+			}
+			if r.FormValue("user") != "u1" {
+				t.Errorf("Expected user u1, got %s", r.FormValue("user"))
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"id": "f1", "name": "log.txt", "size": 5}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`not found`))
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	client := NewClient(server.URL+"/", "key", nil)
+
+	chat, err := client.ChatMessages(ctx, &ChatRequest{Query: "hi", User: "u1"})
+	if err != nil {
+		t.Fatalf("ChatMessages: %v", err)
+	}
+	if chat.Answer != "hello" || chat.ConversationID != "c1" || chat.Metadata.Usage.TotalTokens != 42 {
+		t.Errorf("Unexpected chat response: %+v", chat)
+	}
+
+	conversations, err := client.Conversations(ctx, ConversationsParams{User: "u1", Limit: 5})
+	if err != nil {
+		t.Fatalf("Conversations: %v", err)
+	}
+	if !conversations.HasMore || len(conversations.Data) != 1 || conversations.Data[0].Name != "incident" {
+		t.Errorf("Unexpected conversations: %+v", conversations)
+	}
+
+	messages, err := client.Messages(ctx, MessagesParams{User: "u1", ConversationID: "c1"})
+	if err != nil {
+		t.Fatalf("Messages: %v", err)
+	}
+	if len(messages.Data) != 1 || messages.Data[0].Answer != "a" {
+		t.Errorf("Unexpected messages: %+v", messages)
+	}
+
+	params, err := client.Parameters(ctx, "u1")
+	if err != nil {
+		t.Fatalf("Parameters: %v", err)
+	}
+	if params.OpeningStatement != "hi" || len(params.SuggestedQuestions) != 1 {
+		t.Errorf("Unexpected parameters: %+v", params)
+	}
+
+	file, err := client.UploadFile(ctx, "u1", "log.txt", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("UploadFile: %v", err)
+	}
+	if file.ID != "f1" {
+		t.Errorf("Unexpected upload: %+v", file)
+	}
+
+	_, err = client.RunWorkflow(ctx, &WorkflowRunRequest{})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound || apiErr.Message != "not found" {
+		t.Errorf("Expected 404 APIError, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package dify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxErrorBody bounds how much of an error response is read.
+const maxErrorBody = 64 * 1024
+
+// APIError is returned for any non-2xx response from Dify.
+type APIError struct {
+	StatusCode int    `json:"status"`
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	// RetryAfter is the wait Dify asked for in a Retry-After header.
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("dify: status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("dify: status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// newAPIError builds an APIError from a failed response and closes its body.
+// Dify normally answers {"code": ..., "message": ..., "status": ...}; other
+// bodies are kept verbatim as the message.
+func newAPIError(resp *http.Response) *APIError {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+
+	apiErr := &APIError{}
+	if err := json.Unmarshal(body, apiErr); err != nil || (apiErr.Code == "" && apiErr.Message == "") {
+		apiErr.Message = string(body)
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	apiErr.StatusCode = resp.StatusCode
+	apiErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return apiErr
+}
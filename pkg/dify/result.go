@@ -0,0 +1,104 @@
+package dify
+
+import (
+	"strconv"
+)
+
+// Result is the final outcome of a streamed chat message, completion or
+// workflow run, built by adding the stream's events in order.
+type Result struct {
+	TaskID         string `json:"task_id,omitempty"`
+	MessageID      string `json:"message_id,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	WorkflowRunID  string `json:"workflow_run_id,omitempty"`
+
+	// Answer is the concatenated text of message, agent_message and
+	// text_chunk events.
+	Answer string `json:"answer"`
+	// Status and Outputs are set by workflow_finished.
+	Status  string                 `json:"status,omitempty"`
+	Outputs map[string]interface{} `json:"outputs,omitempty"`
+	// Metadata is set by message_end.
+	Metadata *Metadata `json:"metadata,omitempty"`
+	// Usage is taken from message_end, or summed over workflow nodes.
+	Usage *Usage        `json:"usage,omitempty"`
+	Files []MessageFile `json:"files,omitempty"`
+	// Error is set when the stream reported an error event or a failed run.
+	Error *APIError `json:"error,omitempty"`
+
+	// Done is true once a message_end or workflow_finished event was seen.
+	Done bool `json:"-"`
+}
+
+// Add folds one event into the result.
+func (r *Result) Add(ev *Event) {
+	if ev.TaskID != "" {
+		r.TaskID = ev.TaskID
+	}
+	if ev.MessageID != "" {
+		r.MessageID = ev.MessageID
+	}
+	if ev.ConversationID != "" {
+		r.ConversationID = ev.ConversationID
+	}
+	if ev.WorkflowRunID != "" {
+		r.WorkflowRunID = ev.WorkflowRunID
+	}
+
+	switch ev.Event {
+	case EventMessage, EventAgentMessage:
+		r.Answer += ev.Answer
+	case EventMessageReplace:
+		r.Answer = ev.Answer
+	case EventTextChunk:
+		if ev.Data != nil {
+			r.Answer += ev.Data.Text
+		}
+	case EventMessageFile:
+		r.Files = append(r.Files, MessageFile{ID: ev.ID, Type: ev.Type, URL: ev.URL, BelongsTo: ev.BelongsTo})
+	case EventMessageEnd:
+		r.Done = true
+		if ev.Metadata != nil {
+			r.Metadata = ev.Metadata
+			usage := ev.Metadata.Usage
+			r.Usage = &usage
+		}
+	case EventNodeFinished:
+		if ev.Data != nil && ev.Data.ExecutionMetadata != nil {
+			r.addNodeUsage(ev.Data.ExecutionMetadata)
+		}
+	case EventWorkflowFinished:
+		r.Done = true
+		if ev.Data == nil {
+			return
+		}
+		r.Status = ev.Data.Status
+		r.Outputs = ev.Data.Outputs
+		if ev.Data.TotalTokens > 0 {
+			if r.Usage == nil {
+				r.Usage = &Usage{}
+			}
+			r.Usage.TotalTokens = ev.Data.TotalTokens
+		}
+		if ev.Data.Error != "" {
+			r.Error = &APIError{Code: ev.Data.Status, Message: ev.Data.Error}
+		}
+	case EventError:
+		r.Error = &APIError{StatusCode: ev.Status, Code: ev.Code, Message: ev.Message}
+	}
+}
+
+// addNodeUsage adds the cost of a finished workflow node to the run's usage.
+func (r *Result) addNodeUsage(meta *ExecutionMetadata) {
+	if r.Usage == nil {
+		r.Usage = &Usage{}
+	}
+	r.Usage.TotalTokens += meta.TotalTokens
+	if meta.Currency != "" {
+		r.Usage.Currency = meta.Currency
+	}
+	if price, err := strconv.ParseFloat(meta.TotalPrice, 64); err == nil && price != 0 {
+		total, _ := strconv.ParseFloat(r.Usage.TotalPrice, 64)
+		r.Usage.TotalPrice = strconv.FormatFloat(total+price, 'f', -1, 64)
+	}
+}
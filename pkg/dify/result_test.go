@@ -0,0 +1,93 @@
+package dify
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestResult tests folding a stream into its final result
+func TestResult(t *testing.T) {
+	testCases := []struct {
+		name   string
+		stream string
+		check  func(t *testing.T, r *Result)
+	}{
+		{
+			name: "chat answer with usage",
+			stream: `data: {"event": "agent_message", "task_id": "t1", "message_id": "m1", "conversation_id": "c1", "answer": "a"}
+
+data: {"event": "message_file", "id": "f1", "type": "image", "url": "u"}
+
+data: {"event": "agent_message", "task_id": "t1", "answer": "b"}
+
+data: {"event": "message_end", "task_id": "t1", "metadata": {"usage": {"total_tokens": 7, "total_price": "0.1"}}}
+`,
+			check: func(t *testing.T, r *Result) {
+				if r.Answer != "ab" || r.ConversationID != "c1" || r.MessageID != "m1" || !r.Done {
+					t.Errorf("Unexpected result: %+v", r)
+				}
+				if len(r.Files) != 1 || r.Usage == nil || r.Usage.TotalTokens != 7 {
+					t.Errorf("Unexpected files or usage: %+v %+v", r.Files, r.Usage)
+				}
+			},
+		},
+		{
+			name: "message_replace overrides answer",
+			stream: `data: {"event": "message", "answer": "secret"}
+
+data: {"event": "message_replace", "answer": "redacted"}
+`,
+			check: func(t *testing.T, r *Result) {
+				if r.Answer != "redacted" || r.Done {
+					t.Errorf("Unexpected result: %+v", r)
+				}
+			},
+		},
+		{
+			name: "workflow sums node usage",
+			stream: `data: {"event": "text_chunk", "data": {"text": "x"}}
+
+data: {"event": "node_finished", "data": {"execution_metadata": {"total_tokens": 3, "total_price": "0.25", "currency": "USD"}}}
+
+data: {"event": "node_finished", "data": {"execution_metadata": {"total_tokens": 4, "total_price": "0.5", "currency": "USD"}}}
+
+data: {"event": "workflow_finished", "data": {"status": "failed", "error": "boom", "outputs": {"a": 1}}}
+`,
+			check: func(t *testing.T, r *Result) {
+				if r.Answer != "x" || r.Status != "failed" || r.Outputs["a"] != float64(1) {
+					t.Errorf("Unexpected result: %+v", r)
+				}
+				if r.Usage.TotalTokens != 7 || r.Usage.TotalPrice != "0.75" || r.Usage.Currency != "USD" {
+					t.Errorf("Unexpected usage: %+v", r.Usage)
+				}
+				if r.Error == nil || r.Error.Message != "boom" {
+					t.Errorf("Expected run error, got %+v", r.Error)
+				}
+			},
+		},
+		{
+			name:   "error event",
+			stream: `data: {"event": "error", "status": 429, "code": "rate_limit", "message": "slow down"}`,
+			check: func(t *testing.T, r *Result) {
+				if r.Error == nil || r.Error.StatusCode != 429 || r.Error.Code != "rate_limit" {
+					t.Errorf("Unexpected error: %+v", r.Error)
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var r Result
+			d := NewDecoder(strings.NewReader(tc.stream))
+			for {
+				ev, err := d.Next()
+				if err != nil {
+					break
+				}
+				r.Add(ev)
+			}
+			tc.check(t, &r)
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package dify
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy makes a Client retry idempotent calls when Dify fails
+// transiently, see Retryable. The opening of streams is only retried after
+// failures Dify cannot have acted on, see RetryableUnsent. Blocking
+// generation calls and stop calls are never retried.
+type RetryPolicy struct {
+	// MaxAttempts bounds the attempts of a call, including the first. Values
+	// below 2 disable retries.
+	MaxAttempts int
+	// BaseDelay is the backoff cap of the first retry. It doubles with every
+	// further retry, up to MaxDelay. The actual delay is drawn at random
+	// below the cap.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// OnRetry, if set, is called before waiting for a retry.
+	OnRetry func(req *http.Request, attempt int, err error, delay time.Duration)
+}
+
+// WithRetry sets the retry policy of c and returns c.
+func (c *Client) WithRetry(p RetryPolicy) *Client {
+	c.retry = p
+	return c
+}
+
+// Retryable reports whether err is a transient failure worth retrying an
+// idempotent call after: a 429, 502 or 503 answer, or a connection that was
+// refused, reset or cut short.
+func Retryable(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// RetryableUnsent reports whether err is a transient failure that Dify
+// cannot have acted on: a 429, 502 or 503 answer, or a connection that could
+// not be made. Calls that start a generation are only retried after these.
+// Once a connection drops, Dify may already run the generation, and a retry
+// would run and bill it twice.
+func RetryableUnsent(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return Retryable(err)
+	}
+	var opErr *net.OpError
+	return errors.Is(err, syscall.ECONNREFUSED) || (errors.As(err, &opErr) && opErr.Op == "dial")
+}
+
+// delay returns the wait before retrying after the given attempt. A
+// Retry-After from Dify is honored; if it exceeds MaxDelay, delay reports
+// false and the call is not retried.
+func (p RetryPolicy) delay(attempt int, err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter, p.MaxDelay <= 0 || apiErr.RetryAfter <= p.MaxDelay
+	}
+	limit := p.BaseDelay << (attempt - 1)
+	if limit <= 0 || (p.MaxDelay > 0 && limit > p.MaxDelay) {
+		limit = p.MaxDelay
+	}
+	if limit <= 0 {
+		return 0, true
+	}
+	return time.Duration(rand.Int63n(int64(limit))), true
+}
+
+// doRetry sends req like do, retrying transient failures under the client's
+// retry policy. Only GET requests are idempotent; others are retried after
+// failures Dify cannot have acted on. The request body must be replayable
+// through GetBody.
+func (c *Client) doRetry(req *http.Request) (*http.Response, error) {
+	p := c.retry
+	ctx := req.Context()
+	retryable := Retryable
+	if req.Method != http.MethodGet {
+		retryable = RetryableUnsent
+	}
+	for attempt := 1; ; attempt++ {
+		resp, err := c.do(req)
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) || ctx.Err() != nil {
+			return resp, err
+		}
+		wait, ok := p.delay(attempt, err)
+		if !ok {
+			return nil, err
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(req, attempt, err, wait)
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+
+		next := req.Clone(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			next.Body = body
+		}
+		req = next
+	}
+}
+
+// sleep waits for d or until ctx ends.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP
+// date. It returns 0 if the header is missing or malformed.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if at, err := http.ParseTime(v); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+package dify
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestRetry tests which calls are retried and how Retry-After is honored
+func TestRetry(t *testing.T) {
+	var calls, failures, drops atomic.Int32
+	var retryAfter atomic.Value
+	retryAfter.Store("")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		if drops.Add(-1) >= 0 {
+			// Dify accepted the request, then the connection dropped.
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		if failures.Add(-1) >= 0 {
+			w.Header().Set("Retry-After", retryAfter.Load().(string))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Method == http.MethodPost && len(body) == 0 {
+			t.Error("Expected the retried request to carry its body")
+		}
+		if r.Header.Get("Accept") == "text/event-stream" {
+			w.Write([]byte("data: {\"event\": \"message_end\"}\n\n"))
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	var retries []time.Duration
+	client := NewClient(server.URL, "key", nil).WithRetry(RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		OnRetry: func(_ *http.Request, _ int, _ error, delay time.Duration) {
+			retries = append(retries, delay)
+		},
+	})
+	ctx := context.Background()
+	reset := func(n int32, after string) {
+		calls.Store(0)
+		drops.Store(0)
+		failures.Store(n)
+		retryAfter.Store(after)
+		retries = nil
+	}
+
+	reset(2, "")
+	if _, err := client.Parameters(ctx, "u"); err != nil || calls.Load() != 3 {
+		t.Errorf("Expected GET to succeed on the third attempt, got %d calls: %v", calls.Load(), err)
+	}
+
+	reset(3, "")
+	var apiErr *APIError
+	if _, err := client.Conversations(ctx, ConversationsParams{User: "u"}); !errors.As(err, &apiErr) || calls.Load() != 3 {
+		t.Errorf("Expected the error after 3 attempts, got %d calls: %v", calls.Load(), err)
+	}
+
+	reset(1, "1")
+	resp, err := client.ChatMessagesStream(ctx, &ChatRequest{Query: "hi", User: "u"})
+	if err != nil {
+		t.Fatalf("Expected the stream to open after a retry: %v", err)
+	}
+	resp.Body.Close()
+	if len(retries) != 1 || retries[0] != time.Second {
+		t.Errorf("Expected one retry after the Retry-After second, got %v", retries)
+	}
+
+	reset(0, "")
+	drops.Store(1)
+	if _, err := client.ChatMessagesStream(ctx, &ChatRequest{Query: "hi", User: "u"}); err == nil || calls.Load() != 1 {
+		t.Errorf("Expected a stream whose connection dropped not to be retried, got %d calls: %v", calls.Load(), err)
+	}
+	reset(0, "")
+	drops.Store(1)
+	if _, err := client.Parameters(ctx, "u"); err != nil || calls.Load() != 2 {
+		t.Errorf("Expected GET to be retried after a dropped connection, got %d calls: %v", calls.Load(), err)
+	}
+
+	reset(1, "5")
+	if _, err := client.Parameters(ctx, "u"); err == nil || calls.Load() != 1 {
+		t.Errorf("Expected a Retry-After beyond MaxDelay to fail right away, got %d calls: %v", calls.Load(), err)
+	}
+
+	reset(1, "")
+	if _, err := client.ChatMessages(ctx, &ChatRequest{Query: "hi", User: "u"}); err == nil || calls.Load() != 1 {
+		t.Errorf("Expected blocking calls not to be retried, got %d calls: %v", calls.Load(), err)
+	}
+}
+
+// TestRetryable tests the classification of transient failures
+func TestRetryable(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected bool
+	}{
+		{&APIError{StatusCode: http.StatusTooManyRequests}, true},
+		{&APIError{StatusCode: http.StatusBadGateway}, true},
+		{&APIError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&APIError{StatusCode: http.StatusInternalServerError}, false},
+		{&APIError{StatusCode: http.StatusBadRequest}, false},
+		{io.ErrUnexpectedEOF, true},
+		{context.DeadlineExceeded, false},
+	}
+	for _, tc := range testCases {
+		if got := Retryable(tc.err); got != tc.expected {
+			t.Errorf("Retryable(%v) = %v, expected %v", tc.err, got, tc.expected)
+		}
+	}
+
+	unsent := []struct {
+		err      error
+		expected bool
+	}{
+		{&APIError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{&url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host"}}}, true},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, false},
+		{io.ErrUnexpectedEOF, false},
+	}
+	for _, tc := range unsent {
+		if got := RetryableUnsent(tc.err); got != tc.expected {
+			t.Errorf("RetryableUnsent(%v) = %v, expected %v", tc.err, got, tc.expected)
+		}
+	}
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := parseRetryAfter(now.Add(3*time.Second).Format(http.TimeFormat), now); got != 3*time.Second {
+		t.Errorf("Expected an HTTP date Retry-After of 3s, got %v", got)
+	}
+}
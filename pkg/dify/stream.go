@@ -0,0 +1,176 @@
+package dify
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// Event types sent by Dify in streaming mode.
+const (
+	EventMessage          = "message"
+	EventAgentMessage     = "agent_message"
+	EventAgentThought     = "agent_thought"
+	EventMessageFile      = "message_file"
+	EventMessageReplace   = "message_replace"
+	EventMessageEnd       = "message_end"
+	EventWorkflowStarted  = "workflow_started"
+	EventNodeStarted      = "node_started"
+	EventNodeFinished     = "node_finished"
+	EventTextChunk        = "text_chunk"
+	EventWorkflowFinished = "workflow_finished"
+	EventError            = "error"
+	EventPing             = "ping"
+)
+
+// Event is one event of a Dify stream. Only the fields relevant to the
+// event type are set.
+type Event struct {
+	Event          string `json:"event"`
+	TaskID         string `json:"task_id,omitempty"`
+	ID             string `json:"id,omitempty"`
+	MessageID      string `json:"message_id,omitempty"`
+	ConversationID string `json:"conversation_id,omitempty"`
+	WorkflowRunID  string `json:"workflow_run_id,omitempty"`
+	CreatedAt      int64  `json:"created_at,omitempty"`
+
+	// Answer is the text chunk of message, agent_message and message_replace events.
+	Answer string `json:"answer,omitempty"`
+	// Metadata is sent with message_end.
+	Metadata *Metadata `json:"metadata,omitempty"`
+	// Data is the payload of workflow, node and text_chunk events.
+	Data *EventData `json:"data,omitempty"`
+
+	// Agent thought fields.
+	Position    int    `json:"position,omitempty"`
+	Thought     string `json:"thought,omitempty"`
+	Observation string `json:"observation,omitempty"`
+	Tool        string `json:"tool,omitempty"`
+	ToolInput   string `json:"tool_input,omitempty"`
+
+	// Message file fields.
+	Type      string `json:"type,omitempty"`
+	BelongsTo string `json:"belongs_to,omitempty"`
+	URL       string `json:"url,omitempty"`
+
+	// Error fields.
+	Status  int    `json:"status,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+
+	// Raw is the event payload exactly as received, so events can be
+	// forwarded without being re-encoded.
+	Raw []byte `json:"-"`
+}
+
+// EventData is the data object of workflow, node and text_chunk events.
+type EventData struct {
+	ID                string                 `json:"id,omitempty"`
+	WorkflowID        string                 `json:"workflow_id,omitempty"`
+	NodeID            string                 `json:"node_id,omitempty"`
+	NodeType          string                 `json:"node_type,omitempty"`
+	Title             string                 `json:"title,omitempty"`
+	Index             int                    `json:"index,omitempty"`
+	Status            string                 `json:"status,omitempty"`
+	Text              string                 `json:"text,omitempty"`
+	Outputs           map[string]interface{} `json:"outputs,omitempty"`
+	Error             string                 `json:"error,omitempty"`
+	ElapsedTime       float64                `json:"elapsed_time,omitempty"`
+	TotalTokens       int                    `json:"total_tokens,omitempty"`
+	TotalSteps        int                    `json:"total_steps,omitempty"`
+	ExecutionMetadata *ExecutionMetadata     `json:"execution_metadata,omitempty"`
+	CreatedAt         int64                  `json:"created_at,omitempty"`
+	FinishedAt        int64                  `json:"finished_at,omitempty"`
+}
+
+// ExecutionMetadata reports the cost of a finished workflow node.
+type ExecutionMetadata struct {
+	TotalTokens int    `json:"total_tokens,omitempty"`
+	TotalPrice  string `json:"total_price,omitempty"`
+	Currency    string `json:"currency,omitempty"`
+}
+
+// Encode returns the event in server-sent events wire format.
+func (e *Event) Encode() []byte {
+	if len(e.Raw) == 0 {
+		if e.Event == EventPing {
+			return []byte("event: ping\n\n")
+		}
+		raw, _ := json.Marshal(e)
+		return append(append([]byte("data: "), raw...), '\n', '\n')
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(e.Raw) + 8)
+	buf.WriteString("data: ")
+	buf.Write(e.Raw)
+	buf.WriteString("\n\n")
+	return buf.Bytes()
+}
+
+// Decoder reads events from a Dify server-sent events stream.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder returns a decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, 32*1024)}
+}
+
+// Next returns the next event of the stream, or io.EOF once the stream ends.
+// Payloads that are not valid JSON are returned with an empty Event field
+// and the payload in Raw.
+func (d *Decoder) Next() (*Event, error) {
+	var (
+		data      []byte
+		eventName string
+		hasData   bool
+	)
+	for {
+		line, err := d.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			// A final event without its terminating blank line is still delivered.
+			if err == io.EOF && (hasData || eventName != "") {
+				return newEvent(eventName, data, hasData), nil
+			}
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		if len(line) == 0 {
+			if hasData || eventName != "" {
+				return newEvent(eventName, data, hasData), nil
+			}
+			continue
+		}
+
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "data":
+			if hasData {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+			hasData = true
+		case "event":
+			eventName = string(value)
+		}
+	}
+}
+
+func newEvent(name string, data []byte, hasData bool) *Event {
+	if !hasData {
+		return &Event{Event: name}
+	}
+	ev := &Event{}
+	if err := json.Unmarshal(data, ev); err != nil {
+		ev = &Event{}
+	}
+	if ev.Event == "" {
+		ev.Event = name
+	}
+	ev.Raw = data
+	return ev
+}
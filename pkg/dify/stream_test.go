@@ -0,0 +1,111 @@
+package dify
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+const testStream = `data: {"event": "workflow_started", "task_id": "t1", "workflow_run_id": "r1", "data": {"id": "r1", "workflow_id": "w1"}}
+
+data: {"event": "node_finished", "task_id": "t1", "data": {"node_id": "n1", "title": "LLM", "status": "succeeded", "execution_metadata": {"total_tokens": 12}}}
+
+event: ping
+
+data: {"event": "message", "task_id": "t1", "message_id": "m1", "conversation_id": "c1", "answer": "Hel"}
+data: {"ignored": "continuation lines are joined"}
+
+: a comment line
+
+data: {"event": "agent_thought", "id": "th1", "position": 1, "thought": "look up", "tool": "search"}
+
+data: {"event": "message_file", "id": "f1", "type": "image", "belongs_to": "assistant", "url": "https://x/f1"}
+
+data: {"event": "message_end", "task_id": "t1", "metadata": {"usage": {"prompt_tokens": 3, "completion_tokens": 4, "total_tokens": 7, "total_price": "0.0002"}}}
+
+data: {"event": "workflow_finished", "task_id": "t1", "data": {"status": "succeeded", "outputs": {"text": "done"}, "total_tokens": 19}}
+
+data: {"event": "error", "status": 400, "code": "provider_quota_exceeded", "message": "quota"}
+
+data: not json
+`
+
+// TestDecoder tests decoding of each Dify event type
+func TestDecoder(t *testing.T) {
+	d := NewDecoder(strings.NewReader(testStream))
+
+	var events []*Event
+	for {
+		ev, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		events = append(events, ev)
+	}
+
+	expected := []string{
+		EventWorkflowStarted, EventNodeFinished, EventPing, "", EventAgentThought,
+		EventMessageFile, EventMessageEnd, EventWorkflowFinished, EventError, "",
+	}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for i, ev := range events {
+		if ev.Event != expected[i] {
+			t.Errorf("Event %d: expected %q, got %q", i, expected[i], ev.Event)
+		}
+	}
+
+	if events[0].WorkflowRunID != "r1" || events[0].Data.WorkflowID != "w1" {
+		t.Errorf("Unexpected workflow_started: %+v", events[0])
+	}
+	if events[1].Data.NodeID != "n1" || events[1].Data.ExecutionMetadata.TotalTokens != 12 {
+		t.Errorf("Unexpected node_finished: %+v", events[1].Data)
+	}
+	if string(events[2].Encode()) != "event: ping\n\n" {
+		t.Errorf("Unexpected ping encoding %q", events[2].Encode())
+	}
+	// Two data lines form one payload, which is then no longer valid JSON.
+	if !strings.Contains(string(events[3].Raw), "\n") {
+		t.Errorf("Expected joined data lines, got %q", events[3].Raw)
+	}
+	if events[4].Thought != "look up" || events[4].Tool != "search" {
+		t.Errorf("Unexpected agent_thought: %+v", events[4])
+	}
+	if events[5].URL != "https://x/f1" || events[5].BelongsTo != "assistant" {
+		t.Errorf("Unexpected message_file: %+v", events[5])
+	}
+	if usage := events[6].Metadata.Usage; usage.TotalTokens != 7 || usage.TotalPrice != "0.0002" {
+		t.Errorf("Unexpected message_end usage: %+v", usage)
+	}
+	if events[7].Data.Outputs["text"] != "done" {
+		t.Errorf("Unexpected workflow_finished: %+v", events[7].Data)
+	}
+	if events[8].Code != "provider_quota_exceeded" || events[8].Status != 400 {
+		t.Errorf("Unexpected error event: %+v", events[8])
+	}
+	if string(events[9].Raw) != "not json" {
+		t.Errorf("Expected raw payload to be kept, got %q", events[9].Raw)
+	}
+	if got := string(events[6].Encode()); !strings.HasPrefix(got, `data: {"event": "message_end"`) || !strings.HasSuffix(got, "\n\n") {
+		t.Errorf("Unexpected encoding %q", got)
+	}
+}
+
+// TestDecoderSingleMessage tests a message event split over CRLF lines
+func TestDecoderSingleMessage(t *testing.T) {
+	d := NewDecoder(strings.NewReader("data: {\"event\": \"message\", \"answer\": \"Hi\"}\r\n\r\n"))
+	ev, err := d.Next()
+	if err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if ev.Event != EventMessage || ev.Answer != "Hi" {
+		t.Errorf("Unexpected event: %+v", ev)
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,211 @@
+package dify
+
+import "encoding/json"
+
+// Response modes accepted by the generation endpoints.
+const (
+	ResponseModeStreaming = "streaming"
+	ResponseModeBlocking  = "blocking"
+)
+
+// File references a remote or previously uploaded file attached to a request.
+type File struct {
+	Type           string `json:"type"`
+	TransferMethod string `json:"transfer_method"`
+	URL            string `json:"url,omitempty"`
+	UploadFileID   string `json:"upload_file_id,omitempty"`
+}
+
+// ChatRequest is the body of POST /v1/chat-messages.
+type ChatRequest struct {
+	Inputs           map[string]interface{} `json:"inputs"`
+	Query            string                 `json:"query"`
+	ResponseMode     string                 `json:"response_mode"`
+	ConversationID   string                 `json:"conversation_id"`
+	User             string                 `json:"user"`
+	Files            []File                 `json:"files"`
+	AutoGenerateName *bool                  `json:"auto_generate_name,omitempty"`
+}
+
+// ChatResponse is the blocking response of POST /v1/chat-messages.
+type ChatResponse struct {
+	Event          string   `json:"event"`
+	TaskID         string   `json:"task_id"`
+	ID             string   `json:"id"`
+	MessageID      string   `json:"message_id"`
+	ConversationID string   `json:"conversation_id"`
+	Mode           string   `json:"mode"`
+	Answer         string   `json:"answer"`
+	Metadata       Metadata `json:"metadata"`
+	CreatedAt      int64    `json:"created_at"`
+}
+
+// CompletionRequest is the body of POST /v1/completion-messages. Completion
+// apps take the user prompt as inputs.query.
+type CompletionRequest struct {
+	Inputs       map[string]interface{} `json:"inputs"`
+	ResponseMode string                 `json:"response_mode"`
+	User         string                 `json:"user"`
+	Files        []File                 `json:"files"`
+}
+
+// CompletionResponse is the blocking response of POST /v1/completion-messages.
+type CompletionResponse struct {
+	Event     string   `json:"event"`
+	TaskID    string   `json:"task_id"`
+	ID        string   `json:"id"`
+	MessageID string   `json:"message_id"`
+	Mode      string   `json:"mode"`
+	Answer    string   `json:"answer"`
+	Metadata  Metadata `json:"metadata"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+// WorkflowRunRequest is the body of POST /v1/workflows/run.
+type WorkflowRunRequest struct {
+	Inputs       map[string]interface{} `json:"inputs"`
+	ResponseMode string                 `json:"response_mode"`
+	User         string                 `json:"user"`
+	Files        []File                 `json:"files,omitempty"`
+}
+
+// WorkflowRunResponse is the blocking response of POST /v1/workflows/run.
+type WorkflowRunResponse struct {
+	TaskID        string          `json:"task_id"`
+	WorkflowRunID string          `json:"workflow_run_id"`
+	Data          WorkflowRunData `json:"data"`
+}
+
+// WorkflowRunData describes a finished workflow run.
+type WorkflowRunData struct {
+	ID          string                 `json:"id"`
+	WorkflowID  string                 `json:"workflow_id"`
+	Status      string                 `json:"status"`
+	Outputs     map[string]interface{} `json:"outputs"`
+	Error       string                 `json:"error,omitempty"`
+	ElapsedTime float64                `json:"elapsed_time"`
+	TotalTokens int                    `json:"total_tokens"`
+	TotalSteps  int                    `json:"total_steps"`
+	CreatedAt   int64                  `json:"created_at"`
+	FinishedAt  int64                  `json:"finished_at"`
+}
+
+// Metadata is attached to finished chat and completion messages.
+type Metadata struct {
+	Usage              Usage             `json:"usage"`
+	RetrieverResources []json.RawMessage `json:"retriever_resources,omitempty"`
+}
+
+// Usage reports model token usage and cost. Dify encodes prices as decimal
+// strings.
+type Usage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	PromptPrice      string  `json:"prompt_price,omitempty"`
+	CompletionTokens int     `json:"completion_tokens"`
+	CompletionPrice  string  `json:"completion_price,omitempty"`
+	TotalTokens      int     `json:"total_tokens"`
+	TotalPrice       string  `json:"total_price,omitempty"`
+	Currency         string  `json:"currency,omitempty"`
+	Latency          float64 `json:"latency,omitempty"`
+}
+
+// ConversationsParams are the query parameters of GET /v1/conversations.
+type ConversationsParams struct {
+	User   string
+	LastID string
+	Limit  int
+	SortBy string
+}
+
+// ConversationList is a page of conversations.
+type ConversationList struct {
+	Limit   int            `json:"limit"`
+	HasMore bool           `json:"has_more"`
+	Data    []Conversation `json:"data"`
+}
+
+// Conversation is a chat conversation owned by one user.
+type Conversation struct {
+	ID           string                 `json:"id"`
+	Name         string                 `json:"name"`
+	Inputs       map[string]interface{} `json:"inputs"`
+	Status       string                 `json:"status"`
+	Introduction string                 `json:"introduction"`
+	CreatedAt    int64                  `json:"created_at"`
+	UpdatedAt    int64                  `json:"updated_at"`
+}
+
+// MessagesParams are the query parameters of GET /v1/messages.
+type MessagesParams struct {
+	User           string
+	ConversationID string
+	FirstID        string
+	Limit          int
+}
+
+// MessageList is a page of conversation messages, oldest first.
+type MessageList struct {
+	Limit   int       `json:"limit"`
+	HasMore bool      `json:"has_more"`
+	Data    []Message `json:"data"`
+}
+
+// Message is one query/answer pair of a conversation.
+type Message struct {
+	ID                 string                 `json:"id"`
+	ConversationID     string                 `json:"conversation_id"`
+	Inputs             map[string]interface{} `json:"inputs"`
+	Query              string                 `json:"query"`
+	Answer             string                 `json:"answer"`
+	MessageFiles       []MessageFile          `json:"message_files"`
+	Feedback           json.RawMessage        `json:"feedback"`
+	RetrieverResources []json.RawMessage      `json:"retriever_resources"`
+	CreatedAt          int64                  `json:"created_at"`
+}
+
+// MessageFile is a file attached to or produced by a message.
+type MessageFile struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	URL       string `json:"url"`
+	BelongsTo string `json:"belongs_to"`
+}
+
+// Parameters describes an app's input form and features, as returned by
+// GET /v1/parameters.
+type Parameters struct {
+	OpeningStatement   string            `json:"opening_statement"`
+	SuggestedQuestions []string          `json:"suggested_questions"`
+	UserInputForm      []json.RawMessage `json:"user_input_form"`
+	FileUpload         json.RawMessage   `json:"file_upload,omitempty"`
+	SystemParameters   json.RawMessage   `json:"system_parameters,omitempty"`
+}
+
+// App modes reported by GET /v1/info.
+const (
+	AppModeChat         = "chat"
+	AppModeAdvancedChat = "advanced-chat"
+	AppModeAgentChat    = "agent-chat"
+	AppModeCompletion   = "completion"
+	AppModeWorkflow     = "workflow"
+)
+
+// AppInfo is the response of GET /v1/info.
+type AppInfo struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Mode        string   `json:"mode"`
+	AuthorName  string   `json:"author_name"`
+}
+
+// UploadedFile is the response of POST /v1/files/upload.
+type UploadedFile struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Extension string `json:"extension"`
+	MimeType  string `json:"mime_type"`
+	CreatedBy string `json:"created_by"`
+	CreatedAt int64  `json:"created_at"`
+}
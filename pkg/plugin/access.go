@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Route groups that access rules are configured for in jsonData.access.
+const (
+	accessRead       = "read"
+	accessChat       = "chat"
+	accessCompletion = "completion"
+	accessWorkflow   = "workflow"
+	accessAdmin      = "admin"
+)
+
+// Grafana org roles, lowest first. roleNone denies a group to everyone.
+const (
+	roleNone   = "None"
+	roleViewer = "Viewer"
+	roleEditor = "Editor"
+	roleAdmin  = "Admin"
+)
+
+var roleRank = map[string]int{
+	roleNone:   0,
+	roleViewer: 1,
+	roleEditor: 2,
+	roleAdmin:  3,
+}
+
+// defaultAccess is the minimum role per route group. Workflows may run
+// costly automations, so they need an Editor unless configured otherwise.
+var defaultAccess = map[string]string{
+	accessRead:       roleViewer,
+	accessChat:       roleViewer,
+	accessCompletion: roleViewer,
+	accessWorkflow:   roleEditor,
+	accessAdmin:      roleAdmin,
+}
+
+// requiredRole returns the minimum org role for a route group.
+func (s *pluginSettings) requiredRole(group string) (string, error) {
+	role, ok := s.Access[group]
+	if !ok || role == "" {
+		return defaultAccess[group], nil
+	}
+	if _, known := roleRank[role]; !known {
+		return "", &ConfigError{"access." + group + " has unknown role: " + role}
+	}
+	return role, nil
+}
+
+// hasRole reports whether user holds at least role in the request's org.
+// Requests without a user, or requiring roleNone, are denied.
+func hasRole(user *backend.User, role string) bool {
+	if user == nil || role == roleNone {
+		return false
+	}
+	return roleRank[user.Role] >= roleRank[role]
+}
+
+// authorize wraps a route handler with the access rule of its group.
+// Denials are answered with 403 and recorded in the audit log.
+func (a *App) authorize(group string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		settings, err := getSettings(req)
+		if err != nil {
+			writeConfigError(w, err)
+			return
+		}
+		role, err := settings.requiredRole(group)
+		if err != nil {
+			writeConfigError(w, err)
+			return
+		}
+		user := backend.PluginConfigFromContext(req.Context()).User
+		if !hasRole(user, role) {
+			audit(req, auditAccessDenied, "route", req.URL.Path, "group", group, "required_role", role)
+			http.Error(w, "access denied: "+group+" requires the "+role+" role", http.StatusForbidden)
+			return
+		}
+		next(w, req)
+	}
+}
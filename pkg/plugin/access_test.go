@@ -0,0 +1,124 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestAuthorize tests the per-route access rules
+func TestAuthorize(t *testing.T) {
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	testCases := []struct {
+		name           string
+		access         string
+		role           string
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{
+			name:           "viewer may list apps",
+			role:           roleViewer,
+			method:         http.MethodGet,
+			path:           "apps",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "request without user",
+			method:         http.MethodGet,
+			path:           "apps",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "viewer may not run workflows by default",
+			role:           roleViewer,
+			method:         http.MethodPost,
+			path:           "difyWorkflowStop",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "editor may run workflows",
+			role:           roleEditor,
+			method:         http.MethodPost,
+			path:           "difyWorkflowStop",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "viewer allowed workflows by config",
+			access:         `{"workflow": "Viewer"}`,
+			role:           roleViewer,
+			method:         http.MethodPost,
+			path:           "difyWorkflowStop",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "editor may not read the config status",
+			role:           roleEditor,
+			method:         http.MethodGet,
+			path:           "configStatus",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "admin may read the config status",
+			role:           roleAdmin,
+			method:         http.MethodGet,
+			path:           "configStatus?probe=false",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "group disabled for everyone",
+			access:         `{"chat": "None"}`,
+			role:           roleAdmin,
+			method:         http.MethodPost,
+			path:           "difyChatStop",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "unknown role in config",
+			access:         `{"chat": "Owner"}`,
+			role:           roleAdmin,
+			method:         http.MethodPost,
+			path:           "difyChatStop",
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "ping needs no role",
+			method:         http.MethodGet,
+			path:           "ping",
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			access := tc.access
+			if access == "" {
+				access = "{}"
+			}
+			var user *backend.User
+			if tc.role != "" {
+				user = &backend.User{Login: "someone", Role: tc.role}
+			}
+
+			resp := callResource(t, app, backend.PluginContext{
+				OrgID: 1,
+				User:  user,
+				AppInstanceSettings: &backend.AppInstanceSettings{
+					JSONData:                []byte(`{"apiUrl": "http://dify.invalid", "access": ` + access + `}`),
+					DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+				},
+			}, tc.method, tc.path, "")
+			if resp.Status != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, resp.Status, resp.Body)
+			}
+		})
+	}
+}
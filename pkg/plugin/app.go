@@ -3,6 +3,7 @@ package plugin
 import (
 	"context"
 	"net/http"
+	"sync"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
@@ -20,20 +21,65 @@ var (
 )
 
 // App is an example app plugin with a backend which can respond to data queries.
+//
+// Grafana creates an instance per org and replaces it whenever the settings
+// change. State that must outlive that, such as usage, limits, open
+// circuits, endpoint pins, pseudonyms and open files, lives in the shared*
+// package variables that every instance refers to.
 type App struct {
 	backend.CallResourceHandler
+
+	conversations *conversationOwnership
+	// httpClient carries all Dify traffic of the instance.
+	httpClient *http.Client
+	usage      *usageLedger
+	limits     *limiter
+	breakers   *breakers
+	// heldEndpoints keeps the breakers of the instance's endpoints until
+	// Dispose, see breakers.hold.
+	heldEndpoints []string
+	endpoints     *endpointPool
+	affinity      *endpointAffinity
+	mappings      *pseudonymStore
+	// stopProbes ends the background endpoint probes, if any run.
+	stopProbes context.CancelFunc
+	// maintenance bounds the background conversation store maintenance,
+	// started once by the first request, see maintainConversationStore.
+	// stopMaintenance ends it.
+	maintenance     context.Context
+	stopMaintenance context.CancelFunc
+	maintainStore   sync.Once
 }
 
 // NewApp creates a new example *App instance.
-func NewApp(_ context.Context, _ backend.AppInstanceSettings) (instancemgmt.Instance, error) {
-	var app App
+func NewApp(_ context.Context, settings backend.AppInstanceSettings) (instancemgmt.Instance, error) {
+	httpClient, err := newHTTPClient(&settings)
+	if err != nil {
+		return nil, err
+	}
+	app := App{
+		conversations: newConversationOwnership(conversationOwnershipTTL),
+		httpClient:    httpClient,
+		usage:         sharedUsage,
+		limits:        sharedLimits,
+		breakers:      sharedBreakers,
+		endpoints:     newEndpointPool(),
+		affinity:      sharedAffinity,
+		mappings:      sharedPseudonyms,
+	}
+	app.maintenance, app.stopMaintenance = context.WithCancel(context.Background())
+	app.heldEndpoints = instanceEndpoints(&settings)
+	app.breakers.hold(app.heldEndpoints)
+	persistSharedUsage()
+	persistSharedPseudonyms()
+	app.startEndpointProbes(&settings)
 
 	// Use a httpadapter (provided by the SDK) for resource calls. This allows us
 	// to use a *http.ServeMux for resource calls, so we can map multiple routes
 	// to CallResource without having to implement extra logic.
 	mux := http.NewServeMux()
 	app.registerRoutes(mux)
-	app.CallResourceHandler = httpadapter.New(mux)
+	app.CallResourceHandler = httpadapter.New(instrument(mux))
 
 	return &app, nil
 }
@@ -41,13 +87,10 @@ func NewApp(_ context.Context, _ backend.AppInstanceSettings) (instancemgmt.Inst
 // Dispose here tells plugin SDK that plugin wants to clean up resources when a new instance
 // created.
 func (a *App) Dispose() {
-	// cleanup
-}
-
-// CheckHealth handles health checks sent from Grafana to the plugin.
-func (a *App) CheckHealth(_ context.Context, _ *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	return &backend.CheckHealthResult{
-		Status:  backend.HealthStatusOk,
-		Message: "ok",
-	}, nil
+	if a.stopProbes != nil {
+		a.stopProbes()
+	}
+	a.stopMaintenance()
+	a.breakers.release(a.heldEndpoints)
+	a.httpClient.CloseIdleConnections()
 }
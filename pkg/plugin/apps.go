@@ -0,0 +1,171 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Dify application types. An app's type decides which routes may use it.
+const (
+	appTypeChat       = "chat"
+	appTypeWorkflow   = "workflow"
+	appTypeCompletion = "completion"
+)
+
+const (
+	// defaultAppName names the app built from the legacy top-level apiUrl and apiKey.
+	defaultAppName = "default"
+	// defaultAPIKeyRef is the secureJsonData key used when an app does not name one.
+	defaultAPIKeyRef = "apiKey"
+)
+
+// difyApp is one named Dify application configured in jsonData.apps.
+type difyApp struct {
+	Name string `json:"name"`
+	// Type is one of appTypeChat, appTypeWorkflow or appTypeCompletion. The
+	// legacy default app has no type and may be used by every route.
+	Type   string `json:"type"`
+	APIURL string `json:"apiUrl"`
+	// APIKeyRef is the secureJsonData key holding the app's API key.
+	APIKeyRef string `json:"apiKeyRef"`
+	// Endpoints lists Dify deployments serving the app, see pickEndpoint.
+	// Without it, APIURL and APIKeyRef form the only endpoint. APIURL and
+	// the API key otherwise describe the first endpoint.
+	Endpoints []*difyEndpoint `json:"endpoints"`
+	// Balance is balancePriority or balanceWeighted.
+	Balance string `json:"balance"`
+
+	apiKey string
+}
+
+// appInfo is the browser-safe description of a difyApp returned by /apps.
+type appInfo struct {
+	Name   string `json:"name"`
+	Type   string `json:"type,omitempty"`
+	APIURL string `json:"apiUrl"`
+	HasKey bool   `json:"hasKey"`
+}
+
+// loadApps returns the Dify apps configured for the plugin instance. If no
+// apps are listed, the legacy apiUrl/apiKey pair is returned as the default app.
+func loadApps(settings *backend.AppInstanceSettings) ([]*difyApp, error) {
+	if settings == nil {
+		return nil, &ConfigError{"plugin is not configured"}
+	}
+
+	var config struct {
+		APIURL string     `json:"apiUrl"`
+		Apps   []*difyApp `json:"apps"`
+	}
+	if err := json.Unmarshal(settings.JSONData, &config); err != nil {
+		return nil, err
+	}
+
+	if len(config.Apps) == 0 {
+		if config.APIURL == "" {
+			return nil, &ConfigError{"apiUrl not found or not a string"}
+		}
+		config.Apps = []*difyApp{{Name: defaultAppName, APIURL: config.APIURL}}
+	}
+
+	seen := map[string]bool{}
+	for _, app := range config.Apps {
+		if app.Name == "" {
+			return nil, &ConfigError{"every app needs a name"}
+		}
+		if seen[app.Name] {
+			return nil, &ConfigError{"duplicate app name: " + app.Name}
+		}
+		seen[app.Name] = true
+
+		switch app.Type {
+		case "", appTypeChat, appTypeWorkflow, appTypeCompletion:
+		default:
+			return nil, &ConfigError{"app " + app.Name + " has unknown type: " + app.Type}
+		}
+		if app.APIURL == "" {
+			app.APIURL = config.APIURL
+		}
+		if app.APIKeyRef == "" {
+			app.APIKeyRef = defaultAPIKeyRef
+		}
+		if err := app.loadEndpoints(settings); err != nil {
+			return nil, err
+		}
+	}
+	return config.Apps, nil
+}
+
+// selectApp picks the app named by the request's "app" query parameter, or
+// the first app usable by a route of appType when no app is named.
+func selectApp(apps []*difyApp, name, appType string) (*difyApp, error) {
+	for _, app := range apps {
+		if name != "" && app.Name != name {
+			continue
+		}
+		if appType != "" && app.Type != "" && app.Type != appType {
+			if name != "" {
+				return nil, &ConfigError{"app " + name + " is not a " + appType + " app"}
+			}
+			continue
+		}
+		return app, nil
+	}
+	if name != "" {
+		return nil, &ConfigError{"unknown app: " + name}
+	}
+	return nil, &ConfigError{"no " + appType + " app is configured"}
+}
+
+// getPluginConfig resolves the Dify app a request targets. appType restricts
+// the choice to apps usable by the calling route; "" accepts any app.
+func getPluginConfig(req *http.Request, appType string) (*difyApp, error) {
+	pluginConfig := backend.PluginConfigFromContext(req.Context())
+	apps, err := loadApps(pluginConfig.AppInstanceSettings)
+	if err != nil {
+		return nil, err
+	}
+	app, err := selectApp(apps, req.URL.Query().Get("app"), appType)
+	if err != nil {
+		return nil, err
+	}
+	if len(app.usableEndpoints()) == 0 {
+		for _, ep := range app.Endpoints {
+			if ep.APIURL != "" {
+				return nil, &ConfigError{"API key is not set"}
+			}
+		}
+		return nil, &ConfigError{"apiUrl not found for app " + app.Name}
+	}
+	return app, nil
+}
+
+// handleApps lists the configured Dify apps without their API keys so the
+// frontend can offer an app picker.
+func (a *App) handleApps(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	apps, err := loadApps(backend.PluginConfigFromContext(req.Context()).AppInstanceSettings)
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	infos := make([]appInfo, 0, len(apps))
+	for _, app := range apps {
+		infos = append(infos, appInfo{
+			Name:   app.Name,
+			Type:   app.Type,
+			APIURL: app.APIURL,
+			HasKey: app.apiKey != "",
+		})
+	}
+	w.Header().Add("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"apps": infos}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,155 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const testAppsJSONData = `{
+	"apiUrl": "https://dify.example.com",
+	"apps": [
+		{"name": "logs", "type": "chat", "apiKeyRef": "logsKey"},
+		{"name": "triage", "type": "workflow", "apiUrl": "https://triage.example.com", "apiKeyRef": "triageKey"},
+		{"name": "postmortem", "type": "completion"}
+	]
+}`
+
+// TestGetPluginConfig tests app selection for resource routes
+func TestGetPluginConfig(t *testing.T) {
+	testCases := []struct {
+		name        string
+		jsonData    string
+		secure      map[string]string
+		query       string
+		appType     string
+		expectedApp string
+		expectedURL string
+		expectedKey string
+		expectError string
+	}{
+		{
+			name:        "legacy single app",
+			jsonData:    `{"apiUrl": "https://api.dify.ai"}`,
+			secure:      map[string]string{"apiKey": "legacy-key"},
+			appType:     appTypeWorkflow,
+			expectedApp: defaultAppName,
+			expectedURL: "https://api.dify.ai",
+			expectedKey: "legacy-key",
+		},
+		{
+			name:        "legacy app without key",
+			jsonData:    `{"apiUrl": "https://api.dify.ai"}`,
+			appType:     appTypeChat,
+			expectError: "API key is not set",
+		},
+		{
+			name:        "first app of the route type",
+			jsonData:    testAppsJSONData,
+			secure:      map[string]string{"logsKey": "k1", "triageKey": "k2"},
+			appType:     appTypeWorkflow,
+			expectedApp: "triage",
+			expectedURL: "https://triage.example.com",
+			expectedKey: "k2",
+		},
+		{
+			name:        "named app inherits top-level apiUrl",
+			jsonData:    testAppsJSONData,
+			secure:      map[string]string{"logsKey": "k1"},
+			query:       "?app=logs",
+			appType:     appTypeChat,
+			expectedApp: "logs",
+			expectedURL: "https://dify.example.com",
+			expectedKey: "k1",
+		},
+		{
+			name:        "named app of the wrong type",
+			jsonData:    testAppsJSONData,
+			secure:      map[string]string{"logsKey": "k1"},
+			query:       "?app=logs",
+			appType:     appTypeWorkflow,
+			expectError: "app logs is not a workflow app",
+		},
+		{
+			name:        "unknown app",
+			jsonData:    testAppsJSONData,
+			query:       "?app=nope",
+			appType:     appTypeChat,
+			expectError: "unknown app: nope",
+		},
+		{
+			name:        "duplicate app names",
+			jsonData:    `{"apps": [{"name": "a", "apiUrl": "u"}, {"name": "a", "apiUrl": "u"}]}`,
+			expectError: "duplicate app name: a",
+		},
+		{
+			name:        "unknown app type",
+			jsonData:    `{"apps": [{"name": "a", "type": "agent", "apiUrl": "u"}]}`,
+			expectError: "app a has unknown type: agent",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/difyChatProxy"+tc.query, nil)
+			req = req.WithContext(backend.WithPluginContext(req.Context(), backend.PluginContext{
+				AppInstanceSettings: &backend.AppInstanceSettings{
+					JSONData:                []byte(tc.jsonData),
+					DecryptedSecureJSONData: tc.secure,
+				},
+			}))
+
+			app, err := getPluginConfig(req, tc.appType)
+			if tc.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+					t.Errorf("Expected error %q, got %v", tc.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if app.Name != tc.expectedApp || app.APIURL != tc.expectedURL || app.apiKey != tc.expectedKey {
+				t.Errorf("Expected app %s (%s, %s), got %s (%s, %s)",
+					tc.expectedApp, tc.expectedURL, tc.expectedKey, app.Name, app.APIURL, app.apiKey)
+			}
+		})
+	}
+}
+
+// TestHandleApps tests that /apps lists apps without exposing keys
+func TestHandleApps(t *testing.T) {
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	resp := callResource(t, app, asUser("viewer", roleViewer, &backend.AppInstanceSettings{
+		JSONData:                []byte(testAppsJSONData),
+		DecryptedSecureJSONData: map[string]string{"logsKey": "secret-logs-key"},
+	}), http.MethodGet, "apps", "")
+	if resp.Status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.Status)
+	}
+	if strings.Contains(string(resp.Body), "secret-logs-key") {
+		t.Error("/apps must not return API keys")
+	}
+
+	var body struct {
+		Apps []appInfo `json:"apps"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(body.Apps) != 3 {
+		t.Fatalf("Expected 3 apps, got %d", len(body.Apps))
+	}
+	if !body.Apps[0].HasKey || body.Apps[1].HasKey {
+		t.Errorf("Unexpected hasKey flags: %+v", body.Apps)
+	}
+}
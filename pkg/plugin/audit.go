@@ -0,0 +1,496 @@
+package plugin
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// Audit events.
+const (
+	auditAccessDenied      = "access_denied"
+	auditChatMessage       = "chat_message"
+	auditCompletionMessage = "completion_message"
+	auditWorkflowRun       = "workflow_run"
+	auditTaskStopped       = "task_stopped"
+)
+
+// auditedRoutes are the routes that record an audit event for every
+// request, named by the event.
+var auditedRoutes = map[string]string{
+	"/difyChatProxy":       auditChatMessage,
+	"/difyCompletionProxy": auditCompletionMessage,
+	"/difyWorkflowProxy":   auditWorkflowRun,
+	"/difyChatStop":        auditTaskStopped,
+	"/difyCompletionStop":  auditTaskStopped,
+	"/difyWorkflowStop":    auditTaskStopped,
+}
+
+// Prompt policies of the audit trail.
+const (
+	// auditPromptHash records the SHA-256 of prompts, so that a known prompt
+	// can be traced without the trail holding it.
+	auditPromptHash = "hash"
+	auditPromptFull = "full"
+	auditPromptNone = "none"
+)
+
+// auditFileName is the name of the audit trail in the plugin's data
+// directory.
+const auditFileName = "audit.jsonl"
+
+// defaultAuditLimit and maxAuditLimit bound the events returned by /audit.
+const (
+	defaultAuditLimit = 1000
+	maxAuditLimit     = 100000
+)
+
+// auditSettings configures the audit trail of assistant usage.
+type auditSettings struct {
+	Enabled bool `json:"enabled"`
+	// Path is the audit trail file within the plugin's data directory. It
+	// defaults to audit.jsonl, see dataFile.
+	Path string `json:"path"`
+	// Prompts is auditPromptHash, the default, auditPromptFull or
+	// auditPromptNone.
+	Prompts string `json:"prompts"`
+}
+
+func (s auditSettings) validate() error {
+	switch s.Prompts {
+	case "", auditPromptHash, auditPromptFull, auditPromptNone:
+	default:
+		return &ConfigError{"unknown audit prompt policy: " + s.Prompts}
+	}
+	// An enabled trail must have somewhere to go rather than be dropped.
+	if s.Enabled {
+		if _, err := s.path(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s auditSettings) path() (string, error) {
+	return dataFile("audit.path", "", s.Path, auditFileName)
+}
+
+var errNoDataDir = errors.New("the data path of Grafana (GF_PATHS_DATA) is not known to the plugin")
+
+// dataDir is where the plugin keeps its files: a directory named after the
+// plugin in Grafana's data path. Grafana only passes GF_PATHS_DATA to
+// plugins that are allowed to see it.
+func dataDir() (string, error) {
+	base := os.Getenv("GF_PATHS_DATA")
+	if base == "" {
+		return "", errNoDataDir
+	}
+	return filepath.Join(base, "cloudorg-difychatflow-app"), nil
+}
+
+// dataFile resolves path, the value of the setting named option, within the
+// subdirectory dir of dataDir, or name if path is empty. Org admins edit the
+// settings, so they may only name files below dir rather than any file the
+// Grafana server can write.
+func dataFile(option, dir, path, name string) (string, error) {
+	base, err := dataDir()
+	if err != nil {
+		return "", &ConfigError{option + " cannot be resolved: " + err.Error()}
+	}
+	if path == "" {
+		path = name
+	} else if !filepath.IsLocal(path) {
+		return "", &ConfigError{option + " must be a relative path within the plugin's data directory"}
+	}
+	return filepath.Join(base, dir, path), nil
+}
+
+// auditEvent is one entry of the audit trail. Prompts are what was sent to
+// Dify, so values removed by redaction are not in the trail either.
+type auditEvent struct {
+	Time           time.Time `json:"time"`
+	Event          string    `json:"event"`
+	RequestID      string    `json:"requestId,omitempty"`
+	OrgID          int64     `json:"orgId"`
+	User           string    `json:"user"`
+	Role           string    `json:"role,omitempty"`
+	Route          string    `json:"route,omitempty"`
+	App            string    `json:"app,omitempty"`
+	ConversationID string    `json:"conversationId,omitempty"`
+	TaskID         string    `json:"taskId,omitempty"`
+	Prompt         string    `json:"prompt,omitempty"`
+	PromptHash     string    `json:"promptHash,omitempty"`
+	Status         int       `json:"status"`
+	TotalTokens    int       `json:"totalTokens,omitempty"`
+	Cost           float64   `json:"cost,omitempty"`
+	Currency       string    `json:"currency,omitempty"`
+	// Detail says why a request was denied.
+	Detail string `json:"detail,omitempty"`
+}
+
+// auditColumns are the CSV columns of /audit, in the order of auditEvent.
+var auditColumns = []string{"time", "event", "requestId", "orgId", "user", "role", "route", "app",
+	"conversationId", "taskId", "prompt", "promptHash", "status", "totalTokens", "cost", "currency", "detail"}
+
+func (e *auditEvent) csvRecord() []string {
+	record := []string{
+		e.Time.UTC().Format(time.RFC3339Nano), e.Event, e.RequestID, strconv.FormatInt(e.OrgID, 10),
+		e.User, e.Role, e.Route, e.App, e.ConversationID, e.TaskID, e.Prompt, e.PromptHash,
+		strconv.Itoa(e.Status), strconv.Itoa(e.TotalTokens), strconv.FormatFloat(e.Cost, 'f', -1, 64),
+		e.Currency, e.Detail,
+	}
+	for i, cell := range record {
+		record[i] = csvCell(cell)
+	}
+	return record
+}
+
+// csvCell quotes a cell that spreadsheets would run as a formula, such as a
+// prompt starting with "=", so that the export is only ever read as text.
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// applyPolicy replaces the prompt of e as the policy demands. Full prompts
+// are sealed with keys; without a storage key they are hashed instead.
+func (e *auditEvent) applyPolicy(policy string, keys *keyring) error {
+	if e.Prompt == "" || policy == auditPromptNone {
+		e.Prompt = ""
+		return nil
+	}
+	if policy == auditPromptFull && keys != nil {
+		sealed, err := keys.sealString(e.Prompt)
+		e.Prompt = sealed
+		return err
+	}
+	sum := sha256.Sum256([]byte(e.Prompt))
+	e.PromptHash = hex.EncodeToString(sum[:])
+	e.Prompt = ""
+	return nil
+}
+
+// auditFilter selects events of /audit.
+type auditFilter struct {
+	orgID    int64
+	from, to time.Time
+	user     string
+	event    string
+	app      string
+}
+
+func (f *auditFilter) match(e *auditEvent) bool {
+	return e.OrgID == f.orgID &&
+		(f.from.IsZero() || !e.Time.Before(f.from)) &&
+		(f.to.IsZero() || e.Time.Before(f.to)) &&
+		(f.user == "" || e.User == f.user) &&
+		(f.event == "" || e.Event == f.event) &&
+		(f.app == "" || e.App == f.app)
+}
+
+// auditLog is an append-only file of audit events, one JSON object per line.
+// Nothing in the plugin rewrites or truncates it.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// auditLogs holds one auditLog per path, so that concurrent requests and
+// app instances append to the same file handle.
+type auditLogs struct {
+	mu   sync.Mutex
+	logs map[string]*auditLog
+}
+
+// sharedAuditLogs holds the audit logs of all app instances, see App.
+var sharedAuditLogs = &auditLogs{logs: map[string]*auditLog{}}
+
+func (l *auditLogs) get(path string) *auditLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if al, ok := l.logs[path]; ok {
+		return al
+	}
+	al := &auditLog{path: path}
+	l.logs[path] = al
+	return al
+}
+
+// append writes e to the end of the log.
+func (l *auditLog) append(e *auditEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		if err := os.MkdirAll(filepath.Dir(l.path), 0o700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		l.file = f
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+// query returns the last limit events matching f, oldest first. A missing
+// log has no events.
+func (l *auditLog) query(f *auditFilter, limit int) ([]auditEvent, error) {
+	file, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []auditEvent{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events := []auditEvent{}
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			var e auditEvent
+			// A line cut short by a crash is skipped.
+			if json.Unmarshal(line, &e) == nil && f.match(&e) {
+				if events = append(events, e); len(events) > limit {
+					events = events[1:]
+				}
+			}
+		}
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// audit records a security-relevant event with the calling user and org.
+// keyvals are logged like the arguments of log.Logger.Info. The event also
+// goes to the audit trail, if enabled, and replaces the event the request
+// would have recorded otherwise.
+func audit(req *http.Request, event string, keyvals ...interface{}) {
+	pluginConfig := backend.PluginConfigFromContext(req.Context())
+	login, role := "", ""
+	if pluginConfig.User != nil {
+		login, role = pluginConfig.User.Login, pluginConfig.User.Role
+	}
+	args := append([]interface{}{
+		"audit", true,
+		"event", event,
+		"org_id", pluginConfig.OrgID,
+		"user", login,
+		"role", role,
+	}, keyvals...)
+	loggerFrom(req.Context()).Warn("Audit event", args...)
+
+	info := requestInfoFrom(req.Context())
+	detail := ""
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if detail != "" {
+			detail += " "
+		}
+		detail += toString(keyvals[i]) + "=" + toString(keyvals[i+1])
+	}
+	info.audit = &auditEvent{Event: event, Detail: detail}
+}
+
+func toString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
+
+// startAudit prepares the audit event of a request to an audited route,
+// which recordAudit completes once the request was served.
+func startAudit(req *http.Request, info *requestInfo) {
+	if event, ok := auditedRoutes[info.route]; ok {
+		info.audit = &auditEvent{Event: event}
+	}
+}
+
+// recordAudit appends the request's audit event, if any, to the audit
+// trail with the request's final status. Failures are logged, as the
+// response is already sent.
+func recordAudit(req *http.Request, info *requestInfo, status int) {
+	if info.audit == nil {
+		return
+	}
+	settings, err := getSettings(req)
+	if err != nil || !settings.Audit.Enabled {
+		return
+	}
+	e := info.audit
+	pluginConfig := backend.PluginConfigFromContext(req.Context())
+	e.Time = info.start.UTC()
+	e.RequestID = info.id
+	e.OrgID = pluginConfig.OrgID
+	if pluginConfig.User != nil {
+		e.User, e.Role = pluginConfig.User.Login, pluginConfig.User.Role
+	}
+	e.Route, e.App, e.Status = info.route, info.app, status
+	keys, err := loadKeyring(pluginConfig.AppInstanceSettings)
+	if settings.Audit.Prompts == auditPromptFull && keys == nil {
+		log.DefaultLogger.Error("Hashing audited prompts: full prompts need the "+storageKeySetting+" secure setting", "error", err)
+	}
+	if err := e.applyPolicy(settings.Audit.Prompts, keys); err != nil {
+		log.DefaultLogger.Error("Failed to seal audited prompt", "request_id", e.RequestID, "error", err)
+		return
+	}
+	path, err := settings.Audit.path()
+	if err != nil {
+		log.DefaultLogger.Error("Dropping audit event", "event", e.Event, "request_id", e.RequestID, "error", err)
+		return
+	}
+	if err := sharedAuditLogs.get(path).append(e); err != nil {
+		log.DefaultLogger.Error("Failed to write audit event", "event", e.Event, "request_id", e.RequestID, "error", err)
+	}
+}
+
+// auditPrompt records the prompt of the request: the query of a chat
+// message, or the inputs of a completion or workflow run.
+func (t *difyTarget) auditPrompt(conversationID string, query *string, inputs map[string]interface{}) {
+	if t.audit == nil {
+		return
+	}
+	t.audit.ConversationID = conversationID
+	if query != nil {
+		t.audit.Prompt = *query
+		return
+	}
+	raw, _ := json.Marshal(inputs)
+	t.audit.Prompt = string(raw)
+}
+
+// auditDenied records why the request was denied.
+func (t *difyTarget) auditDenied(detail string) {
+	if t.audit != nil {
+		t.audit.Detail = detail
+	}
+}
+
+// auditTask records the task a request stopped.
+func (t *difyTarget) auditTask(taskID string) {
+	if t.audit != nil {
+		t.audit.TaskID = taskID
+	}
+}
+
+// auditUsage adds a generation's usage to the request's audit event.
+func (t *difyTarget) auditUsage(usage *dify.Usage) {
+	if t.audit == nil || usage == nil {
+		return
+	}
+	t.audit.TotalTokens += usage.TotalTokens
+	t.audit.Currency = usage.Currency
+	if price, err := strconv.ParseFloat(usage.TotalPrice, 64); err == nil {
+		t.audit.Cost += price
+	}
+}
+
+// handleAudit returns the audit events of the caller's org, optionally
+// filtered by ?from= and ?to= (RFC 3339), ?user=, ?event= and ?app=, as
+// JSON or, with ?format=csv, as CSV. ?limit= bounds the number of events,
+// the most recent of which are returned.
+func (a *App) handleAudit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	settings, err := getSettings(req)
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	if !settings.Audit.Enabled {
+		http.Error(w, "The audit trail is not enabled", http.StatusNotFound)
+		return
+	}
+
+	q := req.URL.Query()
+	f := &auditFilter{
+		orgID: backend.PluginConfigFromContext(req.Context()).OrgID,
+		user:  q.Get("user"),
+		event: q.Get("event"),
+		app:   q.Get("app"),
+	}
+	for name, t := range map[string]*time.Time{"from": &f.from, "to": &f.to} {
+		if v := q.Get(name); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, name+" must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	limit := defaultAuditLimit
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxAuditLimit {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	format := q.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	path, err := settings.Audit.path()
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	events, err := sharedAuditLogs.get(path).query(f, limit)
+	if err != nil {
+		http.Error(w, "Failed to read the audit trail: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Sealed prompts are opened for export. Those sealed with a key that is
+	// no longer configured stay sealed.
+	if keys, _ := loadKeyring(backend.PluginConfigFromContext(req.Context()).AppInstanceSettings); keys != nil {
+		for i := range events {
+			if prompt, err := keys.openString(events[i].Prompt); err == nil {
+				events[i].Prompt = prompt
+			}
+		}
+	}
+	if format != "csv" {
+		writeJSON(w, map[string]interface{}{"events": events})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write(auditColumns)
+	for i := range events {
+		cw.Write(events[i].csvRecord())
+	}
+	cw.Flush()
+}
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestAuditTrail tests that chat messages and denied requests are recorded
+// and can be exported by admins
+func TestAuditTrail(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"answer": "ok", "conversation_id": "c1", "task_id": "t1",
+			"metadata": {"usage": {"total_tokens": 42, "total_price": "0.01", "currency": "USD"}}}`))
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	app.usage = newUsageLedger()
+	t.Setenv("GF_PATHS_DATA", t.TempDir())
+
+	settings := &backend.AppInstanceSettings{
+		JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "audit": {"enabled": true, "path": "trail/audit.jsonl"}}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+	}
+
+	if resp := callResource(t, app, asUser("alice", roleViewer, settings), http.MethodPost, "difyChatProxy", `{"query": "why is prod down?", "response_mode": "blocking"}`); resp.Status != http.StatusOK {
+		t.Fatalf("Unexpected chat response %+v", resp)
+	}
+	if resp := callResource(t, app, asUser("bob", roleViewer, settings), http.MethodGet, "audit", ""); resp.Status != http.StatusForbidden {
+		t.Fatalf("Expected viewers to be denied the audit trail, got %d", resp.Status)
+	}
+
+	resp := callResource(t, app, asUser("admin", roleAdmin, settings), http.MethodGet, "audit", "")
+	var trail struct {
+		Events []auditEvent `json:"events"`
+	}
+	if err := json.Unmarshal(resp.Body, &trail); err != nil || len(trail.Events) != 2 {
+		t.Fatalf("Expected 2 events, got %s: %v", resp.Body, err)
+	}
+	chat, denied := trail.Events[0], trail.Events[1]
+	sum := sha256.Sum256([]byte("why is prod down?"))
+	if chat.Event != auditChatMessage || chat.User != "alice" || chat.ConversationID != "c1" || chat.Status != http.StatusOK ||
+		chat.TotalTokens != 42 || chat.Prompt != "" || chat.PromptHash != hex.EncodeToString(sum[:]) {
+		t.Errorf("Unexpected chat event %+v", chat)
+	}
+	if denied.Event != auditAccessDenied || denied.User != "bob" || denied.Status != http.StatusForbidden {
+		t.Errorf("Unexpected denial event %+v", denied)
+	}
+
+	resp = callResource(t, app, asUser("admin", roleAdmin, settings), http.MethodGet, "audit?user=alice&format=csv", "")
+	lines := strings.Split(strings.TrimSpace(string(resp.Body)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "time,event,") || !strings.Contains(lines[1], ",chat_message,") {
+		t.Errorf("Unexpected CSV export %q", resp.Body)
+	}
+
+	resp = callResource(t, app, asUser("admin", roleAdmin, settings), http.MethodGet, "audit?from=2999-01-01T00:00:00Z", "")
+	if err := json.Unmarshal(resp.Body, &trail); err != nil || len(trail.Events) != 0 {
+		t.Errorf("Expected no events in the future, got %s: %v", resp.Body, err)
+	}
+	if resp := callResource(t, app, asUser("admin", roleAdmin, settings), http.MethodGet, "audit?from=yesterday", ""); resp.Status != http.StatusBadRequest {
+		t.Errorf("Expected an invalid time to be rejected, got %d", resp.Status)
+	}
+}
+
+// TestAuditDataPath tests that the audit trail needs Grafana's data path and
+// stays within the plugin's directory there
+func TestAuditDataPath(t *testing.T) {
+	t.Setenv("GF_PATHS_DATA", "")
+	for _, path := range []string{"", "audit.jsonl"} {
+		if err := (auditSettings{Enabled: true, Path: path}).validate(); err == nil {
+			t.Errorf("Expected an audit trail at %q without a data directory to be rejected", path)
+		}
+	}
+
+	t.Setenv("GF_PATHS_DATA", "/var/lib/grafana")
+	dir := filepath.Join("/var/lib/grafana", "cloudorg-difychatflow-app")
+	for path, expected := range map[string]string{"": "audit.jsonl", "trails/org1.jsonl": "trails/org1.jsonl"} {
+		if p, err := (auditSettings{Enabled: true, Path: path}).path(); err != nil || p != filepath.Join(dir, expected) {
+			t.Errorf("Unexpected path %q for %q: %v", p, path, err)
+		}
+	}
+	var ce *ConfigError
+	for _, path := range []string{"/etc/passwd", "../grafana.db", "trails/../../grafana.db"} {
+		if err := (auditSettings{Enabled: true, Path: path}).validate(); !errors.As(err, &ce) {
+			t.Errorf("Expected %q outside the data directory to be rejected, got %v", path, err)
+		}
+	}
+}
+
+// TestAuditCSVFormulas tests that exported cells are never read as formulas
+func TestAuditCSVFormulas(t *testing.T) {
+	e := auditEvent{User: "=HYPERLINK(\"http://evil\")", Detail: "-2+3", App: "logs"}
+	record := e.csvRecord()
+	if record[4] != "'=HYPERLINK(\"http://evil\")" || record[16] != "'-2+3" || record[7] != "logs" {
+		t.Errorf("Unexpected CSV record %q", record)
+	}
+}
@@ -0,0 +1,339 @@
+package plugin
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+const (
+	defaultRetryAttempts  = 3
+	defaultRetryBaseDelay = 200 * time.Millisecond
+	defaultRetryMaxDelay  = 5 * time.Second
+
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+)
+
+// Circuit states reported in health checks and /configStatus.
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// sharedBreakers holds the circuit breakers of all app instances, see App.
+var sharedBreakers = newBreakers()
+
+// retrySettings configures retries of idempotent calls and of opening
+// streams, see dify.RetryPolicy.
+type retrySettings struct {
+	// MaxAttempts includes the first attempt. 1 disables retries.
+	MaxAttempts int `json:"maxAttempts"`
+	// BaseDelayMs and MaxDelayMs bound the jittered exponential backoff, in
+	// milliseconds. A Retry-After beyond MaxDelayMs is not waited for.
+	BaseDelayMs int `json:"baseDelayMs"`
+	MaxDelayMs  int `json:"maxDelayMs"`
+}
+
+// circuitSettings configures the circuit breaker of each Dify app.
+type circuitSettings struct {
+	// FailureThreshold is the number of consecutive failed calls that opens
+	// the circuit. A negative value disables the breaker.
+	FailureThreshold int `json:"failureThreshold"`
+	// OpenTimeout is how long the circuit stays open before a trial call is
+	// let through, in seconds.
+	OpenTimeout int `json:"openTimeout"`
+}
+
+// retryPolicy returns the retry policy for the target's calls.
+func (s *pluginSettings) retryPolicy() dify.RetryPolicy {
+	attempts := s.Retry.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultRetryAttempts
+	}
+	return dify.RetryPolicy{
+		MaxAttempts: attempts,
+		BaseDelay:   milliseconds(s.Retry.BaseDelayMs, defaultRetryBaseDelay),
+		MaxDelay:    milliseconds(s.Retry.MaxDelayMs, defaultRetryMaxDelay),
+		OnRetry: func(req *http.Request, attempt int, err error, delay time.Duration) {
+			info := requestInfoFrom(req.Context())
+			upstreamRetries.WithLabelValues(info.route, info.app).Inc()
+			loggerFrom(req.Context()).Debug("Retrying Dify call", "path", req.URL.Path,
+				"attempt", attempt, "delay", delay, "error", err)
+		},
+	}
+}
+
+// milliseconds converts a setting in milliseconds, falling back to def when
+// unset.
+func milliseconds(v int, def time.Duration) time.Duration {
+	if v > 0 {
+		return time.Duration(v) * time.Millisecond
+	}
+	return def
+}
+
+// circuitOpenError fails a call while the circuit of its app is open.
+type circuitOpenError struct {
+	app        string
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return "Dify app " + e.app + " is failing, calls are paused for " + e.retryAfter.Round(time.Second).String()
+}
+
+// breaker is the circuit breaker of one Dify app. It opens after a run of
+// failed calls and then fails calls fast until OpenTimeout has passed. The
+// next call is then let through as a trial, whose outcome closes or reopens
+// the circuit.
+type breaker struct {
+	mu       sync.Mutex
+	name     string
+	cfg      circuitSettings
+	state    string
+	failures int
+	openedAt time.Time
+	// trial is set while the half-open trial call is in flight.
+	trial bool
+	now   func() time.Time
+}
+
+func (b *breaker) openTimeout() time.Duration {
+	return seconds(b.cfg.OpenTimeout, defaultOpenTimeout)
+}
+
+// allow returns a *circuitOpenError if a call must not be made.
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg.FailureThreshold < 0 {
+		return nil
+	}
+	switch b.state {
+	case circuitOpen:
+		if wait := b.openTimeout() - b.now().Sub(b.openedAt); wait > 0 {
+			return &circuitOpenError{app: b.name, retryAfter: wait}
+		}
+		b.state = circuitHalfOpen
+	case circuitHalfOpen:
+		if b.trial {
+			return &circuitOpenError{app: b.name, retryAfter: time.Second}
+		}
+	default:
+		return nil
+	}
+	b.trial = true
+	return nil
+}
+
+// Outcomes of a call fed to a breaker.
+type callOutcome int
+
+const (
+	callSucceeded callOutcome = iota
+	callFailed
+	// callAbandoned is a call that ended without telling whether Dify is
+	// healthy, as when the client went away.
+	callAbandoned
+)
+
+// record feeds the outcome of an allowed call to the breaker.
+func (b *breaker) record(outcome callOutcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.cfg.FailureThreshold < 0 {
+		return
+	}
+	wasTrial := b.trial
+	b.trial = false
+	switch {
+	case outcome == callAbandoned:
+	case outcome == callSucceeded:
+		if b.state != circuitClosed {
+			log.DefaultLogger.Info("Dify circuit closed", "app", b.name)
+		}
+		b.state, b.failures = circuitClosed, 0
+	case wasTrial && b.state == circuitHalfOpen:
+		b.open()
+	default:
+		b.failures++
+		threshold := b.cfg.FailureThreshold
+		if threshold == 0 {
+			threshold = defaultFailureThreshold
+		}
+		if b.state == circuitClosed && b.failures >= threshold {
+			b.open()
+		}
+	}
+}
+
+// open opens the circuit. The caller holds b.mu.
+func (b *breaker) open() {
+	log.DefaultLogger.Warn("Dify circuit opened", "app", b.name, "openTimeout", b.openTimeout())
+	b.state, b.failures, b.openedAt = circuitOpen, 0, b.now()
+}
+
+// currentState reports the state as the next call would see it.
+func (b *breaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen && b.now().Sub(b.openedAt) >= b.openTimeout() {
+		return circuitHalfOpen
+	}
+	return b.state
+}
+
+// breakers holds a breaker per org and Dify app.
+type breakers struct {
+	mu    sync.Mutex
+	byKey map[string]*breaker
+	// held counts the live instances whose settings hold each endpoint, by
+	// endpointKey. Breakers of endpoints no instance holds are dropped.
+	held map[string]int
+}
+
+func newBreakers() *breakers {
+	return &breakers{byKey: map[string]*breaker{}, held: map[string]int{}}
+}
+
+// instanceEndpoints returns the endpointKey of every endpoint in the
+// instance's settings.
+func instanceEndpoints(settings *backend.AppInstanceSettings) []string {
+	apps, err := loadApps(settings)
+	if err != nil {
+		return nil
+	}
+	var keys []string
+	for _, app := range apps {
+		for _, ep := range app.Endpoints {
+			keys = append(keys, endpointKey(app, ep))
+		}
+	}
+	return keys
+}
+
+// hold marks the endpoints as used by a live instance.
+func (bs *breakers) hold(endpoints []string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for _, k := range endpoints {
+		bs.held[k]++
+	}
+}
+
+// release undoes hold when an instance is disposed, and drops the breakers
+// of all endpoints that no live instance holds anymore. Those were removed
+// from the settings, or have a changed API URL and thus a new key.
+func (bs *breakers) release(endpoints []string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for _, k := range endpoints {
+		if bs.held[k]--; bs.held[k] <= 0 {
+			delete(bs.held, k)
+		}
+	}
+	for key := range bs.byKey {
+		if _, ep, _ := strings.Cut(key, "/"); bs.held[ep] == 0 {
+			delete(bs.byKey, key)
+		}
+	}
+}
+
+// breakerKey identifies an endpoint of an app of an org. A changed API URL
+// gets a fresh breaker.
+func breakerKey(orgID int64, app *difyApp, ep *difyEndpoint) string {
+	return strconv.FormatInt(orgID, 10) + "/" + endpointKey(app, ep)
+}
+
+// get returns the breaker for key, applying the current settings.
+func (bs *breakers) get(key, name string, cfg circuitSettings) *breaker {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	b, ok := bs.byKey[key]
+	if !ok {
+		b = &breaker{name: name, state: circuitClosed, now: time.Now}
+		bs.byKey[key] = b
+	}
+	b.mu.Lock()
+	b.cfg = cfg
+	b.mu.Unlock()
+	return b
+}
+
+// state reports the circuit state of key. Apps that have not been called
+// yet are closed.
+func (bs *breakers) state(key string) string {
+	bs.mu.Lock()
+	b, ok := bs.byKey[key]
+	bs.mu.Unlock()
+	if !ok {
+		return circuitClosed
+	}
+	return b.currentState()
+}
+
+// appCircuit reports the best circuit state among the app's endpoints, which
+// tells whether the app can serve requests.
+func (a *App) appCircuit(orgID int64, app *difyApp) string {
+	best := circuitOpen
+	for _, ep := range app.Endpoints {
+		switch a.breakers.state(breakerKey(orgID, app, ep)) {
+		case circuitClosed:
+			return circuitClosed
+		case circuitHalfOpen:
+			best = circuitHalfOpen
+		}
+	}
+	return best
+}
+
+// breakerTransport guards the calls of one app with its breaker. Transport
+// errors and 5xx answers count as failures; calls cut short by the caller
+// count as neither.
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *breaker
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.allow(); err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	outcome := callSucceeded
+	switch {
+	case req.Context().Err() != nil:
+		outcome = callAbandoned
+	case err != nil, resp.StatusCode >= http.StatusInternalServerError:
+		outcome = callFailed
+	}
+	t.breaker.record(outcome)
+	return resp, err
+}
+
+// breakerClient returns an HTTP client sending through the instance's
+// transport, guarded by b.
+func (a *App) breakerClient(b *breaker) *http.Client {
+	return &http.Client{Transport: &breakerTransport{next: a.httpClient.Transport, breaker: b}}
+}
+
+// writeCircuitOpen answers a call failed fast by an open circuit with 503
+// and Retry-After. It returns false for other errors.
+func writeCircuitOpen(w http.ResponseWriter, err error) bool {
+	var open *circuitOpenError
+	if !errors.As(err, &open) {
+		return false
+	}
+	writeRetryAfter(w, open.retryAfter)
+	http.Error(w, open.Error(), http.StatusServiceUnavailable)
+	return true
+}
@@ -0,0 +1,150 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestBreaker tests the transitions of a circuit breaker
+func TestBreaker(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreakers().get("1/default/x", "default", circuitSettings{FailureThreshold: 2, OpenTimeout: 10})
+	b.now = func() time.Time { return now }
+
+	b.record(callFailed)
+	b.record(callSucceeded)
+	b.record(callFailed)
+	if b.currentState() != circuitClosed {
+		t.Fatal("Expected a success to reset the failure count")
+	}
+	b.record(callFailed)
+	if err := b.allow(); err == nil || b.currentState() != circuitOpen {
+		t.Fatalf("Expected the circuit to open, got %s: %v", b.currentState(), err)
+	}
+
+	now = now.Add(10 * time.Second)
+	if b.currentState() != circuitHalfOpen {
+		t.Fatalf("Expected the circuit to be half-open, got %s", b.currentState())
+	}
+	if err := b.allow(); err != nil {
+		t.Fatalf("Expected a trial call, got %v", err)
+	}
+	if err := b.allow(); err == nil {
+		t.Error("Expected only one trial call at a time")
+	}
+	b.record(callFailed)
+	if b.currentState() != circuitOpen {
+		t.Fatalf("Expected a failed trial to reopen the circuit, got %s", b.currentState())
+	}
+
+	now = now.Add(10 * time.Second)
+	b.allow()
+	b.record(callAbandoned)
+	if err := b.allow(); err != nil {
+		t.Fatalf("Expected an abandoned trial to free the trial slot, got %v", err)
+	}
+	b.record(callSucceeded)
+	if b.currentState() != circuitClosed {
+		t.Errorf("Expected a successful trial to close the circuit, got %s", b.currentState())
+	}
+}
+
+// TestCircuitFailsFast tests that an open circuit stops calls to Dify and
+// shows in the health check
+func TestCircuitFailsFast(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	app.breakers = newBreakers()
+
+	instance := &backend.AppInstanceSettings{
+		JSONData: []byte(`{"apiUrl": "` + server.URL + `",
+			"retry": {"maxAttempts": 2, "baseDelayMs": 1},
+			"circuitBreaker": {"failureThreshold": 3, "openTimeout": 60}}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+	}
+	parameters := func() *backend.CallResourceResponse {
+		return callResource(t, app, asUser("viewer", roleViewer, instance), http.MethodGet, "difyParameters", "")
+	}
+
+	// Each request makes two attempts; the third attempt opens the circuit
+	if resp := parameters(); resp.Status != http.StatusBadGateway || calls.Load() != 2 {
+		t.Fatalf("Expected a retried 502, got %d after %d calls", resp.Status, calls.Load())
+	}
+	resp := parameters()
+	if resp.Status != http.StatusServiceUnavailable || calls.Load() != 3 {
+		t.Fatalf("Expected the open circuit to fail the retry, got %d after %d calls: %s", resp.Status, calls.Load(), resp.Body)
+	}
+	if got := resp.Headers["Retry-After"]; len(got) != 1 || got[0] != "60" {
+		t.Errorf("Expected Retry-After 60, got %v", got)
+	}
+	if resp := parameters(); resp.Status != http.StatusServiceUnavailable || calls.Load() != 3 {
+		t.Errorf("Expected calls to fail fast, got %d after %d calls", resp.Status, calls.Load())
+	}
+
+	res, err := app.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+		PluginContext: backend.PluginContext{OrgID: 1, AppInstanceSettings: instance},
+	})
+	if err != nil {
+		t.Fatalf("CheckHealth error: %s", err)
+	}
+	var details struct {
+		Apps []appHealth `json:"apps"`
+	}
+	if err := json.Unmarshal(res.JSONDetails, &details); err != nil {
+		t.Fatalf("decode details: %v", err)
+	}
+	if len(details.Apps) != 1 || details.Apps[0].Circuit != circuitOpen {
+		t.Errorf("Expected the health check to report the open circuit, got %+v", details.Apps)
+	}
+}
+
+// TestBreakersRelease tests that disposing an instance drops the breakers of
+// endpoints no live instance holds anymore
+func TestBreakersRelease(t *testing.T) {
+	instance := func(apiURL string) *backend.AppInstanceSettings {
+		return &backend.AppInstanceSettings{
+			JSONData:                []byte(`{"apiUrl": "` + apiURL + `"}`),
+			DecryptedSecureJSONData: map[string]string{"apiKey": "k"},
+		}
+	}
+	apps, err := loadApps(instance("https://old"))
+	if err != nil {
+		t.Fatalf("loadApps: %v", err)
+	}
+	key := breakerKey(1, apps[0], apps[0].Endpoints[0])
+
+	bs := newBreakers()
+	// An instance replaced first with the same settings, then with a new URL.
+	old := instanceEndpoints(instance("https://old"))
+	same := instanceEndpoints(instance("https://old"))
+	moved := instanceEndpoints(instance("https://new"))
+	bs.hold(old)
+	bs.get(key, "default", circuitSettings{})
+	bs.hold(same)
+	bs.release(old)
+	if _, ok := bs.byKey[key]; !ok {
+		t.Fatal("Expected the breaker of an endpoint still held to be kept")
+	}
+	bs.hold(moved)
+	bs.release(same)
+	if len(bs.byKey) != 0 || len(bs.held) != 1 {
+		t.Errorf("Expected the breaker of a removed endpoint to be dropped, got %v held by %v", bs.byKey, bs.held)
+	}
+}
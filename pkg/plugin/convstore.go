@@ -0,0 +1,700 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// conversationStoreFileName is the name of the conversation store in the
+	// plugin's data directory.
+	conversationStoreFileName  = "conversations.db"
+	defaultStorePurgeInterval  = time.Hour
+	storedConversationNameSize = 100
+)
+
+// Buckets and keys of the conversation store. Each conversation has a
+// bucket within conversationsBucket holding its metadata under metaKey and a
+// messagesBucket of messages keyed by sequence number.
+var (
+	conversationsBucket = []byte("conversations")
+	messagesBucket      = []byte("messages")
+	metaKey             = []byte("meta")
+)
+
+// keysBucket holds a check value for every storage key that may have sealed
+// values of the store, keyed by key ID: keyCheck sealed with the key, or a
+// stored value found sealed with it. The current key's check is added when
+// the store is opened; those of previous keys are dropped once reencrypt
+// moved all their values to the current key.
+var (
+	keysBucket = []byte("keys")
+	keyCheck   = []byte("dify-chatflow storage key check")
+)
+
+// conversationStoreSettings configures the local copy of chat conversations,
+// which outlives the Dify app they were held in.
+type conversationStoreSettings struct {
+	Enabled bool `json:"enabled"`
+	// Path is the store file within the org's directory, see path. It
+	// defaults to conversations.db.
+	Path string `json:"path"`
+	// MaxAgeDays purges conversations not updated for that many days. Zero
+	// keeps them.
+	MaxAgeDays int `json:"maxAgeDays"`
+	// MaxPerUser keeps only the most recently updated conversations of each
+	// user of an org. Zero keeps all.
+	MaxPerUser int `json:"maxPerUser"`
+	// PurgeInterval is how often the purge job runs, in seconds.
+	PurgeInterval int `json:"purgeInterval"`
+}
+
+// path is the store file of an org. Orgs have storage keys of their own, so
+// each org keeps its conversations in a file of its own, in the directory
+// orgs/<org ID> of dataDir.
+func (s conversationStoreSettings) path(orgID int64) (string, error) {
+	return dataFile("conversationStore.path", filepath.Join("orgs", strconv.FormatInt(orgID, 10)), s.Path, conversationStoreFileName)
+}
+
+// storedConversation is the metadata of a stored conversation.
+type storedConversation struct {
+	ID    string `json:"id"`
+	OrgID int64  `json:"orgId"`
+	App   string `json:"app"`
+	// User is the Dify user, Login the Grafana login it was derived from.
+	User      string    `json:"user"`
+	Login     string    `json:"login"`
+	Name      string    `json:"name"`
+	Messages  int       `json:"messages"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (c *storedConversation) key() []byte {
+	return conversationKey(c.OrgID, c.App, c.User, c.ID)
+}
+
+// conversationKey identifies a conversation in the store. Its parts are
+// separated by NUL, which no part contains, so that the conversations of a
+// user share a prefix.
+func conversationKey(orgID int64, app, user, id string) []byte {
+	return []byte(strconv.FormatInt(orgID, 10) + "\x00" + app + "\x00" + user + "\x00" + id)
+}
+
+// storedMessage is one exchange of a stored conversation, as the user saw
+// it: the query before redaction and the answer after rehydration.
+type storedMessage struct {
+	ID          string    `json:"id"`
+	Query       string    `json:"query"`
+	Answer      string    `json:"answer"`
+	TotalTokens int       `json:"totalTokens,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// conversationStore keeps conversations in a bbolt database. Values are
+// sealed with the storage keys, see keyring.
+type conversationStore struct {
+	db *bolt.DB
+	mu sync.RWMutex
+	// keys is replaced when the storage keys are rotated, see useKeys.
+	keys *keyring
+}
+
+// openConversationStore opens the store at path. It refuses to if the
+// store holds values the keys do not open.
+func openConversationStore(path string, keys *keyring) (*conversationStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(conversationsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &conversationStore{db: db, keys: keys}
+	if err := s.verify(keys); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// verify checks that keys open the check of every key in keysBucket, and
+// records the check of the current key. A store written before key checks
+// were kept is scanned once for the keys its values are sealed with.
+func (s *conversationStore) verify(keys *keyring) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		checks, err := tx.CreateBucketIfNotExists(keysBucket)
+		if err != nil {
+			return err
+		}
+		if k, _ := checks.Cursor().First(); k == nil {
+			err := forEachValue(tx.Bucket(conversationsBucket), func(_ *bolt.Bucket, _, v []byte) error {
+				if id := sealedKeyID(v); id != nil && checks.Get(id) == nil {
+					return checks.Put(append([]byte(nil), id...), append([]byte(nil), v...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err = checks.ForEach(func(_, check []byte) error {
+			if _, err := keys.open(check); err != nil {
+				return &ConfigError{"the conversation store holds values sealed with another storage key: " +
+					"set it as " + storageKeySetting + " or list it in " + previousStorageKeysSetting + " (" + err.Error() + ")"}
+			}
+			return nil
+		})
+		if err != nil || checks.Get(keys.current.id) != nil {
+			return err
+		}
+		check, err := keys.seal(keyCheck)
+		if err != nil {
+			return err
+		}
+		return checks.Put(keys.current.id, check)
+	})
+}
+
+// forEachValue calls fn with every value of the conversations in root, and
+// the bucket holding it.
+func forEachValue(root *bolt.Bucket, fn func(b *bolt.Bucket, k, v []byte) error) error {
+	return root.ForEachBucket(func(k []byte) error {
+		return forEachConversationValue(root.Bucket(k), fn)
+	})
+}
+
+// forEachConversationValue calls fn with the meta and the messages of the
+// conversation in c, and the bucket holding them.
+func forEachConversationValue(c *bolt.Bucket, fn func(b *bolt.Bucket, k, v []byte) error) error {
+	buckets := []*bolt.Bucket{c}
+	if messages := c.Bucket(messagesBucket); messages != nil {
+		buckets = append(buckets, messages)
+	}
+	for _, b := range buckets {
+		err := b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return nil
+			}
+			return fn(b, k, v)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *conversationStore) keyring() *keyring {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.keys
+}
+
+// useKeys switches the store to keys, verifying them first if they differ
+// from the store's. Orgs or instances sharing the store with storage keys
+// that do not open each other's values are refused rather than flipping the
+// store between keys.
+func (s *conversationStore) useKeys(keys *keyring) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sameKeys(s.keys, keys) {
+		return nil
+	}
+	if err := s.verify(keys); err != nil {
+		return err
+	}
+	s.keys = keys
+	return nil
+}
+
+// encode seals the JSON form of v.
+func (s *conversationStore) encode(v interface{}) ([]byte, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return s.keyring().seal(plain)
+}
+
+// decode opens a sealed value into v.
+func (s *conversationStore) decode(data []byte, v interface{}) error {
+	return decodeValue(s.keyring(), data, v)
+}
+
+// decodeValue opens a value sealed with keys into v. Values stored before
+// encryption was required are plain JSON; reencrypt seals them.
+func decodeValue(keys *keyring, data []byte, v interface{}) error {
+	if len(data) > 0 && data[0] == '{' {
+		return json.Unmarshal(data, v)
+	}
+	plain, err := keys.open(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(plain, v)
+}
+
+// reencrypt seals every value not sealed with the current key with it, one
+// conversation per transaction so that requests are not held up. Values
+// that cannot be opened are skipped and kept as they are. It returns the
+// number of values it sealed and skipped. Once none are left behind, the
+// checks of the previous keys are dropped.
+func (s *conversationStore) reencrypt() (sealed, skipped int, err error) {
+	keys := s.keyring()
+	var conversations [][]byte
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationsBucket).ForEachBucket(func(k []byte) error {
+			conversations = append(conversations, append([]byte(nil), k...))
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, k := range conversations {
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			root := tx.Bucket(conversationsBucket)
+			if root.Bucket(k) == nil {
+				// Purged meanwhile.
+				return nil
+			}
+			type staleValue struct {
+				b    *bolt.Bucket
+				k, v []byte
+			}
+			var stale []staleValue
+			err := forEachConversationValue(root.Bucket(k), func(b *bolt.Bucket, k, v []byte) error {
+				if !keys.isCurrent(v) {
+					stale = append(stale, staleValue{b, append([]byte(nil), k...), v})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, sv := range stale {
+				var plain json.RawMessage
+				if err := decodeValue(keys, sv.v, &plain); err != nil {
+					skipped++
+					continue
+				}
+				data, err := keys.seal(plain)
+				if err != nil {
+					return err
+				}
+				if err := sv.b.Put(sv.k, data); err != nil {
+					return err
+				}
+				sealed++
+			}
+			return nil
+		})
+		if err != nil {
+			return sealed, skipped, err
+		}
+	}
+	if skipped > 0 || !sameKeys(keys, s.keyring()) {
+		return sealed, skipped, nil
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		checks := tx.Bucket(keysBucket)
+		var previous [][]byte
+		err := checks.ForEach(func(id, _ []byte) error {
+			if !bytes.Equal(id, keys.current.id) {
+				previous = append(previous, append([]byte(nil), id...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range previous {
+			if err := checks.Delete(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return sealed, skipped, err
+}
+
+// saveMessage appends m to conversation c, creating the conversation if it
+// is new. A new conversation is named after its first query.
+func (s *conversationStore) saveMessage(c storedConversation, m storedMessage) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(conversationsBucket).CreateBucketIfNotExists(c.key())
+		if err != nil {
+			return err
+		}
+		var meta storedConversation
+		if data := b.Get(metaKey); data != nil {
+			if err := s.decode(data, &meta); err != nil {
+				return err
+			}
+		} else {
+			meta = c
+			meta.Name = truncate(m.Query, storedConversationNameSize)
+			meta.CreatedAt = m.CreatedAt
+		}
+		meta.Messages++
+		meta.UpdatedAt = m.CreatedAt
+
+		messages, err := b.CreateBucketIfNotExists(messagesBucket)
+		if err != nil {
+			return err
+		}
+		seq, _ := messages.NextSequence()
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], seq)
+		data, err := s.encode(m)
+		if err != nil {
+			return err
+		}
+		if err := messages.Put(key[:], data); err != nil {
+			return err
+		}
+		if data, err = s.encode(meta); err != nil {
+			return err
+		}
+		return b.Put(metaKey, data)
+	})
+}
+
+// conversations returns the conversations of user in app, most recently
+// updated first.
+func (s *conversationStore) conversations(orgID int64, app, user string) ([]storedConversation, error) {
+	prefix := conversationKey(orgID, app, user, "")
+	list := []storedConversation{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(conversationsBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Next() {
+			var meta storedConversation
+			if err := s.decode(tx.Bucket(conversationsBucket).Bucket(k).Get(metaKey), &meta); err != nil {
+				return err
+			}
+			list = append(list, meta)
+		}
+		return nil
+	})
+	sort.SliceStable(list, func(i, j int) bool { return list[i].UpdatedAt.After(list[j].UpdatedAt) })
+	return list, err
+}
+
+// messages returns the messages of a conversation of user in app, oldest
+// first, or nil if there is no such conversation.
+func (s *conversationStore) messages(orgID int64, app, user, id string) ([]storedMessage, error) {
+	var list []storedMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(conversationsBucket).Bucket(conversationKey(orgID, app, user, id))
+		if b == nil {
+			return nil
+		}
+		list = []storedMessage{}
+		messages := b.Bucket(messagesBucket)
+		if messages == nil {
+			return nil
+		}
+		return messages.ForEach(func(_, v []byte) error {
+			var m storedMessage
+			if err := s.decode(v, &m); err != nil {
+				return err
+			}
+			list = append(list, m)
+			return nil
+		})
+	})
+	return list, err
+}
+
+// purge deletes the conversations of an org not updated since maxAge
+// before now and those of each user beyond the maxPerUser most recently
+// updated. Zero disables either rule. Conversations of other orgs are left
+// alone, should the store hold any. Conversations that
+// cannot be opened are skipped and kept. It returns the number of deleted
+// and skipped conversations.
+func (s *conversationStore) purge(orgID int64, now time.Time, maxAge time.Duration, maxPerUser int) (deleted, skipped int, err error) {
+	prefix := []byte(strconv.FormatInt(orgID, 10) + "\x00")
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		skipped = 0
+		root := tx.Bucket(conversationsBucket)
+		var expired [][]byte
+		perUser := map[string][]storedConversation{}
+		c := root.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if v != nil {
+				continue
+			}
+			var meta storedConversation
+			if err := s.decode(root.Bucket(k).Get(metaKey), &meta); err != nil {
+				skipped++
+				continue
+			}
+			if maxAge > 0 && now.Sub(meta.UpdatedAt) > maxAge {
+				expired = append(expired, meta.key())
+				continue
+			}
+			perUser[meta.User] = append(perUser[meta.User], meta)
+		}
+		if maxPerUser > 0 {
+			for _, list := range perUser {
+				if len(list) <= maxPerUser {
+					continue
+				}
+				sort.SliceStable(list, func(i, j int) bool { return list[i].UpdatedAt.After(list[j].UpdatedAt) })
+				for _, c := range list[maxPerUser:] {
+					expired = append(expired, c.key())
+				}
+			}
+		}
+		for _, k := range expired {
+			if err := root.DeleteBucket(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(expired)
+		return nil
+	})
+	return deleted, skipped, err
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// conversationStores holds one open store per path, and so per org. bbolt
+// locks its file, so app instances share the store instead of opening it
+// again. The store takes the storage keys of the latest instance of its org
+// only once they passed verify, see useKeys.
+type conversationStores struct {
+	mu     sync.Mutex
+	stores map[string]*conversationStore
+}
+
+// sharedConversationStores holds the stores of all app instances, see App.
+var sharedConversationStores = &conversationStores{stores: map[string]*conversationStore{}}
+
+// get returns the store of the org's settings sealing with keys, or nil if
+// the store is disabled. It refuses to open the store without a storage
+// key. Failures are retried by the next call.
+func (l *conversationStores) get(orgID int64, s conversationStoreSettings, keys *keyring) (*conversationStore, error) {
+	if !s.Enabled {
+		return nil, nil
+	}
+	if keys == nil {
+		return nil, &ConfigError{"the conversation store needs the " + storageKeySetting + " secure setting"}
+	}
+	path, err := s.path(orgID)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if store, ok := l.stores[path]; ok {
+		if err := store.useKeys(keys); err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	store, err := openConversationStore(path, keys)
+	if err != nil {
+		return nil, err
+	}
+	l.stores[path] = store
+	return store, nil
+}
+
+// transcript is the chat message of a request, stored once it was answered.
+type transcript struct {
+	conversation storedConversation
+	message      storedMessage
+}
+
+// startTranscript starts recording the chat message of the request, if the
+// conversation store is enabled. query is the query as the user sent it.
+func (t *difyTarget) startTranscript(req *http.Request, query string) {
+	if t.store == nil {
+		return
+	}
+	login := ""
+	if u := backend.PluginConfigFromContext(req.Context()).User; u != nil {
+		login = u.Login
+	}
+	t.transcript = &transcript{
+		conversation: storedConversation{OrgID: t.orgID, App: t.app.Name, User: t.user, Login: login},
+		message:      storedMessage{Query: query, CreatedAt: time.Now().UTC()},
+	}
+}
+
+// saveTranscript stores the chat message of the request with its answer,
+// once Dify assigned the conversation.
+func (t *difyTarget) saveTranscript(conversationID, messageID, answer string, usage *dify.Usage) {
+	if t.transcript == nil || conversationID == "" {
+		return
+	}
+	c, m := t.transcript.conversation, t.transcript.message
+	c.ID = conversationID
+	m.ID, m.Answer = messageID, answer
+	if usage != nil {
+		m.TotalTokens = usage.TotalTokens
+	}
+	if err := t.store.saveMessage(c, m); err != nil {
+		log.DefaultLogger.Error("Failed to store chat message", "app", t.app.Name, "conversation_id", conversationID, "error", err)
+	}
+}
+
+// maintainConversationStore maintains the org's store in the background
+// until Dispose, once the first request of the instance opened it: it first
+// re-encrypts values sealed with a previous storage key, then purges the
+// store if a retention rule is set. Instances belong to one org, which the
+// requests tell.
+func (a *App) maintainConversationStore(orgID int64, store *conversationStore, cfg conversationStoreSettings) {
+	a.maintainStore.Do(func() {
+		go runStoreMaintenance(a.maintenance, orgID, store, cfg)
+	})
+}
+
+func runStoreMaintenance(ctx context.Context, orgID int64, store *conversationStore, cfg conversationStoreSettings) {
+	sealed, skipped, err := store.reencrypt()
+	if err != nil {
+		log.DefaultLogger.Error("Failed to re-encrypt the conversation store", "org_id", orgID, "error", err)
+	} else if sealed > 0 {
+		log.DefaultLogger.Info("Re-encrypted stored conversations", "org_id", orgID, "values", sealed)
+	}
+	if skipped > 0 {
+		log.DefaultLogger.Warn("Skipped stored values no storage key opens", "org_id", orgID, "values", skipped)
+	}
+	if cfg.MaxAgeDays <= 0 && cfg.MaxPerUser <= 0 {
+		return
+	}
+	maxAge := time.Duration(cfg.MaxAgeDays) * 24 * time.Hour
+	ticker := time.NewTicker(seconds(cfg.PurgeInterval, defaultStorePurgeInterval))
+	defer ticker.Stop()
+	for {
+		n, skipped, err := store.purge(orgID, time.Now().UTC(), maxAge, cfg.MaxPerUser)
+		if err != nil {
+			log.DefaultLogger.Error("Failed to purge the conversation store", "org_id", orgID, "error", err)
+		} else if n > 0 {
+			log.DefaultLogger.Info("Purged stored conversations", "org_id", orgID, "count", n)
+		}
+		if skipped > 0 {
+			log.DefaultLogger.Warn("Skipped stored conversations no storage key opens", "org_id", orgID, "count", skipped)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkConversationStore writes an error response and returns false if the
+// target has no conversation store.
+func (a *App) checkConversationStore(w http.ResponseWriter, t *difyTarget) bool {
+	if t.store == nil {
+		http.Error(w, "The conversation store is not enabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// writeStoreError reports a conversation store that cannot be opened.
+func writeStoreError(w http.ResponseWriter, err error) {
+	var ce *ConfigError
+	if errors.As(err, &ce) {
+		writeConfigError(w, err)
+		return
+	}
+	http.Error(w, "Failed to open the conversation store: "+err.Error(), http.StatusInternalServerError)
+}
+
+// openConversationStore returns the conversation store of the request, or
+// nil if it is disabled.
+func (a *App) openConversationStore(req *http.Request, settings *pluginSettings) (*conversationStore, error) {
+	pluginConfig := backend.PluginConfigFromContext(req.Context())
+	keys, err := loadKeyring(pluginConfig.AppInstanceSettings)
+	if err != nil {
+		return nil, err
+	}
+	return sharedConversationStores.get(pluginConfig.OrgID, settings.ConversationStore, keys)
+}
+
+// handleArchivedConversations lists the calling user's stored conversations
+// of an app, most recently updated first.
+func (a *App) handleArchivedConversations(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t, ok := a.resolveTarget(w, req, appTypeChat)
+	if !ok {
+		return
+	}
+	if !a.checkConversationStore(w, t) {
+		return
+	}
+	list, err := t.store.conversations(t.orgID, t.app.Name, t.user)
+	if err != nil {
+		http.Error(w, "Failed to read the conversation store: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"data": list})
+}
+
+// handleArchivedMessages returns the stored messages of a conversation of
+// the calling user, given by ?conversation_id=.
+func (a *App) handleArchivedMessages(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t, ok := a.resolveTarget(w, req, appTypeChat)
+	if !ok {
+		return
+	}
+	if !a.checkConversationStore(w, t) {
+		return
+	}
+	id := req.URL.Query().Get("conversation_id")
+	if id == "" {
+		http.Error(w, "conversation_id is required", http.StatusBadRequest)
+		return
+	}
+	list, err := t.store.messages(t.orgID, t.app.Name, t.user, id)
+	if err != nil {
+		http.Error(w, "Failed to read the conversation store: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if list == nil {
+		http.Error(w, "conversation not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"data": list})
+}
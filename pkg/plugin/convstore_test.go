@@ -0,0 +1,216 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestConversationStore tests that streamed chat messages are stored per
+// user and can be read back
+func TestConversationStore(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/conversations":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"has_more": false, "data": [{"id": "c1"}]}`))
+		case "/v1/messages":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"data": []}`))
+		case "/v1/chat-messages":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"event\": \"message\", \"conversation_id\": \"c1\", \"message_id\": \"m1\", \"answer\": \"Check \"}\n\n" +
+				"data: {\"event\": \"message\", \"conversation_id\": \"c1\", \"message_id\": \"m1\", \"answer\": \"the disk\"}\n\n" +
+				"data: {\"event\": \"message_end\", \"conversation_id\": \"c1\", \"message_id\": \"m1\", \"metadata\": {\"usage\": {\"total_tokens\": 7}}}\n\n"))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	app.usage = newUsageLedger()
+	t.Setenv("GF_PATHS_DATA", t.TempDir())
+
+	settings := &backend.AppInstanceSettings{
+		JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "conversationStore": {"enabled": true}}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key", storageKeySetting: "store test storage key"},
+	}
+
+	callResource(t, app, asUser("alice", roleViewer, settings), http.MethodPost, "difyChatProxy", `{"query": "why is the node down?"}`)
+	callResource(t, app, asUser("alice", roleViewer, settings), http.MethodPost, "difyChatProxy", `{"query": "and now?", "conversation_id": "c1"}`)
+
+	var conversations struct {
+		Data []storedConversation `json:"data"`
+	}
+	resp := callResource(t, app, asUser("alice", roleViewer, settings), http.MethodGet, "archivedConversations", "")
+	if err := json.Unmarshal(resp.Body, &conversations); err != nil || len(conversations.Data) != 1 {
+		t.Fatalf("Expected one stored conversation, got %s: %v", resp.Body, err)
+	}
+	if c := conversations.Data[0]; c.ID != "c1" || c.Name != "why is the node down?" || c.Messages != 2 || c.Login != "alice" {
+		t.Errorf("Unexpected conversation %+v", c)
+	}
+
+	var messages struct {
+		Data []storedMessage `json:"data"`
+	}
+	resp = callResource(t, app, asUser("alice", roleViewer, settings), http.MethodGet, "archivedMessages?conversation_id=c1", "")
+	if err := json.Unmarshal(resp.Body, &messages); err != nil || len(messages.Data) != 2 {
+		t.Fatalf("Expected two stored messages, got %s: %v", resp.Body, err)
+	}
+	if m := messages.Data[1]; m.ID != "m1" || m.Query != "and now?" || m.Answer != "Check the disk" || m.TotalTokens != 7 {
+		t.Errorf("Unexpected message %+v", m)
+	}
+
+	if resp := callResource(t, app, asUser("bob", roleViewer, settings), http.MethodGet, "archivedMessages?conversation_id=c1", ""); resp.Status != http.StatusNotFound {
+		t.Errorf("Expected another user's conversation to be hidden, got %d", resp.Status)
+	}
+}
+
+// TestConversationStorePurge tests the retention rules, which each org
+// applies to its own conversations only
+func TestConversationStorePurge(t *testing.T) {
+	keys, _ := newTestKeyring("purge test storage key", "")
+	store, err := openConversationStore(filepath.Join(t.TempDir(), "conversations.db"), keys)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.db.Close()
+
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	save := func(orgID int64, user, id string, age time.Duration) {
+		c := storedConversation{ID: id, OrgID: orgID, App: "logs", User: user}
+		if err := store.saveMessage(c, storedMessage{Query: "q", CreatedAt: now.Add(-age)}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	for _, orgID := range []int64{1, 10} {
+		save(orgID, "alice", "old", 40*24*time.Hour)
+		save(orgID, "alice", "a1", 3*time.Hour)
+		save(orgID, "alice", "a2", 2*time.Hour)
+		save(orgID, "alice", "a3", time.Hour)
+		save(orgID, "bob", "b1", 5*time.Hour)
+	}
+
+	// Org 1 keeps 30 days and 2 conversations per user, org 10 keeps 60
+	// days and any number.
+	if n, _, err := store.purge(1, now, 30*24*time.Hour, 2); err != nil || n != 2 {
+		t.Fatalf("Expected 2 purged conversations, got %d: %v", n, err)
+	}
+	if n, _, err := store.purge(10, now, 60*24*time.Hour, 0); err != nil || n != 0 {
+		t.Fatalf("Expected no purged conversations, got %d: %v", n, err)
+	}
+	for _, tc := range []struct {
+		orgID    int64
+		user     string
+		expected []string
+	}{
+		{1, "alice", []string{"a3", "a2"}},
+		{1, "bob", []string{"b1"}},
+		{10, "alice", []string{"a3", "a2", "a1", "old"}},
+		{10, "bob", []string{"b1"}},
+	} {
+		list, _ := store.conversations(tc.orgID, "logs", tc.user)
+		var ids []string
+		for _, c := range list {
+			ids = append(ids, c.ID)
+		}
+		if strings.Join(ids, ",") != strings.Join(tc.expected, ",") {
+			t.Errorf("Expected %s of org %d to keep %v, got %v", tc.user, tc.orgID, tc.expected, ids)
+		}
+	}
+}
+
+// TestConversationStoreRetention tests that the first request of an instance
+// starts the retention of its org
+func TestConversationStoreRetention(t *testing.T) {
+	t.Setenv("GF_PATHS_DATA", t.TempDir())
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	defer app.Dispose()
+
+	const orgID = 7
+	cfg := conversationStoreSettings{Enabled: true, MaxAgeDays: 30}
+	keys, _ := newTestKeyring("retention test storage key", "")
+	store, err := sharedConversationStores.get(orgID, cfg, keys)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	for id, age := range map[string]time.Duration{"old": 90 * 24 * time.Hour, "new": time.Hour} {
+		c := storedConversation{ID: id, OrgID: orgID, App: "default", User: "org7:alice"}
+		if err := store.saveMessage(c, storedMessage{Query: "why?", CreatedAt: time.Now().Add(-age)}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	settings := &backend.AppInstanceSettings{
+		JSONData:                []byte(`{"apiUrl": "http://dify.invalid", "conversationStore": {"enabled": true, "maxAgeDays": 30}}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key", storageKeySetting: "retention test storage key"},
+	}
+	pluginContext := asUser("alice", roleViewer, settings)
+	pluginContext.OrgID = orgID
+	resp := callResource(t, app, pluginContext, http.MethodGet, "archivedConversations", "")
+	if resp.Status != http.StatusOK {
+		t.Fatalf("Unexpected response %d: %s", resp.Status, resp.Body)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		list, err := store.conversations(orgID, "default", "org7:alice")
+		if err != nil {
+			t.Fatalf("conversations: %v", err)
+		}
+		if len(list) == 1 && list[0].ID == "new" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the old conversation to be purged, got %+v", list)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestConversationStoreRefused tests that chat messages are refused rather
+// than left unrecorded when the enabled store cannot be opened
+func TestConversationStoreRefused(t *testing.T) {
+	t.Setenv("GF_PATHS_DATA", t.TempDir())
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected call to Dify %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	defer app.Dispose()
+
+	for name, secrets := range map[string]map[string]string{
+		"no storage key":    {"apiKey": "test-api-key"},
+		"short storage key": {"apiKey": "test-api-key", storageKeySetting: "short"},
+	} {
+		settings := &backend.AppInstanceSettings{
+			JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "conversationStore": {"enabled": true}}`),
+			DecryptedSecureJSONData: secrets,
+		}
+		resp := callResource(t, app, asUser("alice", roleViewer, settings), http.MethodPost, "difyChatProxy", `{"query": "hi"}`)
+		if resp.Status != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d: %s", name, resp.Status, resp.Body)
+		}
+	}
+}
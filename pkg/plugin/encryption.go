@@ -0,0 +1,180 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Secure settings holding the storage keys. previousStorageKeys lists the
+// keys replaced by a rotation, separated by commas, so that data sealed with
+// them can still be read while it is re-encrypted.
+const (
+	storageKeySetting          = "storageKey"
+	previousStorageKeysSetting = "previousStorageKeys"
+)
+
+// minStorageKeyLength bounds how short a storage key secret may be.
+const minStorageKeyLength = 16
+
+// sealedVersion starts every sealed value, followed by the key ID, the nonce
+// and the AES-GCM ciphertext. It is not a valid first byte of JSON, so plain
+// values written before encryption are told apart.
+const sealedVersion = 1
+
+const keyIDSize = 8
+
+// sealedPrefix marks sealed strings in text files such as the audit trail.
+const sealedPrefix = "enc:v1:"
+
+var errUnknownStorageKey = errors.New("sealed with an unknown storage key")
+
+// storageKey is an AES-256-GCM key derived from a secret.
+type storageKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+func newStorageKey(secret string) (*storageKey, error) {
+	if len(secret) < minStorageKeyLength {
+		return nil, &ConfigError{"storage keys must be at least 16 characters long"}
+	}
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, "dify-chatflow storage encryption", 32)
+	if err != nil {
+		return nil, err
+	}
+	id, err := hkdf.Key(sha256.New, []byte(secret), nil, "dify-chatflow storage key id", keyIDSize)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &storageKey{id: id, aead: aead}, nil
+}
+
+// keyring seals with the current storage key and opens with any known one.
+type keyring struct {
+	current  *storageKey
+	previous []*storageKey
+}
+
+// loadKeyring reads the storage keys from the secure settings. It returns
+// nil if no storage key is set.
+func loadKeyring(settings *backend.AppInstanceSettings) (*keyring, error) {
+	if settings == nil || settings.DecryptedSecureJSONData[storageKeySetting] == "" {
+		return nil, nil
+	}
+	current, err := newStorageKey(settings.DecryptedSecureJSONData[storageKeySetting])
+	if err != nil {
+		return nil, err
+	}
+	k := &keyring{current: current}
+	for _, secret := range strings.Split(settings.DecryptedSecureJSONData[previousStorageKeysSetting], ",") {
+		if secret = strings.TrimSpace(secret); secret == "" {
+			continue
+		}
+		previous, err := newStorageKey(secret)
+		if err != nil {
+			return nil, err
+		}
+		k.previous = append(k.previous, previous)
+	}
+	return k, nil
+}
+
+// seal encrypts plain with the current key.
+func (k *keyring) seal(plain []byte) ([]byte, error) {
+	header := append([]byte{sealedVersion}, k.current.id...)
+	nonce := make([]byte, k.current.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return k.current.aead.Seal(out, nonce, plain, header), nil
+}
+
+// open decrypts a sealed value with the key it was sealed with.
+func (k *keyring) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < 1+keyIDSize || sealed[0] != sealedVersion {
+		return nil, errors.New("not a sealed value")
+	}
+	header, rest := sealed[:1+keyIDSize], sealed[1+keyIDSize:]
+	for _, key := range append([]*storageKey{k.current}, k.previous...) {
+		if !bytes.Equal(key.id, header[1:]) {
+			continue
+		}
+		n := key.aead.NonceSize()
+		if len(rest) < n {
+			return nil, errors.New("sealed value is truncated")
+		}
+		return key.aead.Open(nil, rest[:n], rest[n:], header)
+	}
+	return nil, errUnknownStorageKey
+}
+
+// isCurrent reports whether data is sealed with the current key.
+func (k *keyring) isCurrent(data []byte) bool {
+	return bytes.Equal(sealedKeyID(data), k.current.id)
+}
+
+// sealedKeyID returns the ID of the key data is sealed with, or nil if data
+// is not sealed.
+func sealedKeyID(data []byte) []byte {
+	if len(data) < 1+keyIDSize || data[0] != sealedVersion {
+		return nil
+	}
+	return data[1 : 1+keyIDSize]
+}
+
+// sameKeys reports whether a and b hold the same keys in the same roles.
+func sameKeys(a, b *keyring) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if !bytes.Equal(a.current.id, b.current.id) || len(a.previous) != len(b.previous) {
+		return false
+	}
+	for i := range a.previous {
+		if !bytes.Equal(a.previous[i].id, b.previous[i].id) {
+			return false
+		}
+	}
+	return true
+}
+
+// sealString encrypts s for a text file.
+func (k *keyring) sealString(s string) (string, error) {
+	sealed, err := k.seal([]byte(s))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openString decrypts a string sealed by sealString. Other strings are
+// returned as they are.
+func (k *keyring) openString(s string) (string, error) {
+	if !strings.HasPrefix(s, sealedPrefix) {
+		return s, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, sealedPrefix))
+	if err != nil {
+		return "", err
+	}
+	plain, err := k.open(sealed)
+	return string(plain), err
+}
@@ -0,0 +1,273 @@
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestKeyring(current, previous string) (*keyring, error) {
+	return loadKeyring(&backend.AppInstanceSettings{DecryptedSecureJSONData: map[string]string{
+		storageKeySetting:          current,
+		previousStorageKeysSetting: previous,
+	}})
+}
+
+// TestConversationStoreEncryption tests that stored messages are sealed and
+// re-encrypted when the storage key is rotated
+func TestConversationStoreEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.db")
+	oldKeys, err := newTestKeyring("the old storage key", "")
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	store, err := openConversationStore(path, oldKeys)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	c := storedConversation{ID: "c1", OrgID: 1, App: "logs", User: "alice", Name: "disk full on node-7"}
+	if err := store.saveMessage(c, storedMessage{Query: "disk full on node-7", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	store.db.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if bytes.Contains(data, []byte("node-7")) {
+		t.Errorf("Expected messages to be encrypted at rest")
+	}
+
+	var ce *ConfigError
+	if _, err := sharedConversationStores.get(1, conversationStoreSettings{Enabled: true}, nil); !errors.As(err, &ce) {
+		t.Errorf("Expected the store to be refused without a storage key, got %v", err)
+	}
+	wrongKeys, _ := newTestKeyring("not the storage key", "")
+	if _, err := openConversationStore(path, wrongKeys); !errors.As(err, &ce) {
+		t.Errorf("Expected the store to be refused with a wrong storage key, got %v", err)
+	}
+
+	rotated, err := newTestKeyring("the new storage key", "an unrelated key, the old storage key")
+	if err != nil {
+		t.Fatalf("keyring: %v", err)
+	}
+	store, err = openConversationStore(path, rotated)
+	if err != nil {
+		t.Fatalf("open after rotation: %v", err)
+	}
+	if n, _, err := store.reencrypt(); err != nil || n != 2 {
+		t.Errorf("Expected 2 re-encrypted values, got %d: %v", n, err)
+	}
+	if n, _, err := store.reencrypt(); err != nil || n != 0 {
+		t.Errorf("Expected nothing left to re-encrypt, got %d: %v", n, err)
+	}
+	store.db.Close()
+
+	newKeys, _ := newTestKeyring("the new storage key", "")
+	store, err = openConversationStore(path, newKeys)
+	if err != nil {
+		t.Fatalf("open with the new key alone: %v", err)
+	}
+	defer store.db.Close()
+	messages, err := store.messages(1, "logs", "alice", "c1")
+	if err != nil || len(messages) != 1 || messages[0].Query != "disk full on node-7" {
+		t.Errorf("Unexpected messages after rotation %+v: %v", messages, err)
+	}
+}
+
+// TestKeyringStrings tests sealing strings for text files
+func TestKeyringStrings(t *testing.T) {
+	if _, err := newTestKeyring("too short", ""); err == nil {
+		t.Errorf("Expected a short storage key to be rejected")
+	}
+	keys, _ := newTestKeyring("a test storage key", "")
+	sealed, err := keys.sealString("why is prod down?")
+	if err != nil || sealed == "why is prod down?" {
+		t.Fatalf("Unexpected sealed string %q: %v", sealed, err)
+	}
+	if plain, err := keys.openString(sealed); err != nil || plain != "why is prod down?" {
+		t.Errorf("Unexpected opened string %q: %v", plain, err)
+	}
+	if plain, _ := keys.openString("plain"); plain != "plain" {
+		t.Errorf("Expected plain strings to be returned as they are, got %q", plain)
+	}
+	other, _ := newTestKeyring("another storage key", "")
+	if _, err := other.openString(sealed); !errors.Is(err, errUnknownStorageKey) {
+		t.Errorf("Expected an unknown key error, got %v", err)
+	}
+}
+
+// TestConversationStoreKeyChecks tests that every key that sealed values is
+// verified, also in stores written before key checks and by other instances
+func TestConversationStoreKeyChecks(t *testing.T) {
+	t.Setenv("GF_PATHS_DATA", t.TempDir())
+	settings := conversationStoreSettings{Enabled: true}
+	path, err := settings.path(1)
+	if err != nil {
+		t.Fatalf("path: %v", err)
+	}
+	keys, _ := newTestKeyring("the current storage key", "")
+	store, err := openConversationStore(path, keys)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	c := storedConversation{ID: "c2", OrgID: 1, App: "logs", User: "alice"}
+	if err := store.saveMessage(c, storedMessage{Query: "why?", CreatedAt: time.Now()}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	// A plain conversation sorting first and no key checks, as written
+	// before both were introduced.
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		plain := storedConversation{ID: "c1", OrgID: 1, App: "logs", User: "alice"}
+		b, err := tx.Bucket(conversationsBucket).CreateBucket(plain.key())
+		if err != nil {
+			return err
+		}
+		if err := b.Put(metaKey, []byte(`{"id":"c1","org_id":1,"app":"logs","user":"alice"}`)); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(keysBucket)
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	store.db.Close()
+
+	var ce *ConfigError
+	wrongKeys, _ := newTestKeyring("not the storage key", "")
+	if _, err := openConversationStore(path, wrongKeys); !errors.As(err, &ce) {
+		t.Fatalf("Expected a store with plain and sealed values to be refused with a wrong key, got %v", err)
+	}
+
+	store, err = sharedConversationStores.get(1, settings, keys)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	defer func() {
+		store.db.Close()
+		sharedConversationStores.mu.Lock()
+		delete(sharedConversationStores.stores, path)
+		sharedConversationStores.mu.Unlock()
+	}()
+	if _, err := sharedConversationStores.get(1, settings, wrongKeys); !errors.As(err, &ce) {
+		t.Errorf("Expected another instance's wrong key to be refused, got %v", err)
+	}
+	if !sameKeys(store.keyring(), keys) {
+		t.Errorf("Expected the store to keep its keys")
+	}
+	rotated, _ := newTestKeyring("the new storage key", "the current storage key")
+	if _, err := sharedConversationStores.get(1, settings, rotated); err != nil {
+		t.Fatalf("get with rotated keys: %v", err)
+	}
+	if !sameKeys(store.keyring(), rotated) {
+		t.Errorf("Expected the store to take the rotated keys")
+	}
+	if _, _, err := store.reencrypt(); err != nil {
+		t.Fatalf("reencrypt: %v", err)
+	}
+	if _, err := sharedConversationStores.get(1, settings, keys); !errors.As(err, &ce) {
+		t.Errorf("Expected the replaced key to be refused, got %v", err)
+	}
+	if messages, err := store.messages(1, "logs", "alice", "c2"); err != nil || len(messages) != 1 {
+		t.Errorf("Unexpected messages %+v: %v", messages, err)
+	}
+}
+
+// TestConversationStoreUnreadableValues tests that re-encryption and purges
+// skip values no storage key opens
+func TestConversationStoreUnreadableValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conversations.db")
+	keys, _ := newTestKeyring("the current storage key", "")
+	store, err := openConversationStore(path, keys)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.db.Close()
+	old := time.Now().Add(-90 * 24 * time.Hour)
+	for _, id := range []string{"c1", "c2", "c3"} {
+		c := storedConversation{ID: id, OrgID: 1, App: "logs", User: "alice"}
+		if err := store.saveMessage(c, storedMessage{Query: "why?", CreatedAt: old}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	lost, _ := newTestKeyring("a lost storage key", "")
+	unreadable, _ := lost.seal([]byte(`{"id":"c2"}`))
+	c2 := storedConversation{ID: "c2", OrgID: 1, App: "logs", User: "alice"}
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationsBucket).Bucket(c2.key()).Put(metaKey, unreadable)
+	})
+	if err != nil {
+		t.Fatalf("update: %v", err)
+	}
+
+	rotated, _ := newTestKeyring("the new storage key", "the current storage key")
+	if err := store.useKeys(rotated); err != nil {
+		t.Fatalf("use keys: %v", err)
+	}
+	if sealed, skipped, err := store.reencrypt(); err != nil || sealed != 5 || skipped != 1 {
+		t.Errorf("Expected 5 re-encrypted and 1 skipped value, got %d and %d: %v", sealed, skipped, err)
+	}
+	store.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(keysBucket).Get(keys.current.id) == nil {
+			t.Errorf("Expected the previous key's check to be kept while values were skipped")
+		}
+		return nil
+	})
+
+	deleted, skipped, err := store.purge(1, time.Now(), 30*24*time.Hour, 0)
+	if err != nil || deleted != 2 || skipped != 1 {
+		t.Errorf("Expected 2 purged and 1 skipped conversation, got %d and %d: %v", deleted, skipped, err)
+	}
+}
+
+// TestConversationStorePerOrg tests that orgs with storage keys of their own
+// keep their conversations in files of their own within the data directory
+func TestConversationStorePerOrg(t *testing.T) {
+	t.Setenv("GF_PATHS_DATA", t.TempDir())
+	settings := conversationStoreSettings{Enabled: true}
+	stores := map[int64]*conversationStore{}
+	for orgID, secret := range map[int64]string{3: "the storage key of org 3", 4: "the storage key of org 4"} {
+		keys, _ := newTestKeyring(secret, "")
+		store, err := sharedConversationStores.get(orgID, settings, keys)
+		if err != nil {
+			t.Fatalf("get for org %d: %v", orgID, err)
+		}
+		stores[orgID] = store
+		c := storedConversation{ID: "c1", OrgID: orgID, App: "logs", User: "alice"}
+		if err := store.saveMessage(c, storedMessage{Query: "why?", CreatedAt: time.Now()}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+	defer func() {
+		sharedConversationStores.mu.Lock()
+		defer sharedConversationStores.mu.Unlock()
+		for orgID, store := range stores {
+			store.db.Close()
+			path, _ := settings.path(orgID)
+			delete(sharedConversationStores.stores, path)
+		}
+	}()
+	if stores[3] == stores[4] {
+		t.Fatalf("Expected each org to have a store of its own")
+	}
+	for orgID, store := range stores {
+		if list, err := store.conversations(orgID, "logs", "alice"); err != nil || len(list) != 1 {
+			t.Errorf("Unexpected conversations of org %d %+v: %v", orgID, list, err)
+		}
+	}
+
+	keys, _ := newTestKeyring("the storage key of org 3", "")
+	var ce *ConfigError
+	for _, path := range []string{"/var/lib/grafana/grafana.db", "../4/conversations.db"} {
+		if _, err := sharedConversationStores.get(3, conversationStoreSettings{Enabled: true, Path: path}, keys); !errors.As(err, &ce) {
+			t.Errorf("Expected %q outside the org's directory to be refused, got %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// Balancing modes of an app with several endpoints.
+const (
+	// balancePriority sends all requests to the healthy endpoint with the
+	// lowest priority, so later endpoints act as standbys.
+	balancePriority = "priority"
+	// balanceWeighted spreads requests over the healthy endpoints in
+	// proportion to their weights.
+	balanceWeighted = "weighted"
+)
+
+const defaultEndpointProbeInterval = 30 * time.Second
+
+// endpointAffinityTTL is how long a conversation or task stays pinned to the
+// endpoint that created it after it was last used.
+const endpointAffinityTTL = 7 * 24 * time.Hour
+
+// maxAffinityPins bounds the pins kept. Expired ones are dropped when it is
+// reached, then the one used least recently, whose follow-up calls then go
+// wherever balancing sends them.
+const maxAffinityPins = 100000
+
+// sharedAffinity holds the endpoint pins of all app instances, see App.
+var sharedAffinity = newEndpointAffinity(endpointAffinityTTL)
+
+// difyEndpoint is one Dify deployment serving an app, with its own API key.
+type difyEndpoint struct {
+	Name string `json:"name"`
+	// APIURL and APIKeyRef default to the app's.
+	APIURL    string `json:"apiUrl"`
+	APIKeyRef string `json:"apiKeyRef"`
+	// Priority orders endpoints under balancePriority, lowest first.
+	// Endpoints of equal priority keep their configured order.
+	Priority int `json:"priority"`
+	// Weight is the endpoint's share under balanceWeighted. It defaults to 1.
+	Weight int `json:"weight"`
+
+	apiKey string
+}
+
+// loadEndpoints validates the app's endpoints and fills in their defaults.
+// An app without endpoints gets one from its APIURL and APIKeyRef.
+func (app *difyApp) loadEndpoints(settings *backend.AppInstanceSettings) error {
+	switch app.Balance {
+	case "":
+		app.Balance = balancePriority
+	case balancePriority, balanceWeighted:
+	default:
+		return &ConfigError{"app " + app.Name + " has unknown balance: " + app.Balance}
+	}
+	if len(app.Endpoints) == 0 {
+		app.Endpoints = []*difyEndpoint{{Name: app.Name}}
+	}
+
+	seen := map[string]bool{}
+	for i, ep := range app.Endpoints {
+		if ep.Name == "" {
+			ep.Name = "endpoint" + strconv.Itoa(i+1)
+		}
+		if seen[ep.Name] {
+			return &ConfigError{"app " + app.Name + " has duplicate endpoint: " + ep.Name}
+		}
+		seen[ep.Name] = true
+		if ep.Weight < 0 {
+			return &ConfigError{"endpoint " + ep.Name + " of app " + app.Name + " has a negative weight"}
+		}
+		if ep.Weight == 0 {
+			ep.Weight = 1
+		}
+		if ep.APIURL == "" {
+			ep.APIURL = app.APIURL
+		}
+		if ep.APIKeyRef == "" {
+			ep.APIKeyRef = app.APIKeyRef
+		}
+		ep.apiKey = settings.DecryptedSecureJSONData[ep.APIKeyRef]
+	}
+
+	primary := app.Endpoints[0]
+	app.APIURL, app.APIKeyRef, app.apiKey = primary.APIURL, primary.APIKeyRef, primary.apiKey
+	return nil
+}
+
+// usableEndpoints returns the endpoints with both a URL and a key.
+func (app *difyApp) usableEndpoints() []*difyEndpoint {
+	var usable []*difyEndpoint
+	for _, ep := range app.Endpoints {
+		if ep.APIURL != "" && ep.apiKey != "" {
+			usable = append(usable, ep)
+		}
+	}
+	return usable
+}
+
+// endpointLabel names an endpoint in logs and errors. An app's only
+// endpoint goes by the app's name.
+func (app *difyApp) endpointLabel(ep *difyEndpoint) string {
+	if len(app.Endpoints) == 1 {
+		return app.Name
+	}
+	return app.Name + "/" + ep.Name
+}
+
+// endpointKey identifies an endpoint within an instance.
+func endpointKey(app *difyApp, ep *difyEndpoint) string {
+	return app.Name + "/" + ep.Name + "/" + ep.APIURL
+}
+
+// endpointPool tracks which endpoints failed their last probe and the
+// weighted round-robin state of each app.
+type endpointPool struct {
+	mu sync.Mutex
+	// down holds the probe error of endpoints that are down.
+	down map[string]string
+	// current holds the smooth weighted round-robin counters.
+	current map[string]int
+}
+
+func newEndpointPool() *endpointPool {
+	return &endpointPool{down: map[string]string{}, current: map[string]int{}}
+}
+
+// setProbe records the outcome of probing an endpoint.
+func (p *endpointPool) setProbe(app *difyApp, ep *difyEndpoint, h appHealth) {
+	key := endpointKey(app, ep)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, wasDown := p.down[key]
+	switch {
+	case h.OK && wasDown:
+		log.DefaultLogger.Info("Dify endpoint is back up", "app", app.Name, "endpoint", ep.Name)
+		delete(p.down, key)
+	case !h.OK:
+		if !wasDown {
+			log.DefaultLogger.Warn("Dify endpoint is down", "app", app.Name, "endpoint", ep.Name, "error", h.Message)
+		}
+		p.down[key] = h.Message
+	}
+}
+
+// downReason returns why the endpoint's last probe failed, or "" if it
+// passed or has not been probed.
+func (p *endpointPool) downReason(app *difyApp, ep *difyEndpoint) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.down[endpointKey(app, ep)]
+}
+
+// nextWeighted picks from eps by smooth weighted round-robin, which
+// interleaves the endpoints instead of sending bursts to each.
+func (p *endpointPool) nextWeighted(app *difyApp, eps []*difyEndpoint) *difyEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *difyEndpoint
+	total := 0
+	for _, ep := range eps {
+		key := endpointKey(app, ep)
+		p.current[key] += ep.Weight
+		total += ep.Weight
+		if best == nil || p.current[key] > p.current[endpointKey(app, best)] {
+			best = ep
+		}
+	}
+	p.current[endpointKey(app, best)] -= total
+	return best
+}
+
+// endpointAffinity remembers which endpoint created each conversation and
+// task of an app. Dify deployments do not share them unless they share a
+// database, so follow-up calls must reach the same endpoint.
+type endpointAffinity struct {
+	mu   sync.Mutex
+	ttl  time.Duration
+	now  func() time.Time
+	pins map[string]*endpointPin
+}
+
+type endpointPin struct {
+	endpoint string
+	used     time.Time
+}
+
+func newEndpointAffinity(ttl time.Duration) *endpointAffinity {
+	return &endpointAffinity{ttl: ttl, now: time.Now, pins: map[string]*endpointPin{}}
+}
+
+// affinityKey identifies a conversation or task ID of an app of an org.
+// Dify IDs are UUIDs, so conversations and tasks share the key space.
+func affinityKey(orgID int64, app *difyApp, id string) string {
+	return strconv.FormatInt(orgID, 10) + "/" + app.Name + "/" + id
+}
+
+// pin records that id was created by the endpoint named endpoint.
+func (a *endpointAffinity) pin(orgID int64, app *difyApp, id, endpoint string) {
+	key := affinityKey(orgID, app, id)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if p, ok := a.pins[key]; ok {
+		p.endpoint, p.used = endpoint, now
+		return
+	}
+	if len(a.pins) >= maxAffinityPins {
+		oldest := ""
+		for k, p := range a.pins {
+			if now.Sub(p.used) > a.ttl {
+				delete(a.pins, k)
+			} else if oldest == "" || p.used.Before(a.pins[oldest].used) {
+				oldest = k
+			}
+		}
+		if len(a.pins) >= maxAffinityPins {
+			delete(a.pins, oldest)
+		}
+	}
+	a.pins[key] = &endpointPin{endpoint: endpoint, used: now}
+}
+
+// lookup returns the name of the endpoint id is pinned to.
+func (a *endpointAffinity) lookup(orgID int64, app *difyApp, id string) (string, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	p, ok := a.pins[affinityKey(orgID, app, id)]
+	if !ok || a.now().Sub(p.used) > a.ttl {
+		return "", false
+	}
+	p.used = a.now()
+	return p.endpoint, true
+}
+
+// endpointHealthy reports whether ep passed its last probe and its circuit
+// is not open.
+func (a *App) endpointHealthy(orgID int64, app *difyApp, ep *difyEndpoint) bool {
+	return a.endpoints.downReason(app, ep) == "" && a.breakers.state(breakerKey(orgID, app, ep)) != circuitOpen
+}
+
+// pickEndpoint selects the endpoint serving a request to app. Endpoints
+// whose last probe failed or whose circuit is open are skipped, unless all
+// are, in which case the app's balancing applies to all of them. The app
+// must have a usable endpoint, see getPluginConfig.
+func (a *App) pickEndpoint(orgID int64, app *difyApp) *difyEndpoint {
+	usable := app.usableEndpoints()
+	if len(usable) == 1 {
+		return usable[0]
+	}
+	var healthy []*difyEndpoint
+	for _, ep := range usable {
+		if a.endpointHealthy(orgID, app, ep) {
+			healthy = append(healthy, ep)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = usable
+	}
+
+	if app.Balance == balanceWeighted {
+		return a.endpoints.nextWeighted(app, healthy)
+	}
+	best := healthy[0]
+	for _, ep := range healthy[1:] {
+		if ep.Priority < best.Priority {
+			best = ep
+		}
+	}
+	return best
+}
+
+// follow moves t to the endpoint that created the conversation or task id,
+// so that a follow-up call reaches the deployment that knows it. t keeps
+// the endpoint picked by balancing if id is not pinned, or if the pinned
+// endpoint is unhealthy and the call has to fail over.
+func (a *App) follow(req *http.Request, t *difyTarget, id string) {
+	if id == "" || len(t.app.Endpoints) < 2 {
+		return
+	}
+	name, ok := a.affinity.lookup(t.orgID, t.app, id)
+	if !ok || name == t.endpoint.Name {
+		return
+	}
+	for _, ep := range t.app.usableEndpoints() {
+		if ep.Name != name {
+			continue
+		}
+		if !a.endpointHealthy(t.orgID, t.app, ep) {
+			loggerFrom(req.Context()).Warn("Failing over from the endpoint that created the conversation or task",
+				"id", id, "endpoint", name, "fallback", t.endpoint.Name)
+			return
+		}
+		a.useEndpoint(req, t, ep)
+		return
+	}
+}
+
+// pin records that the target's endpoint created the conversation or task
+// ids. Empty IDs are skipped.
+func (t *difyTarget) pin(ids ...string) {
+	if t.affinity == nil || len(t.app.Endpoints) < 2 {
+		return
+	}
+	for _, id := range ids {
+		if id != "" {
+			t.affinity.pin(t.orgID, t.app, id, t.endpoint.Name)
+		}
+	}
+}
+
+// startEndpointProbes probes the endpoints of every app with more than one
+// in the background, until Dispose, so that requests avoid a deployment
+// that is down before a call to it fails.
+func (a *App) startEndpointProbes(settings *backend.AppInstanceSettings) {
+	apps, err := loadApps(settings)
+	if err != nil {
+		return
+	}
+	var failover []*difyApp
+	for _, app := range apps {
+		if len(app.usableEndpoints()) > 1 {
+			failover = append(failover, app)
+		}
+	}
+	if len(failover) == 0 {
+		return
+	}
+	interval := defaultEndpointProbeInterval
+	if s, err := loadSettings(settings); err == nil {
+		interval = seconds(s.EndpointProbeInterval, defaultEndpointProbeInterval)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	a.stopProbes = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, app := range failover {
+				for _, ep := range app.usableEndpoints() {
+					h := a.probeEndpoint(ctx, app, ep)
+					if ctx.Err() != nil {
+						return
+					}
+					a.endpoints.setProbe(app, ep, h)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,241 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestLoadEndpoints tests the defaults and validation of app endpoints
+func TestLoadEndpoints(t *testing.T) {
+	apps, err := loadApps(&backend.AppInstanceSettings{
+		JSONData: []byte(`{"apiUrl": "https://primary.example.com", "apps": [
+			{"name": "logs", "type": "chat", "apiKeyRef": "logsKey", "endpoints": [
+				{"name": "primary"},
+				{"apiUrl": "https://standby.example.com", "apiKeyRef": "standbyKey", "priority": 1}
+			]},
+			{"name": "triage", "type": "workflow"}
+		]}`),
+		DecryptedSecureJSONData: map[string]string{"logsKey": "k1", "standbyKey": "k2", "apiKey": "k3"},
+	})
+	if err != nil {
+		t.Fatalf("loadApps: %v", err)
+	}
+	logs, triage := apps[0], apps[1]
+	if logs.Balance != balancePriority || len(logs.Endpoints) != 2 {
+		t.Fatalf("Unexpected app %+v", logs)
+	}
+	primary, standby := logs.Endpoints[0], logs.Endpoints[1]
+	if primary.APIURL != "https://primary.example.com" || primary.apiKey != "k1" || primary.Weight != 1 {
+		t.Errorf("Expected the primary to inherit the app's URL and key, got %+v", primary)
+	}
+	if standby.Name != "endpoint2" || standby.apiKey != "k2" {
+		t.Errorf("Unexpected standby %+v", standby)
+	}
+	if logs.apiKey != "k1" {
+		t.Errorf("Expected the app key to be the primary's, got %q", logs.apiKey)
+	}
+	if len(triage.Endpoints) != 1 || triage.Endpoints[0].Name != "triage" || triage.Endpoints[0].apiKey != "k3" {
+		t.Errorf("Expected a single endpoint from the app settings, got %+v", triage.Endpoints[0])
+	}
+
+	for jsonData, expected := range map[string]string{
+		`{"apps": [{"name": "a", "apiUrl": "u", "balance": "random"}]}`:                         "unknown balance",
+		`{"apps": [{"name": "a", "apiUrl": "u", "endpoints": [{"name": "x"}, {"name": "x"}]}]}`: "duplicate endpoint",
+		`{"apps": [{"name": "a", "apiUrl": "u", "endpoints": [{"name": "x", "weight": -1}]}]}`:  "negative weight",
+	} {
+		if _, err := loadApps(&backend.AppInstanceSettings{JSONData: []byte(jsonData)}); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: expected error %q, got %v", jsonData, expected, err)
+		}
+	}
+}
+
+// TestWeightedEndpoints tests that weighted balancing interleaves endpoints
+// in proportion to their weights
+func TestWeightedEndpoints(t *testing.T) {
+	app := &App{endpoints: newEndpointPool(), breakers: newBreakers()}
+	apps, err := loadApps(&backend.AppInstanceSettings{
+		JSONData: []byte(`{"apps": [{"name": "a", "balance": "weighted", "endpoints": [
+			{"name": "big", "apiUrl": "https://big", "weight": 2},
+			{"name": "small", "apiUrl": "https://small"}
+		]}]}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "k"},
+	})
+	if err != nil {
+		t.Fatalf("loadApps: %v", err)
+	}
+	var picks []string
+	for i := 0; i < 6; i++ {
+		picks = append(picks, app.pickEndpoint(1, apps[0]).Name)
+	}
+	if got := strings.Join(picks, ","); got != "big,small,big,big,small,big" {
+		t.Errorf("Unexpected picks %s", got)
+	}
+}
+
+// TestEndpointFailover tests that requests move to the standby while the
+// primary fails its probes, and back once it recovers
+func TestEndpointFailover(t *testing.T) {
+	var primaryDown atomic.Bool
+	primaryDown.Store(true)
+	newServer := func(name string, down *atomic.Bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if down != nil && down.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if r.URL.Path == "/v1/info" {
+				w.Write([]byte(`{"name": "` + name + `", "mode": "advanced-chat"}`))
+				return
+			}
+			w.Write([]byte(`{"opening_statement": "` + name + `"}`))
+		}))
+	}
+	primary, standby := newServer("primary", &primaryDown), newServer("standby", nil)
+	defer primary.Close()
+	defer standby.Close()
+
+	instance := backend.AppInstanceSettings{
+		JSONData: []byte(`{"endpointProbeInterval": 1, "apps": [{"name": "logs", "type": "chat", "endpoints": [
+			{"name": "primary", "apiUrl": "` + primary.URL + `"},
+			{"name": "standby", "apiUrl": "` + standby.URL + `", "apiKeyRef": "standbyKey", "priority": 1}
+		]}]}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "k1", "standbyKey": "k2"},
+	}
+	inst, err := NewApp(context.Background(), instance)
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	defer app.Dispose()
+
+	parameters := func() string {
+		return string(callResource(t, app, asUser("viewer", roleViewer, &instance), http.MethodGet, "difyParameters", "").Body)
+	}
+	waitFor := func(name string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(parameters(), name) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Requests did not move to the %s", name)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+
+	waitFor("standby")
+	res, err := app.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+		PluginContext: backend.PluginContext{OrgID: 1, AppInstanceSettings: &instance},
+	})
+	if err != nil || res.Status != backend.HealthStatusOk || !strings.Contains(string(res.JSONDetails), `"endpoints"`) {
+		t.Errorf("Expected a healthy app with per-endpoint details, got %+v: %v", res, err)
+	}
+
+	primaryDown.Store(false)
+	waitFor("primary")
+}
+
+// TestEndpointAffinity tests that follow-up calls of a conversation or task
+// reach the endpoint that created it despite weighted balancing
+func TestEndpointAffinity(t *testing.T) {
+	var hits sync.Map
+	newServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count, _ := hits.LoadOrStore(name, new(int32))
+			atomic.AddInt32(count.(*int32), 1)
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.URL.Path == "/v1/chat-messages":
+				w.Write([]byte(`{"answer": "ok", "conversation_id": "c-` + name + `", "task_id": "t-` + name + `"}`))
+			case r.URL.Path == "/v1/messages" && r.URL.Query().Get("conversation_id") == "c-"+name,
+				r.URL.Path == "/v1/chat-messages/t-"+name+"/stop":
+				w.Write([]byte(`{"data": [], "result": "success"}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"code": "not_found", "message": "not found", "status": 404}`))
+			}
+		}))
+	}
+	east, west := newServer("east"), newServer("west")
+	defer east.Close()
+	defer west.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	app.affinity = newEndpointAffinity(endpointAffinityTTL)
+	settings := &backend.AppInstanceSettings{
+		JSONData: []byte(`{"apps": [{"name": "logs", "type": "chat", "balance": "weighted", "endpoints": [
+			{"name": "east", "apiUrl": "` + east.URL + `"},
+			{"name": "west", "apiUrl": "` + west.URL + `"}
+		]}]}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "k"},
+	}
+
+	resp := callResource(t, app, asUser("alice", roleViewer, settings), http.MethodPost, "difyChatProxy?response_mode=blocking", `{"query": "hi"}`)
+	var chat struct {
+		ConversationID string `json:"conversation_id"`
+		TaskID         string `json:"task_id"`
+	}
+	if err := json.Unmarshal(resp.Body, &chat); err != nil || chat.ConversationID == "" {
+		t.Fatalf("Unexpected chat response %s: %v", resp.Body, err)
+	}
+	for i := 0; i < 4; i++ {
+		if resp := callResource(t, app, asUser("alice", roleViewer, settings), http.MethodGet, "difyMessageHistoryProxy?conversation_id="+chat.ConversationID, ""); resp.Status != http.StatusOK {
+			t.Errorf("history call %d: expected the creating endpoint, got %d: %s", i+1, resp.Status, resp.Body)
+		}
+	}
+	if resp := callResource(t, app, asUser("alice", roleViewer, settings), http.MethodPost, "difyChatStop", `{"task_id": "`+chat.TaskID+`"}`); resp.Status != http.StatusOK {
+		t.Errorf("Expected the stop call to reach the creating endpoint, got %d: %s", resp.Status, resp.Body)
+	}
+
+	// Once the creating endpoint is down, calls fail over to the other one.
+	creator := strings.TrimPrefix(chat.ConversationID, "c-")
+	other := map[string]string{"east": "west", "west": "east"}[creator]
+	apps, _ := loadApps(settings)
+	for _, ep := range apps[0].Endpoints {
+		if ep.Name == creator {
+			app.endpoints.setProbe(apps[0], ep, appHealth{Message: "down"})
+		}
+	}
+	before, _ := hits.LoadOrStore(other, new(int32))
+	n := atomic.LoadInt32(before.(*int32))
+	callResource(t, app, asUser("alice", roleViewer, settings), http.MethodPost, "difyChatStop", `{"task_id": "`+chat.TaskID+`"}`)
+	if atomic.LoadInt32(before.(*int32)) != n+1 {
+		t.Errorf("Expected the call to fail over to %s", other)
+	}
+}
+
+// TestEndpointAffinityBound tests that the pins stay bounded when none of
+// them has expired
+func TestEndpointAffinityBound(t *testing.T) {
+	a := newEndpointAffinity(endpointAffinityTTL)
+	now := time.Now()
+	a.now = func() time.Time { return now }
+	app := &difyApp{Name: "logs"}
+	for i := 0; i < maxAffinityPins; i++ {
+		a.pin(1, app, strconv.Itoa(i), "east")
+		now = now.Add(time.Millisecond)
+	}
+	a.pin(1, app, "new", "west")
+	if len(a.pins) != maxAffinityPins {
+		t.Errorf("Expected %d pins, got %d", maxAffinityPins, len(a.pins))
+	}
+	if _, ok := a.lookup(1, app, "0"); ok {
+		t.Error("Expected the pin used least recently to be evicted")
+	}
+	if ep, ok := a.lookup(1, app, "new"); !ok || ep != "west" {
+		t.Errorf("Expected the new pin, got %q", ep)
+	}
+}
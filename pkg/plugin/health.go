@@ -0,0 +1,212 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// healthCheckTimeout bounds the probe of a single app.
+const healthCheckTimeout = 15 * time.Second
+
+// appHealth is the outcome of probing one configured app, reported in the
+// health check's JSONDetails.
+type appHealth struct {
+	Name   string `json:"name"`
+	Type   string `json:"type,omitempty"`
+	APIURL string `json:"apiUrl"`
+	OK     bool   `json:"ok"`
+	// Error classifies a failed probe, see probeApp.
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message,omitempty"`
+	// DifyName and DifyMode are what Dify reports for the API key.
+	DifyName string `json:"difyName,omitempty"`
+	DifyMode string `json:"difyMode,omitempty"`
+	// Circuit is the state of the app's circuit breaker; for an app with
+	// several endpoints, the best state among them. Probes bypass it.
+	Circuit string `json:"circuit"`
+	// Endpoints holds the probe of each endpoint of an app with several.
+	// The app is healthy if any endpoint is.
+	Endpoints []appHealth `json:"endpoints,omitempty"`
+}
+
+// Error classes reported by probeApp.
+const (
+	healthErrorConfig      = "config"
+	healthErrorUnreachable = "unreachable"
+	healthErrorTLS         = "tls"
+	healthErrorAuth        = "unauthorized"
+	healthErrorAppType     = "wrong_app_type"
+	healthErrorAPI         = "api"
+)
+
+// CheckHealth probes every configured Dify app with its API key.
+func (a *App) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	apps, err := loadApps(req.PluginContext.AppInstanceSettings)
+	if err != nil {
+		return &backend.CheckHealthResult{
+			Status:  backend.HealthStatusError,
+			Message: "Invalid configuration: " + err.Error(),
+		}, nil
+	}
+
+	results := make([]appHealth, 0, len(apps))
+	var failed []string
+	for _, app := range apps {
+		h := a.probeApp(ctx, req.PluginContext.OrgID, app)
+		if !h.OK {
+			failed = append(failed, app.Name+": "+h.Message)
+		}
+		results = append(results, h)
+	}
+	details, err := json.Marshal(map[string]interface{}{"apps": results})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(failed) > 0 {
+		return &backend.CheckHealthResult{
+			Status:      backend.HealthStatusError,
+			Message:     strings.Join(failed, "; "),
+			JSONDetails: details,
+		}, nil
+	}
+	connected := make([]string, 0, len(results))
+	for _, h := range results {
+		entry := h.Name
+		if h.DifyName != "" {
+			entry += " (" + h.DifyName + ", " + h.DifyMode + ")"
+		}
+		if h.Circuit != circuitClosed {
+			entry += " [circuit " + h.Circuit + "]"
+		}
+		connected = append(connected, entry)
+	}
+	return &backend.CheckHealthResult{
+		Status:      backend.HealthStatusOk,
+		Message:     "Connected to Dify: " + strings.Join(connected, ", "),
+		JSONDetails: details,
+	}, nil
+}
+
+// probeApp probes every endpoint of the app. The results also steer
+// pickEndpoint.
+func (a *App) probeApp(ctx context.Context, orgID int64, app *difyApp) appHealth {
+	results := make([]appHealth, 0, len(app.Endpoints))
+	for _, ep := range app.Endpoints {
+		h := a.probeEndpoint(ctx, app, ep)
+		h.Circuit = a.breakers.state(breakerKey(orgID, app, ep))
+		if ep.APIURL != "" && ep.apiKey != "" {
+			a.endpoints.setProbe(app, ep, h)
+		}
+		results = append(results, h)
+	}
+	if len(results) == 1 {
+		return results[0]
+	}
+
+	h := appHealth{Name: app.Name, Type: app.Type, APIURL: app.APIURL, Circuit: a.appCircuit(orgID, app), Endpoints: results}
+	var failed []string
+	for i, r := range results {
+		results[i].Name, results[i].Type = app.Endpoints[i].Name, ""
+		if r.OK && !h.OK {
+			h.OK, h.DifyName, h.DifyMode = true, r.DifyName, r.DifyMode
+		}
+		if !r.OK {
+			failed = append(failed, app.Endpoints[i].Name+": "+r.Message)
+		}
+	}
+	if !h.OK {
+		return h.fail(results[0].Error, "all endpoints failed: "+strings.Join(failed, "; "))
+	}
+	return h
+}
+
+// probeEndpoint calls GET /v1/info with the endpoint's key, falling back to
+// GET /v1/parameters on Dify versions without /v1/info.
+func (a *App) probeEndpoint(ctx context.Context, app *difyApp, ep *difyEndpoint) appHealth {
+	h := appHealth{Name: app.Name, Type: app.Type, APIURL: ep.APIURL}
+	switch {
+	case ep.APIURL == "":
+		return h.fail(healthErrorConfig, "apiUrl is not set")
+	case ep.apiKey == "":
+		return h.fail(healthErrorConfig, "API key is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	client := dify.NewClient(ep.APIURL, ep.apiKey, a.httpClient)
+
+	info, err := client.Info(ctx)
+	var apiErr *dify.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		_, err = client.Parameters(ctx, "")
+		info = &dify.AppInfo{}
+	}
+	if err != nil {
+		return h.fail(classifyProbeError(err))
+	}
+
+	h.DifyName, h.DifyMode = info.Name, info.Mode
+	if !modeMatches(app.Type, info.Mode) {
+		return h.fail(healthErrorAppType, "API key belongs to a "+info.Mode+" app, not a "+app.Type+" app")
+	}
+	h.OK = true
+	return h
+}
+
+func (h appHealth) fail(class, message string) appHealth {
+	h.Error, h.Message = class, message
+	return h
+}
+
+// classifyProbeError turns a failed probe into an error class and a message
+// fit for the config page.
+func classifyProbeError(err error) (string, string) {
+	var apiErr *dify.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden {
+			return healthErrorAuth, "Dify rejected the API key: " + apiErr.Message
+		}
+		return healthErrorAPI, apiErr.Error()
+	}
+
+	var (
+		unknownCA x509.UnknownAuthorityError
+		hostname  x509.HostnameError
+		invalid   x509.CertificateInvalidError
+		verify    *tls.CertificateVerificationError
+		record    tls.RecordHeaderError
+		alert     tls.AlertError
+	)
+	if errors.As(err, &unknownCA) || errors.As(err, &hostname) || errors.As(err, &invalid) ||
+		errors.As(err, &verify) || errors.As(err, &record) || errors.As(err, &alert) {
+		return healthErrorTLS, "TLS handshake with Dify failed: " + err.Error()
+	}
+	return healthErrorUnreachable, "Dify is unreachable: " + err.Error()
+}
+
+// modeMatches reports whether a Dify app mode can serve routes of appType.
+// An unknown mode, as on Dify versions without /v1/info, is accepted.
+func modeMatches(appType, mode string) bool {
+	if appType == "" || mode == "" {
+		return true
+	}
+	switch mode {
+	case dify.AppModeChat, dify.AppModeAdvancedChat, dify.AppModeAgentChat:
+		return appType == appTypeChat
+	case dify.AppModeCompletion:
+		return appType == appTypeCompletion
+	case dify.AppModeWorkflow:
+		return appType == appTypeWorkflow
+	}
+	return true
+}
@@ -0,0 +1,138 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// difyInfoMock answers /v1/info by API key, like apps of different modes.
+func difyInfoMock(w http.ResponseWriter, r *http.Request) {
+	switch r.Header.Get("Authorization") {
+	case "Bearer chat-key":
+		w.Write([]byte(`{"name": "Log assistant", "mode": "advanced-chat"}`))
+	case "Bearer workflow-key":
+		w.Write([]byte(`{"name": "Triage", "mode": "workflow"}`))
+	case "Bearer legacy-key":
+		if r.URL.Path == "/v1/info" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"opening_statement": ""}`))
+	default:
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"code": "unauthorized", "message": "Access token is invalid", "status": 401}`))
+	}
+}
+
+// TestCheckHealth tests probing the configured apps
+func TestCheckHealth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(difyInfoMock))
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(difyInfoMock))
+	defer tlsServer.Close()
+	closed := httptest.NewServer(http.HandlerFunc(difyInfoMock))
+	closed.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	testCases := []struct {
+		name           string
+		jsonData       string
+		apiKey         string
+		expectedStatus backend.HealthStatus
+		expectedError  string
+		expectedMode   string
+	}{
+		{
+			name:           "chat app",
+			jsonData:       `{"apps": [{"name": "logs", "type": "chat", "apiUrl": "` + server.URL + `"}]}`,
+			apiKey:         "chat-key",
+			expectedStatus: backend.HealthStatusOk,
+			expectedMode:   "advanced-chat",
+		},
+		{
+			name:           "legacy Dify without /v1/info",
+			jsonData:       `{"apiUrl": "` + server.URL + `"}`,
+			apiKey:         "legacy-key",
+			expectedStatus: backend.HealthStatusOk,
+		},
+		{
+			name:           "revoked key",
+			jsonData:       `{"apiUrl": "` + server.URL + `"}`,
+			apiKey:         "revoked-key",
+			expectedStatus: backend.HealthStatusError,
+			expectedError:  healthErrorAuth,
+		},
+		{
+			name:           "wrong app type",
+			jsonData:       `{"apps": [{"name": "logs", "type": "chat", "apiUrl": "` + server.URL + `"}]}`,
+			apiKey:         "workflow-key",
+			expectedStatus: backend.HealthStatusError,
+			expectedError:  healthErrorAppType,
+			expectedMode:   "workflow",
+		},
+		{
+			name:           "unreachable host",
+			jsonData:       `{"apiUrl": "` + closed.URL + `"}`,
+			apiKey:         "chat-key",
+			expectedStatus: backend.HealthStatusError,
+			expectedError:  healthErrorUnreachable,
+		},
+		{
+			name:           "untrusted certificate",
+			jsonData:       `{"apiUrl": "` + tlsServer.URL + `"}`,
+			apiKey:         "chat-key",
+			expectedStatus: backend.HealthStatusError,
+			expectedError:  healthErrorTLS,
+		},
+		{
+			name:           "missing key",
+			jsonData:       `{"apiUrl": "` + server.URL + `"}`,
+			expectedStatus: backend.HealthStatusError,
+			expectedError:  healthErrorConfig,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := app.CheckHealth(context.Background(), &backend.CheckHealthRequest{
+				PluginContext: backend.PluginContext{
+					AppInstanceSettings: &backend.AppInstanceSettings{
+						JSONData:                []byte(tc.jsonData),
+						DecryptedSecureJSONData: map[string]string{"apiKey": tc.apiKey},
+					},
+				},
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if res.Status != tc.expectedStatus {
+				t.Fatalf("Expected status %v, got %v: %s", tc.expectedStatus, res.Status, res.Message)
+			}
+
+			var details struct {
+				Apps []appHealth `json:"apps"`
+			}
+			if err := json.Unmarshal(res.JSONDetails, &details); err != nil || len(details.Apps) != 1 {
+				t.Fatalf("Unexpected details %s: %v", res.JSONDetails, err)
+			}
+			got := details.Apps[0]
+			if got.Error != tc.expectedError || got.DifyMode != tc.expectedMode {
+				t.Errorf("Expected error %q and mode %q, got %+v", tc.expectedError, tc.expectedMode, got)
+			}
+			if strings.Contains(string(res.JSONDetails), tc.apiKey) && tc.apiKey != "" {
+				t.Errorf("Details must not contain the API key: %s", res.JSONDetails)
+			}
+		})
+	}
+}
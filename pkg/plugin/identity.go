@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// Strategies for deriving the Dify "user" field from the calling Grafana user.
+const (
+	userIdentityLogin = "login"
+	userIdentityEmail = "email"
+	userIdentityHash  = "hash"
+)
+
+// anonymousDifyUser is used when Grafana did not attach a user to the request,
+// for example when the call is initiated by Grafana itself.
+const anonymousDifyUser = "grafana-user"
+
+// getDifyUser derives the Dify end-user identifier for the Grafana user making
+// the request. The identifier is always prefixed with the org ID so that users
+// from different orgs can never share conversations.
+func getDifyUser(req *http.Request) (string, error) {
+	pluginConfig := backend.PluginConfigFromContext(req.Context())
+
+	settings, err := loadSettings(pluginConfig.AppInstanceSettings)
+	if err != nil {
+		return "", err
+	}
+	salt := ""
+	if pluginConfig.AppInstanceSettings != nil {
+		salt = pluginConfig.AppInstanceSettings.DecryptedSecureJSONData["userIdentitySalt"]
+	}
+
+	id, err := userIdentity(pluginConfig.User, settings.UserIdentity, salt)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("org%d:%s", pluginConfig.OrgID, id), nil
+}
+
+// userIdentity applies the configured strategy to a Grafana user.
+func userIdentity(user *backend.User, strategy, salt string) (string, error) {
+	if user == nil || (user.Login == "" && user.Email == "") {
+		return anonymousDifyUser, nil
+	}
+	login := user.Login
+	if login == "" {
+		login = user.Email
+	}
+
+	switch strategy {
+	case userIdentityLogin:
+		return login, nil
+	case userIdentityEmail:
+		if user.Email == "" {
+			return login, nil
+		}
+		return user.Email, nil
+	case userIdentityHash:
+		if salt == "" {
+			return "", &ConfigError{"userIdentitySalt is required for the hash user identity strategy"}
+		}
+		mac := hmac.New(sha256.New, []byte(salt))
+		mac.Write([]byte(login))
+		return hex.EncodeToString(mac.Sum(nil))[:32], nil
+	default:
+		return "", &ConfigError{"unknown userIdentity strategy: " + strategy}
+	}
+}
@@ -0,0 +1,110 @@
+package plugin
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestGetDifyUser tests how the Dify user is derived from the Grafana user
+func TestGetDifyUser(t *testing.T) {
+	testCases := []struct {
+		name        string
+		orgID       int64
+		user        *backend.User
+		jsonData    string
+		secure      map[string]string
+		expected    string
+		expectError bool
+	}{
+		{
+			name:     "default strategy uses login",
+			orgID:    1,
+			user:     &backend.User{Login: "alice", Email: "alice@example.com"},
+			jsonData: `{"apiUrl": "https://api.dify.ai"}`,
+			expected: "org1:alice",
+		},
+		{
+			name:     "email strategy",
+			orgID:    2,
+			user:     &backend.User{Login: "alice", Email: "alice@example.com"},
+			jsonData: `{"userIdentity": "email"}`,
+			expected: "org2:alice@example.com",
+		},
+		{
+			name:     "email strategy falls back to login",
+			orgID:    1,
+			user:     &backend.User{Login: "alice"},
+			jsonData: `{"userIdentity": "email"}`,
+			expected: "org1:alice",
+		},
+		{
+			name:     "hash strategy",
+			orgID:    1,
+			user:     &backend.User{Login: "alice"},
+			jsonData: `{"userIdentity": "hash"}`,
+			secure:   map[string]string{"userIdentitySalt": "pepper"},
+			expected: "org1:" + mustUserIdentity(t, "alice", "pepper"),
+		},
+		{
+			name:        "hash strategy without salt",
+			orgID:       1,
+			user:        &backend.User{Login: "alice"},
+			jsonData:    `{"userIdentity": "hash"}`,
+			expectError: true,
+		},
+		{
+			name:        "unknown strategy",
+			orgID:       1,
+			user:        &backend.User{Login: "alice"},
+			jsonData:    `{"userIdentity": "nickname"}`,
+			expectError: true,
+		},
+		{
+			name:     "no user on request",
+			orgID:    3,
+			jsonData: `{}`,
+			expected: "org3:grafana-user",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/difyGetConversations", nil)
+			req = req.WithContext(backend.WithPluginContext(req.Context(), backend.PluginContext{
+				OrgID: tc.orgID,
+				User:  tc.user,
+				AppInstanceSettings: &backend.AppInstanceSettings{
+					JSONData:                []byte(tc.jsonData),
+					DecryptedSecureJSONData: tc.secure,
+				},
+			}))
+
+			user, err := getDifyUser(req)
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("Expected error but got user %s", user)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if user != tc.expected {
+				t.Errorf("Expected user %s, got %s", tc.expected, user)
+			}
+		})
+	}
+}
+
+func mustUserIdentity(t *testing.T, login, salt string) string {
+	id, err := userIdentity(&backend.User{Login: login}, userIdentityHash, salt)
+	if err != nil {
+		t.Fatalf("userIdentity: %v", err)
+	}
+	if id == login {
+		t.Fatal("hashed identity must not equal the login")
+	}
+	return id
+}
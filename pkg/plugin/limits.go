@@ -0,0 +1,294 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueTimeout = 30 * time.Second
+
+	// maxIdleBuckets bounds the buckets kept before idle ones are dropped. A
+	// refilled bucket behaves exactly like a missing one.
+	maxIdleBuckets = 10000
+)
+
+// Reasons a request was limited, as reported in the rate_limited_total metric.
+const (
+	limitUser         = "user"
+	limitOrg          = "org"
+	limitQueueFull    = "queue_full"
+	limitQueueTimeout = "queue_timeout"
+)
+
+var (
+	errQueueFull    = errors.New("too many streams are waiting for Dify")
+	errQueueTimeout = errors.New("timed out waiting for a free Dify stream")
+)
+
+// sharedLimits holds the limiter state of all app instances, see App.
+var sharedLimits = newLimiter()
+
+// limitSettings throttles generation calls to Dify.
+type limitSettings struct {
+	// User and Org rate-limit generation requests per Grafana user and org.
+	User rateSettings `json:"user"`
+	Org  rateSettings `json:"org"`
+	// MaxConcurrentStreams caps the generations, streamed or blocking, the
+	// org runs at once across all its users. Zero means unlimited.
+	MaxConcurrentStreams int `json:"maxConcurrentStreams"`
+	// MaxQueuedStreams bounds the org's streams waiting for a free slot. Zero
+	// rejects streams right away when all slots are taken.
+	MaxQueuedStreams int `json:"maxQueuedStreams"`
+	// QueueTimeout bounds the wait for a free slot, in seconds.
+	QueueTimeout int `json:"queueTimeout"`
+}
+
+// rateSettings configures a token bucket. Zero requests per minute means
+// unlimited.
+type rateSettings struct {
+	RequestsPerMinute float64 `json:"requestsPerMinute"`
+	// Burst is the bucket size. It defaults to one minute's worth of
+	// requests.
+	Burst int `json:"burst"`
+}
+
+// perSecond returns the refill rate and bucket size.
+func (r rateSettings) perSecond() (rate, burst float64) {
+	rate = r.RequestsPerMinute / 60
+	burst = float64(r.Burst)
+	if burst <= 0 {
+		burst = math.Max(1, math.Ceil(r.RequestsPerMinute))
+	}
+	return rate, burst
+}
+
+// tokenBucket holds the tokens left at the time it was last updated.
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill adds the tokens earned since the last update.
+func (b *tokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+}
+
+// wait returns how long until the bucket holds a whole token.
+func (b *tokenBucket) wait(rate float64) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// limiter rate-limits requests and gates concurrent streams.
+type limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+
+	// streams holds the stream slots of each org with streams running or
+	// queued. Orgs configure their own caps, so they count their own
+	// streams.
+	streams map[int64]*streamSlots
+}
+
+// streamSlots counts the running and the queued streams of an org.
+// released is closed and replaced whenever a stream ends, waking the queue.
+type streamSlots struct {
+	running  int
+	waiting  int
+	released chan struct{}
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		buckets: map[string]*tokenBucket{},
+		now:     time.Now,
+		streams: map[int64]*streamSlots{},
+	}
+}
+
+// bucketLimit pairs a bucket with its configuration.
+type bucketLimit struct {
+	key    string
+	reason string
+	rate   rateSettings
+}
+
+// allow takes a token from every configured bucket, or from none if one of
+// them is empty. It then returns the reason and how long until it refills.
+func (l *limiter) allow(limits ...bucketLimit) (string, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var taken []*tokenBucket
+	for _, lim := range limits {
+		if lim.rate.RequestsPerMinute <= 0 {
+			continue
+		}
+		rate, burst := lim.rate.perSecond()
+		b := l.bucket(lim.key, now, burst)
+		b.refill(now, rate, burst)
+		if wait := b.wait(rate); wait > 0 {
+			return lim.reason, wait
+		}
+		taken = append(taken, b)
+	}
+	for _, b := range taken {
+		b.tokens--
+	}
+	return "", 0
+}
+
+// bucket returns the bucket for key, creating a full one. The caller holds
+// l.mu.
+func (l *limiter) bucket(key string, now time.Time, burst float64) *tokenBucket {
+	if b, ok := l.buckets[key]; ok {
+		return b
+	}
+	if len(l.buckets) >= maxIdleBuckets {
+		for k, b := range l.buckets {
+			// An hour refills any bucket allowing one request per hour or more.
+			if now.Sub(b.updated) > time.Hour {
+				delete(l.buckets, k)
+			}
+		}
+	}
+	b := &tokenBucket{tokens: burst, updated: now}
+	l.buckets[key] = b
+	return b
+}
+
+// acquireStream waits for one of the org's max stream slots, queueing
+// behind at most queue other streams of the org for up to timeout. The
+// returned func frees the slot.
+func (l *limiter) acquireStream(ctx context.Context, orgID int64, max, queue int, timeout time.Duration) (func(), error) {
+	l.mu.Lock()
+	s, ok := l.streams[orgID]
+	if !ok {
+		s = &streamSlots{released: make(chan struct{})}
+		l.streams[orgID] = s
+	}
+	release := func() { l.releaseStream(orgID, s) }
+	if max <= 0 || s.running < max {
+		s.running++
+		l.mu.Unlock()
+		return release, nil
+	}
+	if s.waiting >= queue {
+		l.mu.Unlock()
+		return nil, errQueueFull
+	}
+	s.waiting++
+	defer func() {
+		s.waiting--
+		l.dropIdle(orgID, s)
+		l.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for s.running >= max {
+		released := s.released
+		l.mu.Unlock()
+		select {
+		case <-released:
+		case <-timer.C:
+			l.mu.Lock()
+			return nil, errQueueTimeout
+		case <-ctx.Done():
+			l.mu.Lock()
+			return nil, ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	s.running++
+	return release, nil
+}
+
+func (l *limiter) releaseStream(orgID int64, s *streamSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.running--
+	close(s.released)
+	s.released = make(chan struct{})
+	l.dropIdle(orgID, s)
+}
+
+// dropIdle forgets the slots of an org once no stream runs or waits. The
+// caller holds l.mu.
+func (l *limiter) dropIdle(orgID int64, s *streamSlots) {
+	if s.running == 0 && s.waiting == 0 {
+		delete(l.streams, orgID)
+	}
+}
+
+// checkRate writes a 429 response with Retry-After and returns false if the
+// calling user or their org exceeded the request rate.
+func (a *App) checkRate(w http.ResponseWriter, req *http.Request, t *difyTarget) bool {
+	limits := t.settings.Limits
+	org := strconv.FormatInt(t.orgID, 10)
+	reason, wait := a.limits.allow(
+		bucketLimit{key: "user:" + org + ":" + t.user, reason: limitUser, rate: limits.User},
+		bucketLimit{key: "org:" + org, reason: limitOrg, rate: limits.Org},
+	)
+	if reason == "" {
+		return true
+	}
+	scope, rate := "your", limits.User
+	if reason == limitOrg {
+		scope, rate = "your organization's", limits.Org
+	}
+	observeRateLimited(req.Context(), reason)
+	t.auditDenied("rate limited: " + reason)
+	writeTooManyRequests(w, wait, "Rate limit exceeded: "+scope+" requests to Dify are limited to "+
+		strconv.FormatFloat(rate.RequestsPerMinute, 'g', -1, 64)+" per minute")
+	return false
+}
+
+// acquireStream waits for a free stream slot of the org. Blocking calls take one too,
+// as they hold a Dify generation just as long. It writes a 429 response and
+// returns false if none frees up in time; otherwise the caller must call
+// release once the generation ends.
+func (a *App) acquireStream(w http.ResponseWriter, req *http.Request, t *difyTarget) (release func(), ok bool) {
+	limits := t.settings.Limits
+	timeout := seconds(limits.QueueTimeout, defaultQueueTimeout)
+	release, err := a.limits.acquireStream(req.Context(), t.orgID, limits.MaxConcurrentStreams, limits.MaxQueuedStreams, timeout)
+	switch {
+	case err == nil:
+		return release, true
+	case errors.Is(err, errQueueFull):
+		observeRateLimited(req.Context(), limitQueueFull)
+	case errors.Is(err, errQueueTimeout):
+		observeRateLimited(req.Context(), limitQueueTimeout)
+	default:
+		// The client went away while waiting.
+		return nil, false
+	}
+	t.auditDenied("stream queue: " + err.Error())
+	writeTooManyRequests(w, time.Second, "Dify is busy: "+err.Error())
+	return nil, false
+}
+
+// writeTooManyRequests answers 429 with Retry-After.
+func writeTooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	writeRetryAfter(w, retryAfter)
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+// writeRetryAfter sets the Retry-After header, rounded up to whole seconds.
+func writeRetryAfter(w http.ResponseWriter, d time.Duration) {
+	secs := int(math.Ceil(d.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
@@ -0,0 +1,158 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestRateLimits tests the per-user and per-org token buckets
+func TestRateLimits(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"answer": "ok"}`))
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	app.limits = newLimiter()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	app.limits.now = func() time.Time { return now }
+
+	settings := &backend.AppInstanceSettings{
+		JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "limits": {"user": {"requestsPerMinute": 6, "burst": 2}, "org": {"requestsPerMinute": 3}}}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+	}
+	chat := func(login string) *backend.CallResourceResponse {
+		return callResource(t, app, asUser(login, roleViewer, settings), http.MethodPost, "difyChatProxy", `{"query": "hi", "response_mode": "blocking"}`)
+	}
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if resp := chat("alice"); resp.Status != expected {
+			t.Fatalf("alice call %d: expected status %d, got %d: %s", i+1, expected, resp.Status, resp.Body)
+		}
+	}
+	// alice's bucket refills one token every 10 seconds
+	resp := chat("alice")
+	if got := resp.Headers["Retry-After"]; len(got) != 1 || got[0] != "10" {
+		t.Errorf("Expected Retry-After 10, got %v", got)
+	}
+
+	// The org bucket holds 3 tokens, of which alice took 2
+	if resp := chat("bob"); resp.Status != http.StatusOK {
+		t.Fatalf("bob: expected status 200, got %d: %s", resp.Status, resp.Body)
+	}
+	resp = chat("bob")
+	if resp.Status != http.StatusTooManyRequests {
+		t.Fatalf("bob: expected the org limit to apply, got %d: %s", resp.Status, resp.Body)
+	}
+	if got := resp.Headers["Retry-After"]; len(got) != 1 || got[0] != "20" {
+		t.Errorf("Expected Retry-After 20, got %v", got)
+	}
+
+	now = now.Add(20 * time.Second)
+	if resp := chat("bob"); resp.Status != http.StatusOK {
+		t.Errorf("Expected the buckets to refill, got %d: %s", resp.Status, resp.Body)
+	}
+}
+
+// TestStreamQueue tests the concurrent stream cap of an org and its bounded
+// queue
+func TestStreamQueue(t *testing.T) {
+	l := newLimiter()
+	ctx := context.Background()
+
+	release, err := l.acquireStream(ctx, 1, 1, 1, time.Minute)
+	if err != nil {
+		t.Fatalf("first stream: %v", err)
+	}
+
+	queued := make(chan error, 1)
+	go func() {
+		release, err := l.acquireStream(ctx, 1, 1, 1, time.Minute)
+		if err == nil {
+			release()
+		}
+		queued <- err
+	}()
+	for {
+		l.mu.Lock()
+		waiting := l.streams[1].waiting
+		l.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := l.acquireStream(ctx, 1, 1, 1, time.Minute); !errors.Is(err, errQueueFull) {
+		t.Errorf("Expected the queue to be full, got %v", err)
+	}
+	other, err := l.acquireStream(ctx, 2, 1, 0, time.Minute)
+	if err != nil {
+		t.Errorf("Expected another org to have slots of its own, got %v", err)
+	} else {
+		other()
+	}
+	release()
+	if err := <-queued; err != nil {
+		t.Errorf("Expected the queued stream to run, got %v", err)
+	}
+
+	release, _ = l.acquireStream(ctx, 1, 1, 1, time.Minute)
+	if _, err := l.acquireStream(ctx, 1, 1, 1, 10*time.Millisecond); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("Expected the wait to time out, got %v", err)
+	}
+	if s := l.streams[1]; len(l.streams) != 1 || s.running != 1 || s.waiting != 0 {
+		t.Errorf("Unexpected limiter state %+v", l.streams)
+	}
+	release()
+	if len(l.streams) != 0 {
+		t.Errorf("Expected idle orgs to be forgotten, got %+v", l.streams)
+	}
+}
+
+// TestBlockingConcurrency tests that blocking calls count against the
+// concurrent stream cap
+func TestBlockingConcurrency(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"answer": "ok", "outputs": {}}`))
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	app.limits = newLimiter()
+
+	settings := &backend.AppInstanceSettings{
+		JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "limits": {"maxConcurrentStreams": 1, "queueTimeout": 1}}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+	}
+
+	release, err := app.limits.acquireStream(context.Background(), 1, 1, 0, time.Minute)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	for _, path := range []string{"difyChatProxy", "difyCompletionProxy", "difyWorkflowProxy"} {
+		if resp := callResource(t, app, asUser("alice", roleEditor, settings), http.MethodPost, path+"?response_mode=blocking", `{"query": "hi"}`); resp.Status != http.StatusTooManyRequests {
+			t.Errorf("%s: expected a blocking call to wait for the cap, got %d: %s", path, resp.Status, resp.Body)
+		}
+	}
+	release()
+	if resp := callResource(t, app, asUser("alice", roleEditor, settings), http.MethodPost, "difyChatProxy", `{"query": "hi", "response_mode": "blocking"}`); resp.Status != http.StatusOK {
+		t.Errorf("Expected a blocking call with a free slot to pass, got %d: %s", resp.Status, resp.Body)
+	}
+}
@@ -0,0 +1,108 @@
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// requestIDHeader carries the ID of a request, so that users can quote it
+// and its log lines can be told apart from those of concurrent requests. An
+// ID sent by the client is kept.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID bounds what a client may send as a request ID, so that it
+// cannot inject text into the logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// loggingSettings configures what the plugin logs about requests. By default
+// only the request ID, route, app, user, status and latency are logged.
+type loggingSettings struct {
+	// Payloads logs the queries and inputs sent to Dify at debug level,
+	// redacted with the redaction rules even if redaction is disabled.
+	Payloads bool `json:"payloads"`
+}
+
+// newRequestID returns the client's request ID, if valid, or a random one.
+func newRequestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loggerFrom returns a logger that adds the request ID, route and app of the
+// request being served to every line.
+func loggerFrom(ctx context.Context) log.Logger {
+	logger := log.DefaultLogger.FromContext(ctx)
+	info := requestInfoFrom(ctx)
+	if info.id == "" {
+		return logger
+	}
+	args := []interface{}{"request_id", info.id, "route", info.route}
+	if info.app != "" {
+		args = append(args, "app", info.app)
+	}
+	return logger.With(args...)
+}
+
+// logRequest logs a served request. It never logs the query string, headers
+// or body, which may hold prompts and customer data. The user is the Dify
+// user, so userIdentity settings that hash it apply to the logs too.
+func logRequest(req *http.Request, info *requestInfo, status int) {
+	user := info.user
+	if user == "" {
+		user, _ = getDifyUser(req)
+	}
+	args := []interface{}{
+		"method", req.Method,
+		"org_id", backend.PluginConfigFromContext(req.Context()).OrgID,
+		"user", user,
+		"status", status,
+		"duration", time.Since(info.start).Round(time.Millisecond),
+	}
+	logger := loggerFrom(req.Context())
+	if status >= http.StatusInternalServerError {
+		logger.Warn("Request failed", args...)
+		return
+	}
+	logger.Info("Request served", args...)
+}
+
+// logPayload logs the query and inputs sent to Dify at debug level, if
+// payload logging is enabled. They are logged redacted, even if they were
+// sent to Dify as they are.
+func (t *difyTarget) logPayload(ctx context.Context, query *string, inputs map[string]interface{}) {
+	if !t.settings.Logging.Payloads {
+		return
+	}
+	r, err := newRedactor(redactionSettings{
+		Enabled:   true,
+		Detectors: t.settings.Redaction.Detectors,
+		Rules:     t.settings.Redaction.Rules,
+	})
+	if err != nil {
+		return
+	}
+	// Redaction works in place, and inputs are still to be sent.
+	var copied interface{}
+	raw, _ := json.Marshal(inputs)
+	if err := json.Unmarshal(raw, &copied); err != nil {
+		return
+	}
+	var rep redactionReport
+	args := []interface{}{"endpoint", t.endpoint.Name, "inputs", r.redactValue(copied, "inputs", &rep, nil)}
+	if query != nil {
+		args = append(args, "query", r.redactString(*query, "query", &rep, nil))
+	}
+	loggerFrom(ctx).Debug("Sending payload to Dify", args...)
+}
@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// recordingLogger keeps every line logged through it.
+type recordingLogger struct {
+	mu    *sync.Mutex
+	lines *[]string
+	args  []interface{}
+}
+
+func newRecordingLogger() recordingLogger {
+	return recordingLogger{mu: &sync.Mutex{}, lines: &[]string{}}
+}
+
+func (l recordingLogger) record(level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*l.lines = append(*l.lines, fmt.Sprint(level, " ", msg, " ", append(append([]interface{}{}, l.args...), args...)))
+}
+
+func (l recordingLogger) Debug(msg string, args ...interface{}) { l.record("debug", msg, args) }
+func (l recordingLogger) Info(msg string, args ...interface{})  { l.record("info", msg, args) }
+func (l recordingLogger) Warn(msg string, args ...interface{})  { l.record("warn", msg, args) }
+func (l recordingLogger) Error(msg string, args ...interface{}) { l.record("error", msg, args) }
+func (l recordingLogger) With(args ...interface{}) log.Logger {
+	l.args = append(append([]interface{}{}, l.args...), args...)
+	return l
+}
+func (l recordingLogger) Level() log.Level                         { return log.Debug }
+func (l recordingLogger) FromContext(_ context.Context) log.Logger { return l }
+
+func (l recordingLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return strings.Join(*l.lines, "\n")
+}
+
+// TestRequestLogging tests that requests are logged with their ID but
+// without their payload, unless payload logging is enabled
+func TestRequestLogging(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": {"status": "succeeded"}}`))
+	}))
+	defer server.Close()
+
+	logger := newRecordingLogger()
+	defaultLogger := log.DefaultLogger
+	log.DefaultLogger = logger
+	defer func() { log.DefaultLogger = defaultLogger }()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	run := func(logging, requestID string) *backend.CallResourceResponse {
+		var r mockCallResourceResponseSender
+		err := app.CallResource(context.Background(), &backend.CallResourceRequest{
+			PluginContext: backend.PluginContext{
+				OrgID: 1,
+				User:  &backend.User{Login: "alice", Role: roleEditor},
+				AppInstanceSettings: &backend.AppInstanceSettings{
+					JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "logging": ` + logging + `}`),
+					DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+				},
+			},
+			Method:  http.MethodPost,
+			Path:    "difyWorkflowProxy?response_mode=blocking",
+			Headers: map[string][]string{http.CanonicalHeaderKey(requestIDHeader): {requestID}},
+			Body:    []byte(`{"logs": "login failed for bob@example.com"}`),
+		}, &r)
+		if err != nil || r.response.Status != http.StatusOK {
+			t.Fatalf("Unexpected response %+v: %v", r.response, err)
+		}
+		return r.response
+	}
+
+	resp := run(`{}`, "req-1")
+	if id := resp.Headers[http.CanonicalHeaderKey(requestIDHeader)]; len(id) != 1 || id[0] != "req-1" {
+		t.Errorf("Expected the client's request ID, got %v", id)
+	}
+	lines := logger.String()
+	if !strings.Contains(lines, "Request served") || !strings.Contains(lines, "req-1") || !strings.Contains(lines, "org1:alice") {
+		t.Errorf("Expected an access log line, got:\n%s", lines)
+	}
+	if strings.Contains(lines, "login failed") {
+		t.Errorf("Expected no payload in the logs, got:\n%s", lines)
+	}
+
+	resp = run(`{"payloads": true}`, "not a valid\nID")
+	if id := resp.Headers[http.CanonicalHeaderKey(requestIDHeader)]; len(id) != 1 || len(id[0]) != 16 {
+		t.Errorf("Expected a generated request ID, got %v", id)
+	}
+	lines = logger.String()
+	if !strings.Contains(lines, "login failed for [REDACTED:email]") || strings.Contains(lines, "bob@example.com") {
+		t.Errorf("Expected a redacted payload in the logs, got:\n%s", lines)
+	}
+}
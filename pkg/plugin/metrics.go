@@ -0,0 +1,325 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics are registered on the default registry, which the plugin SDK
+// serves to Grafana's metrics endpoint for the plugin. backend.Serve answers
+// metric collection from that registry itself and never asks the instance,
+// so App does not implement backend.CollectMetricsHandler.
+const metricsNamespace = "difychatflow"
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Resource requests by route, Dify app and response status.",
+	}, []string{"route", "app", "status"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_duration_seconds",
+		Help:      "Time until Dify answered with response headers.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"route", "app"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_errors_total",
+		Help:      "Failed Dify calls and error events by Dify error code.",
+	}, []string{"route", "app", "code"})
+
+	timeToFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "time_to_first_token_seconds",
+		Help:      "Time from the request until the first answer text was relayed.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60},
+	}, []string{"route", "app"})
+
+	streamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_duration_seconds",
+		Help:      "Duration of relayed Dify streams.",
+		Buckets:   []float64{1, 2.5, 5, 10, 30, 60, 120, 300, 600},
+	}, []string{"route", "app"})
+
+	streamBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_bytes_total",
+		Help:      "Bytes of Dify events relayed to clients.",
+	}, []string{"route", "app"})
+
+	activeStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_streams",
+		Help:      "Dify streams currently being relayed.",
+	}, []string{"route", "app"})
+
+	tokensTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tokens_total",
+		Help:      "Model tokens reported by Dify, by kind (prompt, completion or total).",
+	}, []string{"route", "app", "kind"})
+
+	costTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cost_total",
+		Help:      "Estimated model cost reported by Dify.",
+	}, []string{"route", "app", "currency"})
+
+	rateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_total",
+		Help:      "Requests rejected by a rate limit or the stream queue, by reason.",
+	}, []string{"route", "app", "reason"})
+
+	upstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_retries_total",
+		Help:      "Dify calls retried after a transient failure.",
+	}, []string{"route", "app"})
+
+	redactionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "redactions_total",
+		Help:      "Values redacted from requests before they were sent to Dify, by detector.",
+	}, []string{"route", "app", "detector"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, upstreamDuration, upstreamErrors, timeToFirstToken,
+		streamDuration, streamBytes, activeStreams, tokensTotal, costTotal, rateLimited, upstreamRetries, redactionsTotal)
+}
+
+// requestInfo describes the resource request being served. Handlers fill in
+// the app and user once they are resolved.
+type requestInfo struct {
+	id    string
+	route string
+	app   string
+	user  string
+	start time.Time
+	// audit is the audit event the request records, if any.
+	audit *auditEvent
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the request's info, or an empty one outside of
+// instrumented requests.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{start: time.Now()}
+}
+
+func (i *requestInfo) labels() prometheus.Labels {
+	return prometheus.Labels{"route": i.route, "app": i.app}
+}
+
+// statusRecorder captures the status written by a handler. It forwards
+// Flush so that streams keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument counts and traces the requests served by mux. The route label
+// is the matched pattern, so unknown paths cannot blow up the label set.
+func instrument(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, route := mux.Handler(req)
+		if route == "" {
+			route = "unmatched"
+		}
+		req, span := startRequestSpan(req, route)
+		info := &requestInfo{id: newRequestID(req), route: route, start: time.Now()}
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+		w.Header().Set(requestIDHeader, info.id)
+		startAudit(req, info)
+		rec := &statusRecorder{ResponseWriter: w}
+
+		mux.ServeHTTP(rec, req)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		requestsTotal.WithLabelValues(info.route, info.app, strconv.Itoa(rec.status)).Inc()
+		endRequestSpan(span, rec.status)
+		logRequest(req, info, rec.status)
+		recordAudit(req, info, rec.status)
+	})
+}
+
+// instrumentedTransport observes how long Dify takes to answer each call and
+// traces it.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, span := startUpstreamSpan(req)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	upstreamDuration.With(requestInfoFrom(req.Context()).labels()).Observe(time.Since(start).Seconds())
+	endUpstreamSpan(span, resp, err)
+	return resp, err
+}
+
+// CloseIdleConnections lets http.Client.CloseIdleConnections reach the
+// wrapped transport.
+func (t *instrumentedTransport) CloseIdleConnections() {
+	if c, ok := t.next.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// observeUpstreamError counts a failed Dify call by its error code.
+func observeUpstreamError(ctx context.Context, err error) {
+	code := "transport"
+	var apiErr *dify.APIError
+	var open *circuitOpenError
+	switch {
+	case errors.As(err, &open):
+		code = "circuit_open"
+	case errors.As(err, &apiErr) && apiErr.Code != "":
+		code = apiErr.Code
+	case errors.As(err, &apiErr):
+		code = "status_" + strconv.Itoa(apiErr.StatusCode)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errStreamStalled):
+		code = "timeout"
+	case errors.Is(err, context.Canceled):
+		code = "canceled"
+	}
+	info := requestInfoFrom(ctx)
+	upstreamErrors.WithLabelValues(info.route, info.app, code).Inc()
+}
+
+// observeRateLimited counts a request rejected by checkRate or acquireStream.
+func observeRateLimited(ctx context.Context, reason string) {
+	info := requestInfoFrom(ctx)
+	rateLimited.WithLabelValues(info.route, info.app, reason).Inc()
+}
+
+// observeRedactions counts the values a detector redacted from a request.
+func observeRedactions(ctx context.Context, detector string, n int) {
+	info := requestInfoFrom(ctx)
+	redactionsTotal.WithLabelValues(info.route, info.app, detector).Add(float64(n))
+}
+
+// observeUsage records the token usage and cost of a finished generation.
+func observeUsage(ctx context.Context, usage *dify.Usage) {
+	if usage == nil {
+		return
+	}
+	info := requestInfoFrom(ctx)
+	if usage.PromptTokens > 0 {
+		tokensTotal.WithLabelValues(info.route, info.app, "prompt").Add(float64(usage.PromptTokens))
+	}
+	if usage.CompletionTokens > 0 {
+		tokensTotal.WithLabelValues(info.route, info.app, "completion").Add(float64(usage.CompletionTokens))
+	}
+	if usage.TotalTokens > 0 {
+		tokensTotal.WithLabelValues(info.route, info.app, "total").Add(float64(usage.TotalTokens))
+	}
+	if price, err := strconv.ParseFloat(usage.TotalPrice, 64); err == nil && price > 0 {
+		costTotal.WithLabelValues(info.route, info.app, usage.Currency).Add(price)
+	}
+}
+
+// usageOf returns the usage reported in a blocking response.
+func usageOf(v interface{}) *dify.Usage {
+	switch r := v.(type) {
+	case *dify.ChatResponse:
+		return &r.Metadata.Usage
+	case *dify.CompletionResponse:
+		return &r.Metadata.Usage
+	case *dify.WorkflowRunResponse:
+		return &dify.Usage{TotalTokens: r.Data.TotalTokens}
+	}
+	return nil
+}
+
+// streamObserver records the metrics of one relayed stream.
+type streamObserver struct {
+	info      *requestInfo
+	ctx       context.Context
+	start     time.Time
+	sawAnswer bool
+}
+
+func newStreamObserver(req *http.Request) *streamObserver {
+	info := requestInfoFrom(req.Context())
+	activeStreams.With(info.labels()).Inc()
+	return &streamObserver{info: info, ctx: req.Context(), start: time.Now()}
+}
+
+// event records an event relayed to the client as n bytes.
+func (o *streamObserver) event(ev *dify.Event, n int) {
+	if o == nil {
+		return
+	}
+	labels := o.info.labels()
+	streamBytes.With(labels).Add(float64(n))
+	firstAnswer := !o.sawAnswer && carriesAnswer(ev)
+	if firstAnswer {
+		o.sawAnswer = true
+		timeToFirstToken.With(labels).Observe(time.Since(o.info.start).Seconds())
+	}
+	traceEvent(o.ctx, ev, firstAnswer)
+	if ev.Event == dify.EventError {
+		code := ev.Code
+		if code == "" {
+			code = "status_" + strconv.Itoa(ev.Status)
+		}
+		upstreamErrors.WithLabelValues(o.info.route, o.info.app, code).Inc()
+	}
+}
+
+// done records the end of the stream and the usage of its result.
+func (o *streamObserver) done(result *dify.Result) {
+	labels := o.info.labels()
+	activeStreams.With(labels).Dec()
+	streamDuration.With(labels).Observe(time.Since(o.start).Seconds())
+	observeUsage(o.ctx, result.Usage)
+}
+
+// carriesAnswer reports whether ev adds text to the answer.
+func carriesAnswer(ev *dify.Event) bool {
+	switch ev.Event {
+	case dify.EventMessage, dify.EventAgentMessage:
+		return ev.Answer != ""
+	case dify.EventTextChunk:
+		return ev.Data != nil && ev.Data.Text != ""
+	}
+	return false
+}
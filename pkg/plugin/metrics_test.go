@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/genproto/pluginv2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestMetrics tests that a relayed chat stream is counted per route and app
+func TestMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"event": "message", "task_id": "t1", "answer": "hello"}
+
+data: {"event": "message_end", "task_id": "t1", "metadata": {"usage": {"prompt_tokens": 3, "completion_tokens": 2, "total_tokens": 5, "total_price": "0.25", "currency": "USD"}}}
+
+`))
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	settings := &backend.AppInstanceSettings{
+		JSONData:                []byte(`{"apps": [{"name": "metrics", "type": "chat", "apiUrl": "` + server.URL + `"}]}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+	}
+
+	if resp := callResource(t, app, asUser("viewer", roleViewer, settings), http.MethodPost, "difyChatProxy", `{"query": "hi"}`); resp.Status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.Status)
+	}
+	if resp := callResource(t, app, asUser("viewer", roleViewer, settings), http.MethodPost, "difyChatProxy", `{}`); resp.Status != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d", resp.Status)
+	}
+
+	checks := []struct {
+		name     string
+		got      float64
+		expected float64
+	}{
+		{"successful requests", testutil.ToFloat64(requestsTotal.WithLabelValues("/difyChatProxy", "metrics", "200")), 1},
+		{"rejected requests", testutil.ToFloat64(requestsTotal.WithLabelValues("/difyChatProxy", "metrics", "400")), 1},
+		{"prompt tokens", testutil.ToFloat64(tokensTotal.WithLabelValues("/difyChatProxy", "metrics", "prompt")), 3},
+		{"total tokens", testutil.ToFloat64(tokensTotal.WithLabelValues("/difyChatProxy", "metrics", "total")), 5},
+		{"cost", testutil.ToFloat64(costTotal.WithLabelValues("/difyChatProxy", "metrics", "USD")), 0.25},
+		{"active streams", testutil.ToFloat64(activeStreams.WithLabelValues("/difyChatProxy", "metrics")), 0},
+	}
+	for _, c := range checks {
+		if c.got != c.expected {
+			t.Errorf("Expected %s to be %v, got %v", c.name, c.expected, c.got)
+		}
+	}
+	if got := testutil.ToFloat64(streamBytes.WithLabelValues("/difyChatProxy", "metrics")); got == 0 {
+		t.Error("Expected streamed bytes to be counted")
+	}
+
+	var ttft dto.Metric
+	if err := timeToFirstToken.WithLabelValues("/difyChatProxy", "metrics").(prometheus.Metric).Write(&ttft); err != nil {
+		t.Fatal(err)
+	}
+	if ttft.GetHistogram().GetSampleCount() != 1 {
+		t.Errorf("Expected one time to first token sample, got %d", ttft.GetHistogram().GetSampleCount())
+	}
+}
+
+// TestCollectMetrics tests that the metrics reach Grafana through the
+// SDK's diagnostics server, which serves the default registry
+func TestCollectMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"answer": "ok"}`))
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	settings := &backend.AppInstanceSettings{
+		JSONData:                []byte(`{"apps": [{"name": "scraped", "type": "chat", "apiUrl": "` + server.URL + `"}]}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+	}
+	if resp := callResource(t, app, asUser("viewer", roleViewer, settings), http.MethodPost, "difyChatProxy", `{"query": "hi", "response_mode": "blocking"}`); resp.Status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.Status, resp.Body)
+	}
+
+	opts, err := backend.GRPCServeOpts(backend.ServeOpts{CallResourceHandler: app, CheckHealthHandler: app})
+	if err != nil {
+		t.Fatalf("serve opts: %v", err)
+	}
+	resp, err := opts.DiagnosticsServer.CollectMetrics(context.Background(), &pluginv2.CollectMetricsRequest{})
+	if err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	scraped := string(resp.GetMetrics().GetPrometheus())
+	for _, series := range []string{
+		`difychatflow_requests_total{app="scraped",route="/difyChatProxy",status="200"} 1`,
+		`difychatflow_upstream_duration_seconds_count{app="scraped",route="/difyChatProxy"} 1`,
+	} {
+		if !strings.Contains(scraped, series) {
+			t.Errorf("Expected the scrape to contain %s", series)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+)
+
+const (
+	// conversationOwnershipTTL is how long a confirmed conversation is
+	// trusted before it is checked again with Dify.
+	conversationOwnershipTTL = 5 * time.Minute
+	// conversationDenialTTL is how long a conversation Dify did not find for
+	// a user is denied without asking again, so that repeated calls with an
+	// unknown conversation ID do not each cost an upstream request.
+	conversationDenialTTL = 30 * time.Second
+	// conversationOwnershipSize bounds the cached answers. Expired ones are
+	// dropped when it is reached, then the one expiring first.
+	conversationOwnershipSize = 10000
+)
+
+// conversationOwnership caches whether conversations belong to Dify users so
+// that the chat and history routes can reject foreign conversations. Answers
+// are kept per endpoint, as deployments hold different conversations.
+type conversationOwnership struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	answers map[string]ownershipAnswer
+}
+
+type ownershipAnswer struct {
+	owned   bool
+	expires time.Time
+}
+
+func newConversationOwnership(ttl time.Duration) *conversationOwnership {
+	return &conversationOwnership{
+		ttl:     ttl,
+		answers: map[string]ownershipAnswer{},
+	}
+}
+
+// owns reports whether conversationID belongs to user. Unknown
+// conversations are looked up with Dify, which only lists the messages of a
+// conversation to the user that holds it.
+func (o *conversationOwnership) owns(ctx context.Context, t *difyTarget, conversationID string) (bool, error) {
+	key := t.app.Name + "\x00" + t.endpoint.Name + "\x00" + t.user + "\x00" + conversationID
+	now := time.Now()
+
+	o.mu.Lock()
+	answer, ok := o.answers[key]
+	o.mu.Unlock()
+	if ok && now.Before(answer.expires) {
+		return answer.owned, nil
+	}
+
+	_, err := t.client.Messages(ctx, dify.MessagesParams{
+		User:           t.user,
+		ConversationID: conversationID,
+		Limit:          1,
+	})
+	var apiErr *dify.APIError
+	owned := err == nil
+	if err != nil && (!errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound) {
+		return false, err
+	}
+
+	ttl := o.ttl
+	if !owned {
+		ttl = conversationDenialTTL
+	}
+	o.remember(key, ownershipAnswer{owned: owned, expires: now.Add(ttl)}, now)
+	return owned, nil
+}
+
+// remember caches answer under key, making room first if the cache is full.
+func (o *conversationOwnership) remember(key string, answer ownershipAnswer, now time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, ok := o.answers[key]; !ok && len(o.answers) >= conversationOwnershipSize {
+		oldest := ""
+		for k, a := range o.answers {
+			if !now.Before(a.expires) {
+				delete(o.answers, k)
+			} else if oldest == "" || a.expires.Before(o.answers[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(o.answers) >= conversationOwnershipSize {
+			delete(o.answers, oldest)
+		}
+	}
+	o.answers[key] = answer
+}
+
+// checkConversationOwner writes an error response and returns false if
+// conversationID is set and does not belong to the calling user.
+func (a *App) checkConversationOwner(w http.ResponseWriter, req *http.Request, t *difyTarget, conversationID string) bool {
+	if conversationID == "" {
+		return true
+	}
+	ctx, cancel := t.callContext(req)
+	defer cancel()
+	owned, err := a.conversations.owns(ctx, t, conversationID)
+	if err != nil {
+		http.Error(w, "Failed to verify conversation ownership: "+err.Error(), http.StatusBadGateway)
+		return false
+	}
+	if !owned {
+		http.Error(w, "conversation does not belong to the current user", http.StatusForbidden)
+		return false
+	}
+	return true
+}
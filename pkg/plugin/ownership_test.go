@@ -0,0 +1,196 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// newOwnershipTestServer returns a mock Dify that owns c1 and c2 for
+// org1:alice and counts the message lookups in lookups.
+func newOwnershipTestServer(t *testing.T, lookups *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/messages":
+			atomic.AddInt32(lookups, 1)
+			w.Header().Set("Content-Type", "application/json")
+			q := r.URL.Query()
+			if q.Get("user") != "org1:alice" || (q.Get("conversation_id") != "c1" && q.Get("conversation_id") != "c2") {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"code": "not_found", "message": "Conversation Not Exists.", "status": 404}`))
+				return
+			}
+			w.Write([]byte(`{"data": []}`))
+		case "/v1/chat-messages":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"event\": \"message_end\"}\n\n"))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+}
+
+// TestConversationOwnership tests that foreign conversations are rejected
+func TestConversationOwnership(t *testing.T) {
+	var lookups int32
+	server := newOwnershipTestServer(t, &lookups)
+	defer server.Close()
+
+	jsonData := []byte(`{"apiUrl": "` + server.URL + `"}`)
+	secureJsonData := map[string]string{"apiKey": "test-api-key"}
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	testCases := []struct {
+		name           string
+		login          string
+		method         string
+		path           string
+		body           map[string]interface{}
+		expectedStatus int
+	}{
+		{
+			name:           "history of own conversation",
+			login:          "alice",
+			method:         http.MethodGet,
+			path:           "/difyMessageHistoryProxy?conversation_id=c1",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "history of another own conversation",
+			login:          "alice",
+			method:         http.MethodGet,
+			path:           "/difyMessageHistoryProxy?conversation_id=c2",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "history of foreign conversation",
+			login:          "bob",
+			method:         http.MethodGet,
+			path:           "/difyMessageHistoryProxy?conversation_id=c1",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "chat in own conversation",
+			login:          "alice",
+			method:         http.MethodPost,
+			path:           "/difyChatProxy",
+			body:           map[string]interface{}{"query": "hi", "conversation_id": "c2"},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "chat in foreign conversation",
+			login:          "bob",
+			method:         http.MethodPost,
+			path:           "/difyChatProxy",
+			body:           map[string]interface{}{"query": "hi", "conversation_id": "c2"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			name:           "chat starting a new conversation",
+			login:          "bob",
+			method:         http.MethodPost,
+			path:           "/difyChatProxy",
+			body:           map[string]interface{}{"query": "hi"},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body []byte
+			if tc.body != nil {
+				body, _ = json.Marshal(tc.body)
+			}
+			req := httptest.NewRequest(tc.method, tc.path, bytes.NewReader(body))
+			req = req.WithContext(backend.WithPluginContext(req.Context(), backend.PluginContext{
+				OrgID: 1,
+				User:  &backend.User{Login: tc.login},
+				AppInstanceSettings: &backend.AppInstanceSettings{
+					JSONData:                jsonData,
+					DecryptedSecureJSONData: secureJsonData,
+				},
+			}))
+			w := httptest.NewRecorder()
+
+			if tc.method == http.MethodPost {
+				app.handleDifyChatProxy(w, req)
+			} else {
+				app.handleDifyMessageHistoryProxy(w, req)
+			}
+
+			if w.Code != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestConversationOwnershipDenialCache tests that unknown conversations are
+// not looked up again on every call
+func TestConversationOwnershipDenialCache(t *testing.T) {
+	var lookups int32
+	server := newOwnershipTestServer(t, &lookups)
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/difyMessageHistoryProxy?conversation_id=unknown", nil)
+		req = req.WithContext(backend.WithPluginContext(req.Context(), backend.PluginContext{
+			OrgID: 1,
+			User:  &backend.User{Login: "alice"},
+			AppInstanceSettings: &backend.AppInstanceSettings{
+				JSONData:                []byte(`{"apiUrl": "` + server.URL + `"}`),
+				DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+			},
+		}))
+		w := httptest.NewRecorder()
+		app.handleDifyMessageHistoryProxy(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("Expected status %d, got %d: %s", http.StatusForbidden, w.Code, w.Body.String())
+		}
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Errorf("Expected one lookup for a denied conversation, got %d", n)
+	}
+}
+
+// TestConversationOwnershipBound tests that the cache stays bounded when
+// none of its answers has expired
+func TestConversationOwnershipBound(t *testing.T) {
+	o := newConversationOwnership(conversationOwnershipTTL)
+	now := time.Now()
+	for i := 0; i < conversationOwnershipSize; i++ {
+		o.remember(strconv.Itoa(i), ownershipAnswer{owned: true, expires: now.Add(time.Hour + time.Duration(i)*time.Second)}, now)
+	}
+	o.remember("0", ownershipAnswer{owned: true, expires: now.Add(time.Hour)}, now)
+	if len(o.answers) != conversationOwnershipSize {
+		t.Fatalf("Expected refreshing an answer not to evict, got %d answers", len(o.answers))
+	}
+
+	o.remember("new", ownershipAnswer{owned: true, expires: now.Add(time.Minute)}, now)
+	if len(o.answers) != conversationOwnershipSize {
+		t.Errorf("Expected the cache to stay at %d answers, got %d", conversationOwnershipSize, len(o.answers))
+	}
+	if _, ok := o.answers["0"]; ok {
+		t.Error("Expected the answer expiring first to be evicted")
+	}
+	if _, ok := o.answers["new"]; !ok {
+		t.Error("Expected the new answer to be cached")
+	}
+}
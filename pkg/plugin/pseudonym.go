@@ -0,0 +1,529 @@
+package plugin
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// pseudonymIdleTTL is how long the pseudonyms of a conversation are kept
+// after they were last used.
+const pseudonymIdleTTL = 7 * 24 * time.Hour
+
+// pseudonymsFileName is the name of the persisted pseudonyms in the plugin's
+// data directory.
+const pseudonymsFileName = "pseudonyms.db"
+
+// pseudonymsBucket holds the pseudonyms of each conversation under its
+// mappingKey: the time they were last used, in Unix seconds as 8 big-endian
+// bytes, followed by their snapshot sealed with the storage keys of the
+// conversation's org.
+var pseudonymsBucket = []byte("pseudonyms")
+
+// placeholderPattern matches anything that looks like a placeholder. Only
+// the placeholders of a mapping are replaced, so text that merely looks like
+// one, such as HTTP_2, is left alone.
+var placeholderPattern = regexp.MustCompile(`\b[A-Z][A-Z0-9_]*_[0-9]+\b`)
+
+// sharedPseudonyms holds the pseudonyms of all app instances, see App.
+var sharedPseudonyms = newPseudonymStore(pseudonymIdleTTL)
+
+// pseudonyms maps the sensitive values of a conversation to placeholders
+// such as IP_1 and back. A value keeps its placeholder for the life of the
+// conversation, so the model can refer to it across turns.
+type pseudonyms struct {
+	mu            sync.Mutex
+	byValue       map[string]string
+	byPlaceholder map[string]string
+	counts        map[string]int
+	// longest is the length of the longest placeholder, see pending.
+	longest int
+}
+
+func newPseudonyms() *pseudonyms {
+	return &pseudonyms{
+		byValue:       map[string]string{},
+		byPlaceholder: map[string]string{},
+		counts:        map[string]int{},
+	}
+}
+
+// placeholder returns the placeholder of value, numbering a new one after
+// the last placeholder with the same prefix.
+func (p *pseudonyms) placeholder(prefix, value string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ph, ok := p.byValue[value]; ok {
+		return ph
+	}
+	p.counts[prefix]++
+	ph := prefix + "_" + strconv.Itoa(p.counts[prefix])
+	p.byValue[value] = ph
+	p.byPlaceholder[ph] = value
+	if len(ph) > p.longest {
+		p.longest = len(ph)
+	}
+	return ph
+}
+
+// pseudonymSnapshot is the persisted form of pseudonyms.
+type pseudonymSnapshot struct {
+	// Values maps placeholders to their values.
+	Values map[string]string `json:"values"`
+	Counts map[string]int    `json:"counts"`
+}
+
+func (p *pseudonyms) snapshot() pseudonymSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := pseudonymSnapshot{Values: map[string]string{}, Counts: map[string]int{}}
+	for ph, value := range p.byPlaceholder {
+		s.Values[ph] = value
+	}
+	for prefix, n := range p.counts {
+		s.Counts[prefix] = n
+	}
+	return s
+}
+
+func restorePseudonyms(s pseudonymSnapshot) *pseudonyms {
+	p := newPseudonyms()
+	for ph, value := range s.Values {
+		p.byPlaceholder[ph] = value
+		p.byValue[value] = ph
+		if len(ph) > p.longest {
+			p.longest = len(ph)
+		}
+	}
+	for prefix, n := range s.Counts {
+		p.counts[prefix] = n
+	}
+	return p
+}
+
+// rehydrate replaces the placeholders in s with their values.
+func (p *pseudonyms) rehydrate(s string) string {
+	if !placeholderPattern.MatchString(s) {
+		return s
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return placeholderPattern.ReplaceAllStringFunc(s, func(ph string) string {
+		if value, ok := p.byPlaceholder[ph]; ok {
+			return value
+		}
+		return ph
+	})
+}
+
+// rehydrateValue rehydrates the strings within a decoded JSON value in
+// place. Object keys are kept.
+func (p *pseudonyms) rehydrateValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return p.rehydrate(v)
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = p.rehydrateValue(v[k])
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = p.rehydrateValue(v[i])
+		}
+		return v
+	}
+	return v
+}
+
+// pending returns the length of the tail of s that may be the start of a
+// placeholder completed by the next chunk of a stream, such as "IP_" or
+// "IP_1" when IP_12 exists.
+func (p *pseudonyms) pending(s string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := len(s) - p.longest
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < len(s); i++ {
+		if i > 0 && isWordByte(s[i-1]) {
+			continue
+		}
+		tail := s[i:]
+		for ph := range p.byPlaceholder {
+			if strings.HasPrefix(ph, tail) {
+				return len(tail)
+			}
+		}
+	}
+	return 0
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// pseudonymStore keeps the pseudonyms of each conversation until they were
+// unused for ttl.
+type pseudonymStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]*storedPseudonyms
+	// db keeps the pseudonyms across restarts, so that placeholders in the
+	// history of a conversation keep their values. It is nil for a store
+	// kept in memory. Pseudonyms are only written sealed, so those of orgs
+	// without a storage key stay in memory.
+	db        *bolt.DB
+	lastPrune time.Time
+}
+
+type storedPseudonyms struct {
+	p    *pseudonyms
+	used time.Time
+}
+
+func newPseudonymStore(ttl time.Duration) *pseudonymStore {
+	return &pseudonymStore{ttl: ttl, now: time.Now, entries: map[string]*storedPseudonyms{}}
+}
+
+// persist keeps the pseudonyms of the store at path from now on and drops
+// those past the ttl.
+func (s *pseudonymStore) persist(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(pseudonymsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.db = db
+	s.prune(s.now())
+	return nil
+}
+
+// lookup returns the pseudonyms stored under key, or nil if there are none:
+// the conversation never had any, or they expired or cannot be opened with
+// keys.
+func (s *pseudonymStore) lookup(key string, keys *keyring) *pseudonyms {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if e, ok := s.entries[key]; ok {
+		if now.Sub(e.used) > s.ttl {
+			// The persisted copy was written no later than e was last used.
+			delete(s.entries, key)
+			return nil
+		}
+		e.used = now
+		return e.p
+	}
+	if s.db == nil || keys == nil {
+		return nil
+	}
+	var snapshot pseudonymSnapshot
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(pseudonymsBucket).Get([]byte(key))
+		if len(v) < 8 || now.Sub(time.Unix(int64(binary.BigEndian.Uint64(v)), 0)) > s.ttl {
+			return nil
+		}
+		plain, err := keys.open(v[8:])
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(plain, &snapshot)
+	})
+	if err != nil {
+		log.DefaultLogger.Error("Failed to read stored pseudonyms", "error", err)
+		return nil
+	}
+	if snapshot.Values == nil {
+		return nil
+	}
+	p := restorePseudonyms(snapshot)
+	s.entries[key] = &storedPseudonyms{p: p, used: now}
+	return p
+}
+
+// put stores p under key, sealed with keys if the store is persisted.
+func (s *pseudonymStore) put(key string, p *pseudonyms, keys *keyring) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	if e, ok := s.entries[key]; ok && e.p == p {
+		e.used = now
+	} else {
+		s.prune(now)
+		s.entries[key] = &storedPseudonyms{p: p, used: now}
+	}
+	if s.db == nil || keys == nil {
+		return
+	}
+	plain, err := json.Marshal(p.snapshot())
+	if err != nil {
+		return
+	}
+	sealed, err := keys.seal(plain)
+	if err != nil {
+		log.DefaultLogger.Error("Failed to seal pseudonyms", "error", err)
+		return
+	}
+	v := binary.BigEndian.AppendUint64(nil, uint64(now.Unix()))
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pseudonymsBucket).Put([]byte(key), append(v, sealed...))
+	})
+	if err != nil {
+		log.DefaultLogger.Error("Failed to persist pseudonyms", "error", err)
+	}
+}
+
+// prune drops the pseudonyms unused for the ttl, those persisted at most
+// hourly. The caller holds s.mu.
+func (s *pseudonymStore) prune(now time.Time) {
+	for key, e := range s.entries {
+		if now.Sub(e.used) > s.ttl {
+			delete(s.entries, key)
+		}
+	}
+	if s.db == nil || now.Sub(s.lastPrune) < time.Hour {
+		return
+	}
+	s.lastPrune = now
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(pseudonymsBucket)
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if len(v) < 8 || now.Sub(time.Unix(int64(binary.BigEndian.Uint64(v)), 0)) > s.ttl {
+				expired = append(expired, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.DefaultLogger.Error("Failed to prune persisted pseudonyms", "error", err)
+	}
+}
+
+// pseudonymPersistence makes sure the shared pseudonyms are persisted once.
+var pseudonymPersistence sync.Once
+
+// persistSharedPseudonyms persists sharedPseudonyms in the data directory.
+// Without one, pseudonymized conversations cannot be continued after the
+// plugin restarts, which is logged loudly.
+func persistSharedPseudonyms() {
+	pseudonymPersistence.Do(func() {
+		dir, err := dataDir()
+		if err == nil {
+			err = sharedPseudonyms.persist(filepath.Join(dir, pseudonymsFileName))
+		}
+		if err != nil {
+			log.DefaultLogger.Error("Pseudonyms are kept in memory and lost when the plugin restarts", "error", err)
+		}
+	})
+}
+
+// mappingKey identifies the pseudonyms of a conversation of the user.
+func (t *difyTarget) mappingKey(conversationID string) string {
+	return strconv.FormatInt(t.orgID, 10) + "/" + t.app.Name + "/" + t.user + "/" + conversationID
+}
+
+// bindConversation stores the pseudonyms of a request that started a
+// conversation under its ID, once Dify assigned one, and records the ID in
+// the audit event.
+func (t *difyTarget) bindConversation(conversationID string) {
+	if conversationID == "" {
+		return
+	}
+	if t.audit != nil && t.audit.ConversationID == "" {
+		t.audit.ConversationID = conversationID
+	}
+	if t.pseudonyms != nil {
+		t.mappings.put(t.mappingKey(conversationID), t.pseudonyms, t.keys)
+	}
+}
+
+// conversationPseudonyms returns the stored pseudonyms of a conversation of
+// the user, or nil if there are none or redaction does not pseudonymize.
+func (t *difyTarget) conversationPseudonyms(conversationID string) *pseudonyms {
+	if t.redactor == nil || !t.redactor.pseudonymize || conversationID == "" {
+		return nil
+	}
+	return t.mappings.lookup(t.mappingKey(conversationID), t.keys)
+}
+
+// rehydrateJSON returns v with the placeholders of the request replaced by
+// their values, going through its JSON form.
+func (t *difyTarget) rehydrateJSON(v interface{}) interface{} {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return v
+	}
+	return t.pseudonyms.rehydrateValue(decoded)
+}
+
+// rehydrateConversations replaces the placeholders in the names and inputs
+// of the listed conversations.
+func (t *difyTarget) rehydrateConversations(list *dify.ConversationList) {
+	for i := range list.Data {
+		c := &list.Data[i]
+		if p := t.conversationPseudonyms(c.ID); p != nil {
+			c.Name = p.rehydrate(c.Name)
+			p.rehydrateValue(c.Inputs)
+		}
+	}
+}
+
+// rehydrateMessages replaces the placeholders in the history of a
+// conversation.
+func (t *difyTarget) rehydrateMessages(conversationID string, list *dify.MessageList) {
+	p := t.conversationPseudonyms(conversationID)
+	if p == nil {
+		return
+	}
+	for i := range list.Data {
+		m := &list.Data[i]
+		m.Query = p.rehydrate(m.Query)
+		m.Answer = p.rehydrate(m.Answer)
+		p.rehydrateValue(m.Inputs)
+	}
+}
+
+// rehydrator returns the stream rewrite that replaces the placeholders of
+// the request in the events relayed to the client, or nil if there are no
+// pseudonyms. It also binds a new conversation to its pseudonyms.
+func (t *difyTarget) rehydrator() func(*dify.Event) []*dify.Event {
+	if t.pseudonyms == nil {
+		return nil
+	}
+	r := &rehydrator{p: t.pseudonyms}
+	bound := false
+	return func(ev *dify.Event) []*dify.Event {
+		if ev != nil && ev.ConversationID != "" && !bound {
+			t.bindConversation(ev.ConversationID)
+			bound = true
+		}
+		return r.rewrite(ev)
+	}
+}
+
+// rehydrator rehydrates a stream. Answer text arrives in chunks that may
+// split a placeholder, so the tail of a chunk that may be one is held back
+// until the next chunk, or the next event of another kind, completes it.
+type rehydrator struct {
+	p *pseudonyms
+	// held is the text held back from heldEvent.
+	held      string
+	heldEvent *dify.Event
+}
+
+func (r *rehydrator) rewrite(ev *dify.Event) []*dify.Event {
+	if ev == nil {
+		return r.flush()
+	}
+	text, ok := streamedText(ev)
+	if !ok || text == "" && r.held == "" {
+		return append(r.flush(), r.rehydrateEvent(ev, nil))
+	}
+	var out []*dify.Event
+	if r.heldEvent != nil && r.heldEvent.Event != ev.Event {
+		out = r.flush()
+	}
+	text = r.held + text
+	cut := len(text) - r.p.pending(text)
+	r.held, r.heldEvent = text[cut:], ev
+	if cut == 0 {
+		return out
+	}
+	head := text[:cut]
+	return append(out, r.rehydrateEvent(ev, &head))
+}
+
+// flush relays the held back text as an event of its own.
+func (r *rehydrator) flush() []*dify.Event {
+	if r.held == "" {
+		return nil
+	}
+	held := r.held
+	ev := r.rehydrateEvent(r.heldEvent, &held)
+	r.held, r.heldEvent = "", nil
+	return []*dify.Event{ev}
+}
+
+// rehydrateEvent returns ev with its placeholders replaced and, if text is
+// set, its streamed text replaced by text first.
+func (r *rehydrator) rehydrateEvent(ev *dify.Event, text *string) *dify.Event {
+	if len(ev.Raw) == 0 || text == nil && !placeholderPattern.Match(ev.Raw) {
+		return ev
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(ev.Raw, &v); err != nil {
+		return ev
+	}
+	if text != nil {
+		if data, ok := v["data"].(map[string]interface{}); ok && ev.Event == dify.EventTextChunk {
+			data["text"] = *text
+		} else {
+			v["answer"] = *text
+		}
+	}
+	raw, err := json.Marshal(r.p.rehydrateValue(v))
+	if err != nil {
+		return ev
+	}
+	out := &dify.Event{}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return ev
+	}
+	if out.Event == "" {
+		out.Event = ev.Event
+	}
+	out.Raw = raw
+	return out
+}
+
+// streamedText returns the text chunk carried by a streamed answer event.
+func streamedText(ev *dify.Event) (string, bool) {
+	switch ev.Event {
+	case dify.EventMessage, dify.EventAgentMessage:
+		return ev.Answer, true
+	case dify.EventTextChunk:
+		if ev.Data != nil {
+			return ev.Data.Text, true
+		}
+	}
+	return "", false
+}
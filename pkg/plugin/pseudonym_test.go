@@ -0,0 +1,191 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestRehydrateStream tests that placeholders split across stream chunks
+// are rehydrated
+func TestRehydrateStream(t *testing.T) {
+	p := newPseudonyms()
+	p.placeholder("IP", "10.0.0.1")
+	for i := 0; i < 11; i++ {
+		p.placeholder("IP", "10.0.1."+string(rune('a'+i)))
+	}
+	r := &rehydrator{p: p}
+
+	stream := "data: {\"event\": \"message\", \"answer\": \"Host IP\"}\n\n" +
+		"data: {\"event\": \"message\", \"answer\": \"_1 and IP_1\"}\n\n" +
+		"data: {\"event\": \"message\", \"answer\": \"2 are down, HTTP_2 is fine\"}\n\n" +
+		"data: {\"event\": \"message\", \"answer\": \" (IP_1\"}\n\n" +
+		"data: {\"event\": \"message_end\"}\n\n" +
+		"data: {\"event\": \"message\", \"answer\": \"IP_\"}\n\n"
+	decoder := dify.NewDecoder(strings.NewReader(stream))
+	var result dify.Result
+	var events []string
+	relay := func(out []*dify.Event) {
+		for _, ev := range out {
+			result.Add(ev)
+			events = append(events, ev.Event)
+		}
+	}
+	for {
+		ev, err := decoder.Next()
+		if err == io.EOF {
+			break
+		}
+		relay(r.rewrite(ev))
+	}
+	relay(r.rewrite(nil))
+
+	if expected := "Host 10.0.0.1 and 10.0.1.k are down, HTTP_2 is fine (10.0.0.1IP_"; result.Answer != expected {
+		t.Errorf("Expected answer %q, got %q", expected, result.Answer)
+	}
+	// Text held back at message_end is relayed before it
+	if n := len(events); n < 3 || events[n-3] != dify.EventMessage || events[n-2] != dify.EventMessageEnd {
+		t.Errorf("Unexpected events %v", events)
+	}
+}
+
+// TestPseudonymStore tests that pseudonyms are kept per conversation and
+// user
+func TestPseudonymStore(t *testing.T) {
+	store := newPseudonymStore(pseudonymIdleTTL)
+	redactor, _ := newRedactor(redactionSettings{Enabled: true, Mode: redactModePseudonymize})
+	alice := &difyTarget{app: &difyApp{Name: "logs"}, orgID: 1, user: "org1:alice", mappings: store, redactor: redactor}
+	bob := &difyTarget{app: &difyApp{Name: "logs"}, orgID: 1, user: "org1:bob", mappings: store, redactor: redactor}
+
+	alice.pseudonyms = newPseudonyms()
+	alice.pseudonyms.placeholder("EMAIL", "alice@example.com")
+	alice.bindConversation("c1")
+	if alice.conversationPseudonyms("c1") != alice.pseudonyms {
+		t.Errorf("Expected the pseudonyms to be bound to the conversation")
+	}
+	if bob.conversationPseudonyms("c1") != nil {
+		t.Errorf("Expected no pseudonyms for another user's conversation")
+	}
+
+	now := time.Now().Add(pseudonymIdleTTL + time.Second)
+	store.now = func() time.Time { return now }
+	if alice.conversationPseudonyms("c1") != nil {
+		t.Errorf("Expected the pseudonyms to expire once unused for the TTL")
+	}
+	if len(store.entries) != 0 {
+		t.Errorf("Expected expired pseudonyms to be dropped, got %d", len(store.entries))
+	}
+}
+
+// TestPseudonymPersistence tests that pseudonyms survive a restart sealed
+// with the storage key, and that a conversation without them is refused
+func TestPseudonymPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pseudonyms.db")
+	keys, _ := newTestKeyring("pseudonym test storage key", "")
+	redactor, _ := newRedactor(redactionSettings{Enabled: true, Mode: redactModePseudonymize})
+	target := func(store *pseudonymStore) *difyTarget {
+		return &difyTarget{app: &difyApp{Name: "logs"}, orgID: 1, user: "org1:alice", mappings: store, redactor: redactor, keys: keys}
+	}
+
+	store := newPseudonymStore(pseudonymIdleTTL)
+	if err := store.persist(path); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	alice := target(store)
+	alice.pseudonyms = newPseudonyms()
+	alice.pseudonyms.placeholder("IP", "10.1.2.3")
+	alice.bindConversation("c1")
+	store.db.Close()
+
+	data, _ := os.ReadFile(path)
+	if bytes.Contains(data, []byte("10.1.2.3")) {
+		t.Errorf("Expected pseudonyms to be encrypted at rest")
+	}
+
+	restarted := newPseudonymStore(pseudonymIdleTTL)
+	if err := restarted.persist(path); err != nil {
+		t.Fatalf("persist after restart: %v", err)
+	}
+	defer restarted.db.Close()
+	alice = target(restarted)
+	w := httptest.NewRecorder()
+	query := "is 10.9.9.9 like 10.1.2.3?"
+	if !alice.redactRequest(context.Background(), w, "c1", &query, map[string]interface{}{}) || query != "is IP_2 like IP_1?" {
+		t.Errorf("Expected the restored placeholders to be continued, got %q", query)
+	}
+
+	w = httptest.NewRecorder()
+	if alice.redactRequest(context.Background(), w, "lost", &query, map[string]interface{}{}) || w.Code != http.StatusConflict {
+		t.Errorf("Expected a conversation without pseudonyms to be refused, got %d", w.Code)
+	}
+}
+
+// TestPseudonymizeChat tests that Dify receives placeholders that stay
+// stable within a conversation while the client sees the real values
+func TestPseudonymizeChat(t *testing.T) {
+	queries := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/conversations":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"has_more": false, "data": [{"id": "c1", "name": "About EMAIL_1"}]}`))
+		case "/v1/messages":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"data": []}`))
+		case "/v1/chat-messages":
+			var body struct {
+				Query string `json:"query"`
+			}
+			raw, _ := io.ReadAll(r.Body)
+			json.Unmarshal(raw, &body)
+			queries <- body.Query
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"event\": \"message\", \"conversation_id\": \"c1\", \"answer\": \"Mail EMA\"}\n\n" +
+				"data: {\"event\": \"message\", \"conversation_id\": \"c1\", \"answer\": \"IL_1 from IP_1\"}\n\n" +
+				"data: {\"event\": \"message_end\", \"conversation_id\": \"c1\"}\n\n"))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	app.mappings = newPseudonymStore(pseudonymIdleTTL)
+
+	pluginContext := asUser("alice", roleViewer, &backend.AppInstanceSettings{
+		JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "redaction": {"enabled": true, "mode": "pseudonymize"}}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+	})
+
+	answer := callResource(t, app, pluginContext, http.MethodPost, "difyChatProxy", `{"query": "mail bob@example.com from 10.1.2.3"}`)
+	if q := <-queries; q != "mail EMAIL_1 from IP_1" {
+		t.Errorf("Unexpected query %q", q)
+	}
+	if body := string(answer.Body); answer.Status != http.StatusOK || !strings.Contains(body, "bob@example.com") || !strings.Contains(body, "10.1.2.3") || strings.Contains(body, "_1") {
+		t.Errorf("Expected a rehydrated answer, got %d: %s", answer.Status, body)
+	}
+
+	callResource(t, app, pluginContext, http.MethodPost, "difyChatProxy", `{"query": "and 10.9.9.9 or 10.1.2.3?", "conversation_id": "c1"}`)
+	if q := <-queries; q != "and IP_2 or IP_1?" {
+		t.Errorf("Expected stable placeholders, got %q", q)
+	}
+
+	if list := callResource(t, app, pluginContext, http.MethodGet, "difyGetConversations", ""); !strings.Contains(string(list.Body), "About bob@example.com") {
+		t.Errorf("Expected a rehydrated conversation name, got %s", list.Body)
+	}
+}
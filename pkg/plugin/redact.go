@@ -0,0 +1,273 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// redactionReportHeader carries the redaction report of a request, so the
+// frontend can tell users what did not reach Dify.
+const redactionReportHeader = "X-Redaction-Report"
+
+// Redaction modes.
+const (
+	// redactModeRedact replaces sensitive values with [REDACTED:<name>].
+	redactModeRedact = "redact"
+	// redactModePseudonymize replaces them with placeholders such as IP_1
+	// that stay stable within a conversation and are turned back into the
+	// real values in answers, see pseudonyms.
+	redactModePseudonymize = "pseudonymize"
+)
+
+// placeholderPrefix is what a placeholder prefix must look like.
+var placeholderPrefix = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+// redactionSettings configures what is removed from chat queries and
+// generation inputs before they are sent to Dify.
+type redactionSettings struct {
+	Enabled bool `json:"enabled"`
+	// Mode is redactModeRedact, the default, or redactModePseudonymize.
+	Mode string `json:"mode"`
+	// Detectors selects built-in detectors by name. Empty enables all.
+	Detectors []string `json:"detectors"`
+	// Rules add custom patterns, such as customer ID formats. They run
+	// before the built-in detectors.
+	Rules []redactionRule `json:"rules"`
+}
+
+// redactionRule is a custom redaction pattern.
+type redactionRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	// Replacement defaults to [REDACTED:<name>].
+	Replacement string `json:"replacement"`
+	// Placeholder is the prefix of pseudonyms, such as USER for USER_1. It
+	// defaults to the upper-cased name.
+	Placeholder string `json:"placeholder"`
+}
+
+// detector finds one kind of sensitive value.
+type detector struct {
+	name        string
+	re          *regexp.Regexp
+	replacement string
+	placeholder string
+	// valid, if set, confirms a match, to cut false positives.
+	valid func(string) bool
+}
+
+// builtinDetectors are the detectors available by name.
+var builtinDetectors = []detector{
+	{name: "email", placeholder: "EMAIL", re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{name: "jwt", placeholder: "TOKEN", re: regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`)},
+	{name: "bearer_token", placeholder: "TOKEN", re: regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]{8,}`)},
+	{name: "api_key", placeholder: "SECRET", re: regexp.MustCompile(`\b(?:sk-[A-Za-z0-9_-]{16,}|app-[A-Za-z0-9]{16,}|gh[pousr]_[A-Za-z0-9]{20,}|glpat-[A-Za-z0-9_-]{20,}|xox[abpr]-[A-Za-z0-9-]{10,}|AKIA[0-9A-Z]{16})\b`)},
+	{name: "credit_card", placeholder: "CARD", re: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), valid: luhn},
+	{name: "ipv4", placeholder: "IP", re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`)},
+	{name: "ipv6", placeholder: "IP", re: regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}\b|\b(?:[0-9a-f]{1,4}:){1,6}:(?:[0-9a-f]{1,4}(?::[0-9a-f]{1,4}){0,5}\b)?|::[0-9a-f]{1,4}(?::[0-9a-f]{1,4}){0,6}\b`), valid: ipv6},
+}
+
+// ipv6 reports whether s is an IPv6 address. Text of the same alphabet is
+// common, such as clock times, MAC addresses and "Type::add" scopes, so
+// besides parsing, an address needs two groups, one of them longer than two
+// characters.
+func ipv6(s string) bool {
+	if net.ParseIP(s) == nil {
+		return false
+	}
+	groups, long := 0, false
+	for _, g := range strings.Split(s, ":") {
+		if g != "" {
+			groups++
+			long = long || len(g) > 2
+		}
+	}
+	return groups >= 2 && long
+}
+
+// luhn reports whether the digits of s pass the Luhn checksum of payment
+// card numbers.
+func luhn(s string) bool {
+	sum, n := 0, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if n%2 == 1 {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		n++
+	}
+	return n >= 13 && sum%10 == 0
+}
+
+// redactor applies the configured detectors in order.
+type redactor struct {
+	detectors []detector
+	// pseudonymize replaces values with placeholders instead of redacting
+	// them.
+	pseudonymize bool
+}
+
+// newRedactor compiles the redaction settings. It returns nil if redaction
+// is disabled.
+func newRedactor(s redactionSettings) (*redactor, error) {
+	if !s.Enabled {
+		return nil, nil
+	}
+	switch s.Mode {
+	case "", redactModeRedact, redactModePseudonymize:
+	default:
+		return nil, &ConfigError{"unknown redaction mode: " + s.Mode}
+	}
+	r := &redactor{pseudonymize: s.Mode == redactModePseudonymize}
+	for _, rule := range s.Rules {
+		if rule.Name == "" {
+			return nil, &ConfigError{"every redaction rule needs a name"}
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil || rule.Pattern == "" {
+			return nil, &ConfigError{"redaction rule " + rule.Name + " has an invalid pattern"}
+		}
+		placeholder := rule.Placeholder
+		if placeholder == "" {
+			placeholder = strings.ToUpper(rule.Name)
+		}
+		if !placeholderPrefix.MatchString(placeholder) {
+			return nil, &ConfigError{"redaction rule " + rule.Name + " has an invalid placeholder: " + placeholder}
+		}
+		r.detectors = append(r.detectors, detector{name: rule.Name, re: re, replacement: rule.Replacement, placeholder: placeholder})
+	}
+	if len(s.Detectors) == 0 {
+		r.detectors = append(r.detectors, builtinDetectors...)
+	}
+	for _, name := range s.Detectors {
+		found := false
+		for _, d := range builtinDetectors {
+			if d.name == name {
+				r.detectors = append(r.detectors, d)
+				found = true
+			}
+		}
+		if !found {
+			return nil, &ConfigError{"unknown redaction detector: " + name}
+		}
+	}
+	return r, nil
+}
+
+// redactionReport counts what was redacted from a request, per detector,
+// and names the fields it was found in. It never holds redacted values.
+type redactionReport struct {
+	Total  int            `json:"total"`
+	Counts map[string]int `json:"counts"`
+	Fields []string       `json:"fields"`
+}
+
+func (rep *redactionReport) add(field, name string) {
+	if rep.Counts == nil {
+		rep.Counts = map[string]int{}
+	}
+	rep.Total++
+	rep.Counts[name]++
+	if n := len(rep.Fields); n == 0 || rep.Fields[n-1] != field {
+		rep.Fields = append(rep.Fields, field)
+	}
+}
+
+// redactString replaces every detected value in s, reporting it under field.
+// With pseudonyms, values are replaced by their placeholders.
+func (r *redactor) redactString(s, field string, rep *redactionReport, p *pseudonyms) string {
+	for _, d := range r.detectors {
+		s = d.re.ReplaceAllStringFunc(s, func(match string) string {
+			if d.valid != nil && !d.valid(match) {
+				return match
+			}
+			rep.add(field, d.name)
+			if p != nil {
+				return p.placeholder(d.placeholder, match)
+			}
+			if d.replacement != "" {
+				return d.replacement
+			}
+			return "[REDACTED:" + d.name + "]"
+		})
+	}
+	return s
+}
+
+// redactValue redacts the strings within a decoded JSON value. Object keys
+// are kept.
+func (r *redactor) redactValue(v interface{}, field string, rep *redactionReport, p *pseudonyms) interface{} {
+	switch v := v.(type) {
+	case string:
+		return r.redactString(v, field, rep, p)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v[k] = r.redactValue(v[k], field+"."+k, rep, p)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = r.redactValue(v[i], field+"["+strconv.Itoa(i)+"]", rep, p)
+		}
+		return v
+	}
+	return v
+}
+
+// redactRequest redacts a chat query, if any, and the inputs of a request
+// in place. In redactModePseudonymize it also selects the pseudonyms of the
+// conversation, or fresh ones for a new conversation or a workflow run. The
+// report goes into the X-Redaction-Report response header, which must be
+// set before the response is written.
+//
+// A conversation whose pseudonyms are lost cannot be continued: its history
+// refers to placeholders that would be numbered again for other values. It
+// writes a 409 response and returns false for one.
+func (t *difyTarget) redactRequest(ctx context.Context, w http.ResponseWriter, conversationID string, query *string, inputs map[string]interface{}) bool {
+	if t.redactor == nil {
+		return true
+	}
+	if t.redactor.pseudonymize {
+		if conversationID == "" {
+			t.pseudonyms = newPseudonyms()
+		} else if t.pseudonyms = t.conversationPseudonyms(conversationID); t.pseudonyms == nil {
+			t.auditDenied("pseudonyms of the conversation are lost")
+			http.Error(w, "The pseudonyms of this conversation are no longer known, start a new conversation", http.StatusConflict)
+			return false
+		}
+	}
+	rep := &redactionReport{Counts: map[string]int{}, Fields: []string{}}
+	if query != nil {
+		*query = t.redactor.redactString(*query, "query", rep, t.pseudonyms)
+	}
+	t.redactor.redactValue(inputs, "inputs", rep, t.pseudonyms)
+
+	for name, n := range rep.Counts {
+		observeRedactions(ctx, name, n)
+	}
+	report, _ := json.Marshal(rep)
+	w.Header().Set(redactionReportHeader, string(report))
+	if t.pseudonyms != nil && conversationID != "" {
+		// Values first seen in this request got new placeholders.
+		t.mappings.put(t.mappingKey(conversationID), t.pseudonyms, t.keys)
+	}
+	return true
+}
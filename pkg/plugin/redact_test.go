@@ -0,0 +1,125 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestBuiltinDetectors tests what each built-in detector redacts
+func TestBuiltinDetectors(t *testing.T) {
+	r, err := newRedactor(redactionSettings{Enabled: true})
+	if err != nil {
+		t.Fatalf("newRedactor: %v", err)
+	}
+	testCases := []struct {
+		in       string
+		expected string
+	}{
+		{"mail jane.doe+ops@example.co.uk now", "mail [REDACTED:email] now"},
+		{"from 10.0.12.7:8080", "from [REDACTED:ipv4]:8080"},
+		{"peer fe80::1ff:fe23:4567:890a up", "peer [REDACTED:ipv6] up"},
+		{"peer 2001:0db8:85a3:0000:0000:8a2e:0370:7334", "peer [REDACTED:ipv6]"},
+		{"Authorization: Bearer abcdefgh12345678", "Authorization: [REDACTED:bearer_token]"},
+		{"token eyJhbGciOi.eyJzdWIiOi.c2lnbmF0dXJl", "token [REDACTED:jwt]"},
+		{"key app-BY4mKffjRdOJemnxqX4d7ThY", "key [REDACTED:api_key]"},
+		{"card 4111 1111 1111 1111", "card [REDACTED:credit_card]"},
+		// Not redacted: a version, a time, a number failing the Luhn check
+		// and C++ scope operators
+		{"v1.2.3 at 12:34:56 id 4111111111111112 std::vector", "v1.2.3 at 12:34:56 id 4111111111111112 std::vector"},
+		// Not redacted as IPv6: times, MAC addresses, scopes and hex digests
+		// that share its alphabet
+		{"from 10:30:: to 12:30:45", "from 10:30:: to 12:30:45"},
+		{"nic 00:1a:2b:3c:4d:5e and eui aa:bb:cc:dd:ee:ff:00:11", "nic 00:1a:2b:3c:4d:5e and eui aa:bb:cc:dd:ee:ff:00:11"},
+		{"call Cache::add() or Foo::bad", "call Cache::add() or Foo::bad"},
+		{"sha dead:beef:cafe:f00d:zz", "sha dead:beef:cafe:f00d:zz"},
+		{"gw 2001:db8::1 ok", "gw [REDACTED:ipv6] ok"},
+	}
+	for _, tc := range testCases {
+		var rep redactionReport
+		if got := r.redactString(tc.in, "query", &rep, nil); got != tc.expected {
+			t.Errorf("redact(%q) = %q, expected %q", tc.in, got, tc.expected)
+		}
+	}
+}
+
+// TestNewRedactor tests the validation of redaction settings
+func TestNewRedactor(t *testing.T) {
+	if r, err := newRedactor(redactionSettings{}); r != nil || err != nil {
+		t.Errorf("Expected no redactor when disabled, got %v: %v", r, err)
+	}
+	for _, s := range []redactionSettings{
+		{Enabled: true, Detectors: []string{"phone"}},
+		{Enabled: true, Rules: []redactionRule{{Name: "x", Pattern: "("}}},
+		{Enabled: true, Rules: []redactionRule{{Pattern: "x"}}},
+	} {
+		if _, err := newRedactor(s); err == nil {
+			t.Errorf("Expected %+v to be rejected", s)
+		}
+	}
+}
+
+// TestRedactChat tests that a chat message is redacted before it reaches
+// Dify and that the response reports what was redacted
+func TestRedactChat(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		raw, _ := io.ReadAll(r.Body)
+		json.Unmarshal(raw, &body)
+		received <- body
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"answer": "ok"}`))
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	var r mockCallResourceResponseSender
+	err = app.CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{
+			OrgID: 1,
+			User:  &backend.User{Login: "viewer", Role: roleViewer},
+			AppInstanceSettings: &backend.AppInstanceSettings{
+				JSONData: []byte(`{"apiUrl": "` + server.URL + `", "redaction": {"enabled": true,
+					"detectors": ["email", "ipv4"],
+					"rules": [{"name": "customer_id", "pattern": "CUST-[0-9]{6}", "replacement": "CUST-XXXXXX"}]}}`),
+				DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+			},
+		},
+		Method: http.MethodPost,
+		Path:   "difyChatProxy",
+		Body: []byte(`{"query": "why did bob@example.com fail?", "response_mode": "blocking",
+			"inputs": {"logs": ["GET /x from 192.168.1.9", "order of CUST-123456"], "level": "error"}}`),
+	}, &r)
+	if err != nil || r.response.Status != http.StatusOK {
+		t.Fatalf("Unexpected response %+v: %v", r.response, err)
+	}
+
+	body := <-received
+	if body["query"] != "why did [REDACTED:email] fail?" {
+		t.Errorf("Unexpected query %q", body["query"])
+	}
+	logs := body["inputs"].(map[string]interface{})["logs"].([]interface{})
+	if logs[0] != "GET /x from [REDACTED:ipv4]" || logs[1] != "order of CUST-XXXXXX" {
+		t.Errorf("Unexpected inputs %v", logs)
+	}
+
+	var rep redactionReport
+	if err := json.Unmarshal([]byte(r.response.Headers[redactionReportHeader][0]), &rep); err != nil {
+		t.Fatalf("decode report: %v", err)
+	}
+	if rep.Total != 3 || rep.Counts["customer_id"] != 1 || strings.Join(rep.Fields, ",") != "query,inputs.logs[0],inputs.logs[1]" {
+		t.Errorf("Unexpected report %+v", rep)
+	}
+}
@@ -1,13 +1,14 @@
 package plugin
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
 
-	"github.com/grafana/grafana-plugin-sdk-go/backend"
-	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
 )
 
 // ConfigError is a simple error type for config issues
@@ -17,25 +18,13 @@ type ConfigError struct {
 
 func (e *ConfigError) Error() string { return e.msg }
 
-// getPluginConfig extracts apiUrl and apiKey from plugin config, with error handling
-func getPluginConfig(req *http.Request) (string, string, error) {
-	pluginConfig := backend.PluginConfigFromContext(req.Context())
-	jsonData := pluginConfig.AppInstanceSettings.JSONData
-	secureJsonData := pluginConfig.AppInstanceSettings.DecryptedSecureJSONData
-
-	var config map[string]interface{}
-	if err := json.Unmarshal(jsonData, &config); err != nil {
-		return "", "", err
-	}
-	apiUrl, ok := config["apiUrl"].(string)
-	if !ok {
-		return "", "", &ConfigError{"apiUrl not found or not a string"}
-	}
-	apiKey, ok := secureJsonData["apiKey"]
-	if !ok {
-		return "", "", &ConfigError{"API key is not set"}
+// writeConfigError reports a configuration error to the client.
+func writeConfigError(w http.ResponseWriter, err error) {
+	if ce, ok := err.(*ConfigError); ok {
+		http.Error(w, ce.msg, http.StatusBadRequest)
+	} else {
+		http.Error(w, "Invalid JSONData", http.StatusInternalServerError)
 	}
-	return apiUrl, apiKey, nil
 }
 
 // handlePing is an example HTTP GET resource that returns a {"message": "ok"} JSON response.
@@ -70,406 +59,481 @@ func (a *App) handleEcho(w http.ResponseWriter, req *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (a *App) handleDifyWorkflow(w http.ResponseWriter, req *http.Request) {
-	apiUrl, apiKey, err := getPluginConfig(req)
-	if err != nil {
-		if ce, ok := err.(*ConfigError); ok {
-			http.Error(w, ce.msg, http.StatusBadRequest)
-		} else {
-			http.Error(w, "Invalid JSONData", http.StatusInternalServerError)
-		}
+// writeDifyError reports a failed Dify call to the client. Errors returned by
+// Dify keep their status code and error body; transport errors become 502,
+// and calls failed fast by an open circuit 503.
+func writeDifyError(w http.ResponseWriter, err error) {
+	if writeCircuitOpen(w, err) {
 		return
 	}
-	response := map[string]string{
-		"apiKey": apiKey,
-		"apiUrl": apiUrl,
-	}
-	w.Header().Add("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	var apiErr *dify.APIError
+	if errors.As(err, &apiErr) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(apiErr.StatusCode)
+		json.NewEncoder(w).Encode(apiErr)
 		return
 	}
-	w.WriteHeader(http.StatusOK)
+	http.Error(w, "Failed to call Dify API: "+err.Error(), http.StatusBadGateway)
 }
 
-// callDifyWorkflowAPI makes a request to the Dify workflow API
-func callDifyWorkflowAPI(apiUrl, apiKey string, inputs interface{}) (*http.Response, error) {
-	// Create the Dify API URL
-	difyURL := apiUrl + "/v1/workflows/run"
-
-	// Create the request payload with hardcoded values and provided inputs
-	payload := map[string]interface{}{
-		"inputs":        inputs,         // Use provided inputs
-		"response_mode": "streaming",    // Hardcoded
-		"user":          "grafana-user", // Hardcoded
+// writeJSON encodes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
+}
 
-	// Marshal the payload to JSON
-	payloadBytes, err := json.Marshal(payload)
-	if err != nil {
-		log.DefaultLogger.Error("Failed to marshal payload", "error", err)
-		return nil, err
+// responseMode returns the Dify response mode requested with ?response_mode=
+// or, for routes with a structured body, the body's response_mode field.
+// Streaming is the default.
+func responseMode(req *http.Request, bodyMode string) (string, error) {
+	mode := req.URL.Query().Get("response_mode")
+	if mode == "" {
+		mode = bodyMode
+	}
+	switch mode {
+	case "", dify.ResponseModeStreaming:
+		return dify.ResponseModeStreaming, nil
+	case dify.ResponseModeBlocking:
+		return dify.ResponseModeBlocking, nil
+	default:
+		return "", fmt.Errorf("unknown response_mode: %s", mode)
 	}
+}
 
-	// Debug log: Print request details
-	log.DefaultLogger.Debug("Making request to Dify API",
-		"url", difyURL,
-		"payload", string(payloadBytes),
-		"inputs", inputs)
-
-	// Create a new HTTP request to Dify API
-	req, err := http.NewRequest("POST", difyURL, bytes.NewBuffer(payloadBytes))
+// writeBlockingResult answers a blocking Dify call with Dify's JSON response.
+func (t *difyTarget) writeBlockingResult(w http.ResponseWriter, ctx context.Context, v interface{}, err error) {
 	if err != nil {
-		log.DefaultLogger.Error("Failed to create HTTP request", "error", err)
-		return nil, err
+		observeUpstreamError(ctx, err)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			http.Error(w, "Dify did not answer before the blocking timeout", http.StatusGatewayTimeout)
+			return
+		}
+		writeDifyError(w, err)
+		return
 	}
-
-	// Set headers
-	req.Header.Set("Authorization", "Bearer "+apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	// Make the request to Dify API
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.DefaultLogger.Error("Failed to make request to Dify API", "error", err, "url", difyURL)
-		return nil, err
+	observeUsage(ctx, usageOf(v))
+	t.recordUsage(usageOf(v))
+	traceResult(ctx, v)
+	if chat, ok := v.(*dify.ChatResponse); ok {
+		t.bindConversation(chat.ConversationID)
+		t.pin(chat.ConversationID, chat.TaskID)
+		answer := chat.Answer
+		if t.pseudonyms != nil {
+			answer = t.pseudonyms.rehydrate(answer)
+		}
+		t.saveTranscript(chat.ConversationID, chat.MessageID, answer, &chat.Metadata.Usage)
 	}
+	if t.pseudonyms != nil {
+		v = t.rehydrateJSON(v)
+	}
+	writeJSON(w, v)
+}
 
-	// Debug log: Print response details
-	log.DefaultLogger.Debug("Received response from Dify API",
-		"status_code", resp.StatusCode,
-		"status", resp.Status,
-		"url", difyURL)
-
-	return resp, nil
+// decodeInputs reads the request body as a JSON object. A missing or empty
+// body yields an empty object.
+func decodeInputs(w http.ResponseWriter, req *http.Request) (map[string]interface{}, bool) {
+	if req.Body == nil || req.ContentLength == 0 {
+		return map[string]interface{}{}, true
+	}
+	// Check content length to prevent oversized requests (max 10MB)
+	if req.ContentLength > 10*1024*1024 {
+		http.Error(w, "Request body too large (max 10MB)", http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		http.Error(w, "Invalid JSON in request body: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	if body == nil {
+		body = map[string]interface{}{}
+	}
+	return body, true
 }
 
-// handleDifyWorkflowProxy proxies requests to the Dify workflow API
+// handleDifyWorkflowProxy runs a Dify workflow with the request body as its inputs
+// and streams the run events, or their aggregated result, back to the client.
 func (a *App) handleDifyWorkflowProxy(w http.ResponseWriter, req *http.Request) {
-	// Allow all HTTP methods
-
-	// Debug log: Print incoming request details
-	log.DefaultLogger.Debug("Received request to difyWorkflowProxy",
-		"method", req.Method,
-		"url", req.URL.String(),
-		"content_length", req.ContentLength,
-		"has_body", req.Body != nil)
-
-	apiUrl, apiKey, err := getPluginConfig(req)
+	t, ok := a.resolveTarget(w, req, appTypeWorkflow)
+	if !ok || !a.checkQuota(w, t) || !a.checkRate(w, req, t) {
+		return
+	}
+	mode, err := responseMode(req, "")
 	if err != nil {
-		if ce, ok := err.(*ConfigError); ok {
-			http.Error(w, ce.msg, http.StatusBadRequest)
-		} else {
-			http.Error(w, "Invalid JSONData", http.StatusInternalServerError)
-		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inputs, ok := decodeInputs(w, req)
+	if !ok {
 		return
 	}
 
-	var inputs map[string]interface{}
-
-	// Handle request body - if no body or empty body, use empty object as default
-	if req.Body == nil || req.ContentLength == 0 {
-		// No body provided, use empty object as default
-		inputs = map[string]interface{}{}
-	} else {
-		// Check content length to prevent oversized requests (max 10MB)
-		if req.ContentLength > 10*1024*1024 {
-			http.Error(w, "Request body too large (max 10MB)", http.StatusRequestEntityTooLarge)
-			return
-		}
-
-		// Parse the incoming request body to extract inputs
-		var requestBody map[string]interface{}
-		if err := json.NewDecoder(req.Body).Decode(&requestBody); err != nil {
-			http.Error(w, "Invalid JSON in request body: "+err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		// If body is empty, use empty object as default
-		inputs = requestBody
-		if len(requestBody) == 0 {
-			inputs = map[string]interface{}{}
-		}
+	if !t.redactRequest(req.Context(), w, "", nil, inputs) {
+		return
 	}
+	t.logPayload(req.Context(), nil, inputs)
+	t.auditPrompt("", nil, inputs)
 
-	// Debug log: Print final inputs being sent to Dify
-	log.DefaultLogger.Debug("Sending inputs to Dify API",
-		"inputs", inputs,
-		"api_url", apiUrl)
+	runReq := &dify.WorkflowRunRequest{
+		Inputs: inputs,
+		User:   t.user,
+	}
+	release, ok := a.acquireStream(w, req, t)
+	if !ok {
+		return
+	}
+	defer release()
+	if mode == dify.ResponseModeBlocking {
+		ctx, cancel := t.blockingContext(req)
+		defer cancel()
+		result, err := t.client.RunWorkflow(ctx, runReq)
+		t.writeBlockingResult(w, ctx, result, err)
+		return
+	}
 
-	// Use the abstracted function to call Dify API
-	resp, err := callDifyWorkflowAPI(apiUrl, apiKey, inputs)
+	wd := t.streamWatchdog(req)
+	defer wd.close()
+	resp, err := t.client.RunWorkflowStream(wd.ctx, runReq)
 	if err != nil {
-		http.Error(w, "Failed to call Dify API: "+err.Error(), http.StatusInternalServerError)
+		loggerFrom(req.Context()).Error("Failed to call Dify workflow API", "error", err)
+		writeCallError(w, wd.ctx, wd, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	// Copy response headers
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
-	}
-
-	// Set status code
-	w.WriteHeader(resp.StatusCode)
-
-	// Stream the response body
-	buf := make([]byte, 32*1024) // 32KB buffer
-	for {
-		n, err := resp.Body.Read(buf)
-		if n > 0 {
-			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
-				break
-			}
-		}
-		if err != nil {
-			break
-		}
-	}
+	writeStream(w, req, resp, streamOptions{
+		watchdog: wd,
+		rewrite:  t.rehydrator(),
+		onResult: t.recordResult,
+		stop: func(ctx context.Context, taskID string) error {
+			return t.client.StopWorkflow(ctx, taskID, t.user)
+		},
+	})
 }
 
+// handleDifyChatProxy sends a chat message on behalf of the calling user and
+// streams the answer, or the aggregated result, back to the client.
 func (a *App) handleDifyChatProxy(w http.ResponseWriter, req *http.Request) {
-	apiUrl, apiKey, err := getPluginConfig(req)
-	if err != nil {
-		if ce, ok := err.(*ConfigError); ok {
-			http.Error(w, ce.msg, http.StatusBadRequest)
-		} else {
-			http.Error(w, "Invalid JSONData", http.StatusInternalServerError)
-		}
+	t, ok := a.resolveTarget(w, req, appTypeChat)
+	if !ok || !a.checkQuota(w, t) || !a.checkRate(w, req, t) {
 		return
 	}
 
-	// Handle request body - if no body or empty body, use empty object as default
+	// Handle request body - a chat message always needs one
 	if req.Body == nil || req.ContentLength == 0 {
-		// No body provided, use empty object as default
 		http.Error(w, "Request body cannot be empty", http.StatusBadRequest)
 		return
-	} else {
-		// Check content length to prevent oversized requests (max 10MB)
-		if req.ContentLength > 10*1024*1024 {
-			http.Error(w, "Request body too large (max 10MB)", http.StatusRequestEntityTooLarge)
-			return
-		}
+	}
+	// Check content length to prevent oversized requests (max 10MB)
+	if req.ContentLength > 10*1024*1024 {
+		http.Error(w, "Request body too large (max 10MB)", http.StatusRequestEntityTooLarge)
+		return
+	}
 
-		// Parse the incoming request body to extract inputs
-		var requestBody map[string]interface{}
-		if err := json.NewDecoder(req.Body).Decode(&requestBody); err != nil {
-			http.Error(w, "Invalid JSON in request body: "+err.Error(), http.StatusBadRequest)
-			return
-		}
+	var requestBody struct {
+		Query          *string                `json:"query"`
+		ConversationID string                 `json:"conversation_id"`
+		Inputs         map[string]interface{} `json:"inputs"`
+		Files          []dify.File            `json:"files"`
+		ResponseMode   string                 `json:"response_mode"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&requestBody); err != nil {
+		http.Error(w, "Invalid JSON in request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Query == nil {
+		http.Error(w, "query field is required in the request body", http.StatusBadRequest)
+		return
+	}
+	if *requestBody.Query == "" {
+		http.Error(w, "query field cannot be empty", http.StatusBadRequest)
+		return
+	}
+	mode, err := responseMode(req, requestBody.ResponseMode)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if requestBody.Inputs == nil {
+		requestBody.Inputs = map[string]interface{}{}
+	}
+	if requestBody.Files == nil {
+		requestBody.Files = []dify.File{}
+	}
 
-		if requestBody["conversation_id"] == nil {
-			requestBody["conversation_id"] = ""
-		}
+	traceAttributes(req.Context(), attrConversationID, requestBody.ConversationID)
+	a.follow(req, t, requestBody.ConversationID)
+	if !a.checkConversationOwner(w, req, t, requestBody.ConversationID) {
+		return
+	}
 
-		if requestBody["query"] == nil {
-			http.Error(w, "query field is required in the request body", http.StatusBadRequest)
-			return
-		} else {
-			if requestBody["query"] == "" {
-				http.Error(w, "query field cannot be empty", http.StatusBadRequest)
-				return
-			}
-			chat_message_endpoint := apiUrl + "/v1/chat-messages"
-
-			username := "grafana-user"
-			conversation_id := requestBody["conversation_id"].(string)
-
-			payload := map[string]interface{}{
-				"inputs":          map[string]interface{}{},
-				"query":           requestBody["query"].(string),
-				"response_mode":   "streaming",
-				"conversation_id": conversation_id,
-				"user":            username,
-				"files":           []map[string]interface{}{},
-			}
-
-			bodyBytes, _ := json.Marshal(payload)
-			req, err := http.NewRequest("POST", chat_message_endpoint, bytes.NewReader(bodyBytes))
-			if err != nil {
-				http.Error(w, "Failed to create Dify API Request: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			req.Header.Set("Authorization", "Bearer "+apiKey)
-			req.Header.Set("Content-Type", "application/json")
-
-			client := &http.Client{}
-			resp, err := client.Do(req)
-			if err != nil {
-				http.Error(w, "Failed to call Dify API: "+err.Error(), http.StatusInternalServerError)
-				return
-			}
-			defer resp.Body.Close()
-
-			w.WriteHeader(resp.StatusCode)
-			for k, vv := range resp.Header {
-				// Skip Content-Length to allow streaming
-				if k == "Content-Length" {
-					continue
-				}
-				for _, v := range vv {
-					w.Header().Add(k, v)
-				}
-			}
-
-			// Ensure content-type is text/event-stream
-			w.Header().Set("Content-Type", "text/event-stream")
-
-			// Flush interface to push data immediately
-			flusher, ok := w.(http.Flusher)
-			if !ok {
-				http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
-				return
-			}
-
-			// Stream response directly to client
-			buf := make([]byte, 4096)
-			for {
-				n, err := resp.Body.Read(buf)
-				if n > 0 {
-					_, writeErr := w.Write(buf[:n])
-					if writeErr != nil {
-						log.DefaultLogger.Debug("Error writing to client: %v", writeErr)
-						break
-					}
-					flusher.Flush()
-				}
-				if err != nil {
-					if err != io.EOF {
-						log.DefaultLogger.Debug("Error reading from backend: %v", err)
-					}
-					break
-				}
-			}
-		}
+	t.startTranscript(req, *requestBody.Query)
+	if !t.redactRequest(req.Context(), w, requestBody.ConversationID, requestBody.Query, requestBody.Inputs) {
+		return
+	}
+	t.logPayload(req.Context(), requestBody.Query, requestBody.Inputs)
+	t.auditPrompt(requestBody.ConversationID, requestBody.Query, requestBody.Inputs)
+	chatReq := &dify.ChatRequest{
+		Inputs:         requestBody.Inputs,
+		Query:          *requestBody.Query,
+		ConversationID: requestBody.ConversationID,
+		User:           t.user,
+		Files:          requestBody.Files,
+	}
+	release, ok := a.acquireStream(w, req, t)
+	if !ok {
+		return
+	}
+	defer release()
+	if mode == dify.ResponseModeBlocking {
+		ctx, cancel := t.blockingContext(req)
+		defer cancel()
+		result, err := t.client.ChatMessages(ctx, chatReq)
+		t.writeBlockingResult(w, ctx, result, err)
+		return
+	}
+
+	wd := t.streamWatchdog(req)
+	defer wd.close()
+	resp, err := t.client.ChatMessagesStream(wd.ctx, chatReq)
+	if err != nil {
+		writeCallError(w, wd.ctx, wd, err)
+		return
 	}
+	defer resp.Body.Close()
+
+	writeStream(w, req, resp, streamOptions{
+		watchdog: wd,
+		rewrite:  t.rehydrator(),
+		onResult: t.recordResult,
+		stop: func(ctx context.Context, taskID string) error {
+			return t.client.StopChatMessage(ctx, taskID, t.user)
+		},
+	})
 }
 
-// handleDifyGetConversations proxies GET requests to Dify's /v1/conversations endpoint
-func (a *App) handleDifyGetConversations(w http.ResponseWriter, req *http.Request) {
-	if req.Method != http.MethodGet {
+// handleDifyCompletionProxy sends a completion request to a completion app and
+// streams the answer back to the client. The body is {"inputs": {...}}.
+func (a *App) handleDifyCompletionProxy(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	apiUrl, apiKey, err := getPluginConfig(req)
+	t, ok := a.resolveTarget(w, req, appTypeCompletion)
+	if !ok || !a.checkQuota(w, t) || !a.checkRate(w, req, t) {
+		return
+	}
+	body, ok := decodeInputs(w, req)
+	if !ok {
+		return
+	}
+	inputs, _ := body["inputs"].(map[string]interface{})
+	if inputs == nil {
+		inputs = map[string]interface{}{}
+	}
+	bodyMode, _ := body["response_mode"].(string)
+	mode, err := responseMode(req, bodyMode)
 	if err != nil {
-		if ce, ok := err.(*ConfigError); ok {
-			http.Error(w, ce.msg, http.StatusBadRequest)
-		} else {
-			http.Error(w, "Invalid JSONData", http.StatusInternalServerError)
-		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	// Build Dify API URL with query params, hardcoding user=grafana-user
-	difyURL := apiUrl + "/v1/conversations"
-	q := req.URL.Query()
-	q.Set("user", "grafana-user") // hard code user
-	// Only allow/forward specific query params
-	params := []string{"user", "last_id", "limit", "sort_by"}
-	outQ := make([]string, 0, len(params))
-	for _, p := range params {
-		if v := q.Get(p); v != "" {
-			outQ = append(outQ, p+"="+v)
-		}
+	if !t.redactRequest(req.Context(), w, "", nil, inputs) {
+		return
 	}
-	if len(outQ) > 0 {
-		difyURL += "?" + q.Encode()
+	t.logPayload(req.Context(), nil, inputs)
+	t.auditPrompt("", nil, inputs)
+	completionReq := &dify.CompletionRequest{
+		Inputs: inputs,
+		User:   t.user,
+		Files:  []dify.File{},
 	}
-
-	// Create request to Dify
-	proxyReq, err := http.NewRequest("GET", difyURL, nil)
-	if err != nil {
-		http.Error(w, "Failed to create request to Dify", http.StatusInternalServerError)
+	release, ok := a.acquireStream(w, req, t)
+	if !ok {
+		return
+	}
+	defer release()
+	if mode == dify.ResponseModeBlocking {
+		ctx, cancel := t.blockingContext(req)
+		defer cancel()
+		result, err := t.client.CompletionMessages(ctx, completionReq)
+		t.writeBlockingResult(w, ctx, result, err)
 		return
 	}
-	proxyReq.Header.Set("Authorization", "Bearer "+apiKey)
-	proxyReq.Header.Set("Accept", "application/json")
 
-	// Make the request
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
+	wd := t.streamWatchdog(req)
+	defer wd.close()
+	resp, err := t.client.CompletionMessagesStream(wd.ctx, completionReq)
 	if err != nil {
-		http.Error(w, "Failed to call Dify API: "+err.Error(), http.StatusBadGateway)
+		writeCallError(w, wd.ctx, wd, err)
 		return
 	}
 	defer resp.Body.Close()
 
-	// Copy response headers and body
-	for k, v := range resp.Header {
-		for _, vv := range v {
-			w.Header().Add(k, vv)
-		}
+	writeStream(w, req, resp, streamOptions{
+		watchdog: wd,
+		rewrite:  t.rehydrator(),
+		onResult: t.recordResult,
+		stop: func(ctx context.Context, taskID string) error {
+			return t.client.StopCompletionMessage(ctx, taskID, t.user)
+		},
+	})
+}
+
+// handleDifyChatStop stops a running chat message of the calling user. The
+// task is named by task_id in the JSON body or the query string.
+func (a *App) handleDifyChatStop(w http.ResponseWriter, req *http.Request) {
+	a.handleStop(w, req, appTypeChat, (*dify.Client).StopChatMessage)
+}
+
+// handleDifyCompletionStop stops a running completion of the calling user.
+func (a *App) handleDifyCompletionStop(w http.ResponseWriter, req *http.Request) {
+	a.handleStop(w, req, appTypeCompletion, (*dify.Client).StopCompletionMessage)
+}
+
+// handleDifyWorkflowStop stops a running workflow of the calling user.
+func (a *App) handleDifyWorkflowStop(w http.ResponseWriter, req *http.Request) {
+	a.handleStop(w, req, appTypeWorkflow, (*dify.Client).StopWorkflow)
+}
+
+func (a *App) handleStop(w http.ResponseWriter, req *http.Request, appType string,
+	stop func(c *dify.Client, ctx context.Context, taskID, user string) error) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t, ok := a.resolveTarget(w, req, appType)
+	if !ok {
+		return
+	}
+	body, ok := decodeInputs(w, req)
+	if !ok {
+		return
+	}
+	taskID, _ := body["task_id"].(string)
+	if taskID == "" {
+		taskID = req.URL.Query().Get("task_id")
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if taskID == "" {
+		http.Error(w, "task_id is required", http.StatusBadRequest)
+		return
+	}
+	t.auditTask(taskID)
+	a.follow(req, t, taskID)
+
+	ctx, cancel := t.callContext(req)
+	defer cancel()
+	if err := stop(t.client, ctx, taskID, t.user); err != nil {
+		writeCallError(w, ctx, nil, err)
+		return
+	}
+	writeJSON(w, map[string]string{"result": "success"})
 }
 
-func (a *App) handleDifyMessageHistoryProxy(w http.ResponseWriter, req *http.Request) {
-	apiUrl, apiKey, err := getPluginConfig(req)
-	if err != nil {
-		if ce, ok := err.(*ConfigError); ok {
-			http.Error(w, ce.msg, http.StatusBadRequest)
-		} else {
-			http.Error(w, "Invalid JSONData", http.StatusInternalServerError)
-		}
+// handleDifyGetConversations lists the calling user's conversations from Dify's /v1/conversations endpoint
+func (a *App) handleDifyGetConversations(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t, ok := a.resolveTarget(w, req, appTypeChat)
+	if !ok {
 		return
 	}
-	difyURL := apiUrl + "/v1/messages"
+
+	// Only forward specific query params; the user is always the caller
 	q := req.URL.Query()
-	q.Set("user", "grafana-user") // hard code user
-	// Only allow/forward specific query params
-	params := []string{"user", "first_id", "limit", "conversation_id"}
-	outQ := make([]string, 0, len(params))
-	for _, p := range params {
-		if v := q.Get(p); v != "" {
-			outQ = append(outQ, p+"="+v)
-		}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	ctx, cancel := t.callContext(req)
+	defer cancel()
+	list, err := t.client.Conversations(ctx, dify.ConversationsParams{
+		User:   t.user,
+		LastID: q.Get("last_id"),
+		Limit:  limit,
+		SortBy: q.Get("sort_by"),
+	})
+	if err != nil {
+		writeCallError(w, ctx, nil, err)
+		return
 	}
-	if len(outQ) > 0 {
-		difyURL += "?" + q.Encode()
+	// Listed conversations are held by the endpoint that listed them.
+	for _, c := range list.Data {
+		t.pin(c.ID)
 	}
+	t.rehydrateConversations(list)
+	writeJSON(w, list)
+}
 
-	// Create request to Dify
-	proxyReq, err := http.NewRequest("GET", difyURL, nil)
-	if err != nil {
-		http.Error(w, "Failed to create request to Dify", http.StatusInternalServerError)
+// handleDifyMessageHistoryProxy returns the messages of one of the calling user's conversations
+func (a *App) handleDifyMessageHistoryProxy(w http.ResponseWriter, req *http.Request) {
+	t, ok := a.resolveTarget(w, req, appTypeChat)
+	if !ok {
 		return
 	}
-	proxyReq.Header.Set("Authorization", "Bearer "+apiKey)
-	proxyReq.Header.Set("Accept", "application/json")
 
-	// Make the request
-	client := &http.Client{}
-	resp, err := client.Do(proxyReq)
+	q := req.URL.Query()
+	traceAttributes(req.Context(), attrConversationID, q.Get("conversation_id"))
+	a.follow(req, t, q.Get("conversation_id"))
+	if !a.checkConversationOwner(w, req, t, q.Get("conversation_id")) {
+		return
+	}
+	// Only forward specific query params; the user is always the caller
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	ctx, cancel := t.callContext(req)
+	defer cancel()
+	list, err := t.client.Messages(ctx, dify.MessagesParams{
+		User:           t.user,
+		ConversationID: q.Get("conversation_id"),
+		FirstID:        q.Get("first_id"),
+		Limit:          limit,
+	})
 	if err != nil {
-		http.Error(w, "Failed to call Dify API: "+err.Error(), http.StatusBadGateway)
+		writeCallError(w, ctx, nil, err)
 		return
 	}
-	defer resp.Body.Close()
+	t.rehydrateMessages(q.Get("conversation_id"), list)
+	writeJSON(w, list)
+}
 
-	// Copy response headers and body
-	for k, v := range resp.Header {
-		for _, vv := range v {
-			w.Header().Add(k, vv)
-		}
+// handleDifyParameters returns the selected app's input form and features.
+func (a *App) handleDifyParameters(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	t, ok := a.resolveTarget(w, req, "")
+	if !ok {
+		return
+	}
+	ctx, cancel := t.callContext(req)
+	defer cancel()
+	params, err := t.client.Parameters(ctx, t.user)
+	if err != nil {
+		writeCallError(w, ctx, nil, err)
+		return
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	writeJSON(w, params)
 }
 
 // registerRoutes takes a *http.ServeMux and registers some HTTP handlers.
 func (a *App) registerRoutes(mux *http.ServeMux) {
 	mux.HandleFunc("/ping", a.handlePing)
 	mux.HandleFunc("/echo", a.handleEcho)
-	mux.HandleFunc("/difyWorkflow", a.handleDifyWorkflow)
-	mux.HandleFunc("/difyWorkflowProxy", a.handleDifyWorkflowProxy)
-	mux.HandleFunc("/difyChatProxy", a.handleDifyChatProxy)
-	mux.HandleFunc("/difyGetConversations", a.handleDifyGetConversations)
-	mux.HandleFunc("/difyMessageHistoryProxy", a.handleDifyMessageHistoryProxy)
+	mux.HandleFunc("/apps", a.authorize(accessRead, a.handleApps))
+	mux.HandleFunc("/configStatus", a.authorize(accessAdmin, a.handleConfigStatus))
+	mux.HandleFunc("/usage", a.authorize(accessRead, a.handleUsage))
+	mux.HandleFunc("/audit", a.authorize(accessAdmin, a.handleAudit))
+	mux.HandleFunc("/difyWorkflowProxy", a.authorize(accessWorkflow, a.handleDifyWorkflowProxy))
+	mux.HandleFunc("/difyChatProxy", a.authorize(accessChat, a.handleDifyChatProxy))
+	mux.HandleFunc("/difyCompletionProxy", a.authorize(accessCompletion, a.handleDifyCompletionProxy))
+	mux.HandleFunc("/difyChatStop", a.authorize(accessChat, a.handleDifyChatStop))
+	mux.HandleFunc("/difyCompletionStop", a.authorize(accessCompletion, a.handleDifyCompletionStop))
+	mux.HandleFunc("/difyWorkflowStop", a.authorize(accessWorkflow, a.handleDifyWorkflowStop))
+	mux.HandleFunc("/difyGetConversations", a.authorize(accessChat, a.handleDifyGetConversations))
+	mux.HandleFunc("/difyMessageHistoryProxy", a.authorize(accessChat, a.handleDifyMessageHistoryProxy))
+	mux.HandleFunc("/archivedConversations", a.authorize(accessChat, a.handleArchivedConversations))
+	mux.HandleFunc("/archivedMessages", a.authorize(accessChat, a.handleArchivedMessages))
+	mux.HandleFunc("/difyParameters", a.authorize(accessRead, a.handleDifyParameters))
 }
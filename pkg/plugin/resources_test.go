@@ -4,12 +4,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-
-	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
 )
 
 // mockCallResourceResponseSender implements backend.CallResourceResponseSender
@@ -18,12 +19,44 @@ type mockCallResourceResponseSender struct {
 	response *backend.CallResourceResponse
 }
 
-// Send sets the received *backend.CallResourceResponse to s.response
+// Send sets the received *backend.CallResourceResponse to s.response. Flushed
+// responses arrive in several chunks; their bodies are appended to the first.
 func (s *mockCallResourceResponseSender) Send(response *backend.CallResourceResponse) error {
+	if s.response != nil {
+		s.response.Body = append(s.response.Body, response.Body...)
+		return nil
+	}
 	s.response = response
 	return nil
 }
 
+// asUser returns the plugin context of a request by login with role to the
+// instance of settings in org 1.
+func asUser(login, role string, settings *backend.AppInstanceSettings) backend.PluginContext {
+	return backend.PluginContext{
+		OrgID:               1,
+		User:                &backend.User{Login: login, Role: role},
+		AppInstanceSettings: settings,
+	}
+}
+
+// callResource sends a request to the resource handlers of app and returns
+// the response.
+func callResource(t *testing.T, app *App, pluginContext backend.PluginContext, method, path, body string) *backend.CallResourceResponse {
+	t.Helper()
+	var r mockCallResourceResponseSender
+	err := app.CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: pluginContext,
+		Method:        method,
+		Path:          path,
+		Body:          []byte(body),
+	}, &r)
+	if err != nil {
+		t.Fatalf("CallResource error: %s", err)
+	}
+	return r.response
+}
+
 // TestCallResource tests CallResource calls, using backend.CallResourceRequest and backend.CallResourceResponse.
 // This ensures the httpadapter for CallResource works correctly.
 func TestCallResource(t *testing.T) {
@@ -104,198 +137,16 @@ func TestCallResource(t *testing.T) {
 	}
 }
 
-// TestCallDifyWorkflowAPI tests the callDifyWorkflowAPI function
-func TestCallDifyWorkflowAPI(t *testing.T) {
-	// Test cases
-	testCases := []struct {
-		name           string
-		apiUrl         string
-		apiKey         string
-		inputs         interface{}
-		mockResponse   string
-		mockStatusCode int
-		expectError    bool
-		expectedURL    string
-	}{
-		{
-			name:           "successful API call",
-			apiUrl:         "https://api.dify.ai",
-			apiKey:         "app-BY4mKffjRdOJemnxqX4d7ThY",
-			inputs:         map[string]interface{}{"inputs": map[string]interface{}{"query": "test query"}},
-			mockResponse:   `{"result": "success"}`,
-			mockStatusCode: 200,
-			expectError:    false,
-			expectedURL:    "/v1/workflows/run",
-		},
-		{
-			name:           "API returns error",
-			apiUrl:         "https://api.dify.ai",
-			apiKey:         "app-BY4mKffjRdOJemnxqX4d7ThY",
-			inputs:         map[string]interface{}{"inputs": map[string]interface{}{"query": "test query"}},
-			mockResponse:   `{"error": "invalid request"}`,
-			mockStatusCode: 400,
-			expectError:    false, // Function should not return error for HTTP 400, just return the response
-			expectedURL:    "/v1/workflows/run",
-		},
-		{
-			name:           "empty request body",
-			apiUrl:         "https://api.dify.ai",
-			apiKey:         "app-BY4mKffjRdOJemnxqX4d7ThY",
-			inputs:         map[string]interface{}{},
-			mockResponse:   `{"result": "success"}`,
-			mockStatusCode: 200,
-			expectError:    false,
-			expectedURL:    "/v1/workflows/run",
-		},
-		{
-			name:           "request with custom fields",
-			apiUrl:         "https://api.dify.ai",
-			apiKey:         "app-BY4mKffjRdOJemnxqX4d7ThY",
-			inputs:         map[string]interface{}{"custom_field": "value", "another_field": 123},
-			mockResponse:   `{"result": "success"}`,
-			mockStatusCode: 200,
-			expectError:    false,
-			expectedURL:    "/v1/workflows/run",
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			// Create a mock server
-			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				// Verify the request method
-				if r.Method != "POST" {
-					t.Errorf("Expected POST method, got %s", r.Method)
-				}
-
-				// Verify the URL path
-				expectedPath := tc.expectedURL
-				if r.URL.Path != expectedPath {
-					t.Errorf("Expected path %s, got %s", expectedPath, r.URL.Path)
-				}
-
-				// Verify the Authorization header
-				expectedAuth := "Bearer " + tc.apiKey
-				if r.Header.Get("Authorization") != expectedAuth {
-					t.Errorf("Expected Authorization header %s, got %s", expectedAuth, r.Header.Get("Authorization"))
-				}
-
-				// Verify the Content-Type header
-				if r.Header.Get("Content-Type") != "application/json" {
-					t.Errorf("Expected Content-Type application/json, got %s", r.Header.Get("Content-Type"))
-				}
-
-				// Parse and verify the request body
-				var requestBody map[string]interface{}
-				if err := json.NewDecoder(r.Body).Decode(&requestBody); err != nil {
-					t.Errorf("Failed to decode request body: %v", err)
-				}
-
-				// Verify that the request body matches what was sent
-				// The entire request body should be passed through as-is
-				if len(requestBody) == 0 {
-					t.Error("Expected non-empty request body")
-				}
-
-				// Set response
-				w.WriteHeader(tc.mockStatusCode)
-				w.Write([]byte(tc.mockResponse))
-			}))
-			defer server.Close()
-
-			// Call the function
-			resp, err := callDifyWorkflowAPI(server.URL, tc.apiKey, tc.inputs)
-
-			// Check for errors
-			if tc.expectError {
-				if err == nil {
-					t.Error("Expected error but got none")
-				}
-				return
-			}
-
-			if err != nil {
-				t.Errorf("Unexpected error: %v", err)
-				return
-			}
-
-			// Verify response
-			if resp == nil {
-				t.Error("Expected response but got nil")
-				return
-			}
-
-			if resp.StatusCode != tc.mockStatusCode {
-				t.Errorf("Expected status code %d, got %d", tc.mockStatusCode, resp.StatusCode)
-			}
-
-			// Read and verify response body
-			buf := make([]byte, 1024)
-			n, err := resp.Body.Read(buf)
-			if err != nil && err.Error() != "EOF" {
-				t.Errorf("Failed to read response body: %v", err)
-			}
-
-			responseBody := string(buf[:n])
-			if !strings.Contains(responseBody, tc.mockResponse) {
-				t.Errorf("Expected response body to contain %s, got %s", tc.mockResponse, responseBody)
-			}
-		})
-	}
-}
-
-// TestCallDifyWorkflowAPIErrorHandling tests error handling in callDifyWorkflowAPI
-func TestCallDifyWorkflowAPIErrorHandling(t *testing.T) {
-	testCases := []struct {
-		name        string
-		apiUrl      string
-		apiKey      string
-		inputs      interface{}
-		expectError bool
-	}{
-		{
-			name:        "invalid JSON marshaling",
-			apiUrl:      "https://api.dify.ai",
-			apiKey:      "app-BY4mKffjRdOJemnxqX4d7ThY",
-			inputs:      make(chan int), // This will cause JSON marshaling to fail
-			expectError: true,
-		},
-		{
-			name:        "invalid URL",
-			apiUrl:      "://invalid-url",
-			apiKey:      "app-BY4mKffjRdOJemnxqX4d7ThY",
-			inputs:      map[string]interface{}{"query": "test"},
-			expectError: true,
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			resp, err := callDifyWorkflowAPI(tc.apiUrl, tc.apiKey, tc.inputs)
-
-			if tc.expectError {
-				if err == nil {
-					t.Error("Expected error but got none")
-				}
-				if resp != nil {
-					t.Error("Expected nil response when error occurs")
-				}
-			} else {
-				if err != nil {
-					t.Errorf("Unexpected error: %v", err)
-				}
-				if resp == nil {
-					t.Error("Expected response but got nil")
-				}
-			}
-		})
-	}
-}
-
 // TestHandleDifyWorkflowProxyBodyValidation tests body validation in handleDifyWorkflowProxy
 func TestHandleDifyWorkflowProxyBodyValidation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"event\": \"workflow_finished\"}\n\n"))
+	}))
+	defer server.Close()
+
 	// Initialize app with test configuration
-	jsonData := []byte(`{"apiUrl": "https://api.dify.ai"}`)
+	jsonData := []byte(`{"apiUrl": "` + server.URL + `"}`)
 	secureJsonData := map[string]string{"apiKey": "test-api-key"}
 
 	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{
@@ -328,8 +179,7 @@ func TestHandleDifyWorkflowProxyBodyValidation(t *testing.T) {
 			name:           "missing request body",
 			method:         http.MethodPost,
 			body:           nil,
-			expectedStatus: http.StatusBadRequest,
-			expectedError:  "Request body is required",
+			expectedStatus: http.StatusOK, // Missing body defaults to {}
 		},
 		{
 			name:           "empty request body",
@@ -405,7 +255,7 @@ func TestHandleDifyWorkflowProxyBodyValidation(t *testing.T) {
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			// Create request
-			var bodyReader *bytes.Reader
+			var bodyReader io.Reader
 			if tc.body != nil {
 				bodyReader = bytes.NewReader(tc.body)
 			}
@@ -416,8 +266,10 @@ func TestHandleDifyWorkflowProxyBodyValidation(t *testing.T) {
 			}
 
 			// Add plugin context
-			ctx := backend.WithPluginConfig(req.Context(), backend.PluginConfig{
-				AppInstanceSettings: backend.AppInstanceSettings{
+			ctx := backend.WithPluginContext(req.Context(), backend.PluginContext{
+				OrgID: 1,
+				User:  &backend.User{Login: "admin"},
+				AppInstanceSettings: &backend.AppInstanceSettings{
 					JSONData:                jsonData,
 					DecryptedSecureJSONData: secureJsonData,
 				},
@@ -445,3 +297,193 @@ func TestHandleDifyWorkflowProxyBodyValidation(t *testing.T) {
 		})
 	}
 }
+
+// TestAggregatedResponse tests that chat and workflow streams can be returned as one JSON document
+func TestAggregatedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		switch r.URL.Path {
+		case "/v1/chat-messages":
+			w.Write([]byte("data: {\"event\": \"message\", \"task_id\": \"t1\", \"message_id\": \"m1\", \"conversation_id\": \"c1\", \"answer\": \"Hello \"}\n\n"))
+			w.Write([]byte("event: ping\n\n"))
+			w.Write([]byte("data: {\"event\": \"message\", \"task_id\": \"t1\", \"message_id\": \"m1\", \"conversation_id\": \"c1\", \"answer\": \"world\"}\n\n"))
+			w.Write([]byte("data: {\"event\": \"message_end\", \"task_id\": \"t1\", \"message_id\": \"m1\", \"conversation_id\": \"c1\", \"metadata\": {\"usage\": {\"total_tokens\": 9}}}\n\n"))
+		case "/v1/workflows/run":
+			w.Write([]byte("data: {\"event\": \"workflow_started\", \"task_id\": \"t2\", \"workflow_run_id\": \"r2\"}\n\n"))
+			w.Write([]byte("data: {\"event\": \"node_finished\", \"task_id\": \"t2\", \"data\": {\"execution_metadata\": {\"total_tokens\": 5, \"total_price\": \"0.01\"}}}\n\n"))
+			w.Write([]byte("data: {\"event\": \"workflow_finished\", \"task_id\": \"t2\", \"workflow_run_id\": \"r2\", \"data\": {\"status\": \"succeeded\", \"outputs\": {\"summary\": \"ok\"}}}\n\n"))
+		}
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	testCases := []struct {
+		name     string
+		path     string
+		accept   string
+		body     string
+		handler  func(http.ResponseWriter, *http.Request)
+		expected map[string]interface{}
+	}{
+		{
+			name:    "chat with aggregate query parameter",
+			path:    "/difyChatProxy?aggregate=true",
+			body:    `{"query": "hi"}`,
+			handler: app.handleDifyChatProxy,
+			expected: map[string]interface{}{
+				"answer": "Hello world", "conversation_id": "c1", "message_id": "m1", "task_id": "t1",
+			},
+		},
+		{
+			name:    "workflow with Accept header",
+			path:    "/difyWorkflowProxy",
+			accept:  "application/json",
+			body:    `{"query": "hi"}`,
+			handler: app.handleDifyWorkflowProxy,
+			expected: map[string]interface{}{
+				"task_id": "t2", "workflow_run_id": "r2", "status": "succeeded",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			req = req.WithContext(backend.WithPluginContext(req.Context(), backend.PluginContext{
+				OrgID: 1,
+				User:  &backend.User{Login: "admin"},
+				AppInstanceSettings: &backend.AppInstanceSettings{
+					JSONData:                []byte(`{"apiUrl": "` + server.URL + `"}`),
+					DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+				},
+			}))
+			w := httptest.NewRecorder()
+
+			tc.handler(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+			}
+			if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("Expected application/json, got %s", ct)
+			}
+			var result map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			for k, v := range tc.expected {
+				if result[k] != v {
+					t.Errorf("Expected %s=%v, got %v", k, v, result[k])
+				}
+			}
+			if result["usage"] == nil {
+				t.Error("Expected usage in aggregated result")
+			}
+		})
+	}
+}
+
+// TestBlockingResponseMode tests that blocking calls return Dify's JSON response
+func TestBlockingResponseMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body["response_mode"] != "blocking" {
+			t.Errorf("Expected blocking response_mode, got %v", body["response_mode"])
+		}
+		if body["user"] == "org1:slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v1/chat-messages":
+			w.Write([]byte(`{"event": "message", "task_id": "t1", "conversation_id": "c1", "answer": "blocked"}`))
+		case "/v1/workflows/run":
+			w.Write([]byte(`{"task_id": "t2", "workflow_run_id": "r2", "data": {"status": "succeeded", "outputs": {"text": "done"}}}`))
+		}
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	testCases := []struct {
+		name           string
+		login          string
+		path           string
+		body           string
+		handler        func(http.ResponseWriter, *http.Request)
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "chat with response_mode in body",
+			login:          "admin",
+			path:           "/difyChatProxy",
+			body:           `{"query": "hi", "response_mode": "blocking"}`,
+			handler:        app.handleDifyChatProxy,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"answer":"blocked"`,
+		},
+		{
+			name:           "workflow with response_mode query parameter",
+			login:          "admin",
+			path:           "/difyWorkflowProxy?response_mode=blocking",
+			body:           `{"text": "hi"}`,
+			handler:        app.handleDifyWorkflowProxy,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"workflow_run_id":"r2"`,
+		},
+		{
+			name:           "unknown response mode",
+			login:          "admin",
+			path:           "/difyWorkflowProxy?response_mode=eventually",
+			handler:        app.handleDifyWorkflowProxy,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "blocking timeout",
+			login:          "slow",
+			path:           "/difyChatProxy?response_mode=blocking",
+			body:           `{"query": "hi"}`,
+			handler:        app.handleDifyChatProxy,
+			expectedStatus: http.StatusGatewayTimeout,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(backend.WithPluginContext(req.Context(), backend.PluginContext{
+				OrgID: 1,
+				User:  &backend.User{Login: tc.login},
+				AppInstanceSettings: &backend.AppInstanceSettings{
+					JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "blockingTimeout": 1}`),
+					DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+				},
+			}))
+			w := httptest.NewRecorder()
+
+			tc.handler(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+			if tc.expectedBody != "" && !strings.Contains(w.Body.String(), tc.expectedBody) {
+				t.Errorf("Expected body to contain %s, got %s", tc.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
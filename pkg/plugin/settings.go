@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// defaultBlockingTimeout matches the time Dify allows a blocking call to run.
+	defaultBlockingTimeout = 100 * time.Second
+
+	defaultConnectTimeout   = 10 * time.Second
+	defaultFirstByteTimeout = 60 * time.Second
+	defaultIdleTimeout      = 60 * time.Second
+	defaultTotalTimeout     = 10 * time.Minute
+)
+
+// pluginSettings holds the instance-wide options stored in jsonData. Dify
+// apps are loaded separately by loadApps.
+type pluginSettings struct {
+	// UserIdentity selects how the Dify user is derived, see getDifyUser.
+	UserIdentity string `json:"userIdentity"`
+	// BlockingTimeout bounds blocking calls, in seconds.
+	BlockingTimeout int `json:"blockingTimeout"`
+	// Timeouts bound every other upstream call.
+	Timeouts timeoutSettings `json:"timeouts"`
+	// TLS, Proxy and Pool configure the transport shared by all routes.
+	TLS   tlsSettings   `json:"tls"`
+	Proxy proxySettings `json:"proxy"`
+	Pool  poolSettings  `json:"pool"`
+	// Access maps route groups to the minimum Grafana org role, see authorize.
+	Access map[string]string `json:"access"`
+	// Quotas cap token usage and cost per user and org.
+	Quotas quotaSettings `json:"quotas"`
+	// Limits throttle generation requests and concurrent streams.
+	Limits limitSettings `json:"limits"`
+	// Retry and Circuit make calls resilient to transient Dify failures.
+	Retry   retrySettings   `json:"retry"`
+	Circuit circuitSettings `json:"circuitBreaker"`
+	// EndpointProbeInterval is how often apps with several endpoints are
+	// probed in the background, in seconds.
+	EndpointProbeInterval int `json:"endpointProbeInterval"`
+	// Redaction removes sensitive values from what is sent to Dify.
+	Redaction redactionSettings `json:"redaction"`
+	// Logging configures what is logged about requests.
+	Logging loggingSettings `json:"logging"`
+	// Audit records who asked the assistant what, and when.
+	Audit auditSettings `json:"audit"`
+	// ConversationStore keeps a local copy of chat conversations.
+	ConversationStore conversationStoreSettings `json:"conversationStore"`
+}
+
+// timeoutSettings bounds upstream Dify calls, in seconds. Zero selects the
+// default.
+type timeoutSettings struct {
+	// Connect bounds establishing the connection, including the TLS handshake.
+	Connect int `json:"connect"`
+	// FirstByte bounds the wait for the first event of a stream.
+	FirstByte int `json:"firstByte"`
+	// Idle bounds the gap between two events of a stream. Dify sends a ping
+	// event every 10 seconds, so a healthy stream is never idle for long.
+	Idle int `json:"idle"`
+	// Total bounds a whole call, including reading a streamed answer.
+	Total int `json:"total"`
+}
+
+// loadSettings parses the instance-wide options. Missing settings yield the
+// defaults.
+func loadSettings(settings *backend.AppInstanceSettings) (*pluginSettings, error) {
+	var s pluginSettings
+	if settings != nil && len(settings.JSONData) > 0 {
+		if err := json.Unmarshal(settings.JSONData, &s); err != nil {
+			return nil, err
+		}
+	}
+	if s.UserIdentity == "" {
+		s.UserIdentity = userIdentityLogin
+	}
+	if err := s.Audit.validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// getSettings returns the instance-wide options for the request.
+func getSettings(req *http.Request) (*pluginSettings, error) {
+	return loadSettings(backend.PluginConfigFromContext(req.Context()).AppInstanceSettings)
+}
+
+// blockingTimeout returns the configured bound for blocking calls.
+func (s *pluginSettings) blockingTimeout() time.Duration {
+	return seconds(s.BlockingTimeout, defaultBlockingTimeout)
+}
+
+func (s *pluginSettings) connectTimeout() time.Duration {
+	return seconds(s.Timeouts.Connect, defaultConnectTimeout)
+}
+
+func (s *pluginSettings) firstByteTimeout() time.Duration {
+	return seconds(s.Timeouts.FirstByte, defaultFirstByteTimeout)
+}
+
+func (s *pluginSettings) idleTimeout() time.Duration {
+	return seconds(s.Timeouts.Idle, defaultIdleTimeout)
+}
+
+func (s *pluginSettings) totalTimeout() time.Duration {
+	return seconds(s.Timeouts.Total, defaultTotalTimeout)
+}
+
+// seconds converts a setting in seconds, falling back to def when unset.
+func seconds(v int, def time.Duration) time.Duration {
+	if v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return def
+}
@@ -0,0 +1,126 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// appStatus describes one configured app for the config page. It carries a
+// fingerprint of the API key, never the key itself.
+type appStatus struct {
+	Name      string `json:"name"`
+	Type      string `json:"type,omitempty"`
+	APIURL    string `json:"apiUrl"`
+	APIKeyRef string `json:"apiKeyRef"`
+	HasKey    bool   `json:"hasKey"`
+	// KeyFingerprint identifies the key so admins can tell which one is in use.
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+	// Circuit is the state of the app's circuit breaker.
+	Circuit string `json:"circuit"`
+	// Balance and Endpoints describe an app with several endpoints.
+	Balance   string           `json:"balance,omitempty"`
+	Endpoints []endpointStatus `json:"endpoints,omitempty"`
+	Probe     *appHealth       `json:"probe,omitempty"`
+}
+
+// endpointStatus describes one endpoint of an app for the config page.
+type endpointStatus struct {
+	Name           string `json:"name"`
+	APIURL         string `json:"apiUrl"`
+	APIKeyRef      string `json:"apiKeyRef"`
+	HasKey         bool   `json:"hasKey"`
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+	Priority       int    `json:"priority"`
+	Weight         int    `json:"weight"`
+	Circuit        string `json:"circuit"`
+	// Down is the error of the endpoint's last failed probe.
+	Down string `json:"down,omitempty"`
+}
+
+// configStatus is the response of /configStatus.
+type configStatus struct {
+	UserIdentity string `json:"userIdentity,omitempty"`
+	// SecureFields lists the secureJsonData keys that are set.
+	SecureFields []string    `json:"secureFields"`
+	Apps         []appStatus `json:"apps"`
+	// Error is set when the configuration cannot be loaded.
+	Error string `json:"error,omitempty"`
+}
+
+// keyFingerprint returns a short, non-reversible identifier of an API key.
+func keyFingerprint(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "sha256:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// handleConfigStatus reports which settings are present and probes every
+// configured app. Pass ?probe=false to skip the probes.
+func (a *App) handleConfigStatus(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	instance := backend.PluginConfigFromContext(req.Context()).AppInstanceSettings
+
+	status := configStatus{SecureFields: []string{}, Apps: []appStatus{}}
+	if instance != nil {
+		for field, value := range instance.DecryptedSecureJSONData {
+			if value != "" {
+				status.SecureFields = append(status.SecureFields, field)
+			}
+		}
+		sort.Strings(status.SecureFields)
+	}
+	if settings, err := loadSettings(instance); err == nil {
+		status.UserIdentity = settings.UserIdentity
+	}
+
+	apps, err := loadApps(instance)
+	if err != nil {
+		status.Error = err.Error()
+		writeJSON(w, status)
+		return
+	}
+	probe := req.URL.Query().Get("probe") != "false"
+	orgID := backend.PluginConfigFromContext(req.Context()).OrgID
+	for _, app := range apps {
+		s := appStatus{
+			Name:           app.Name,
+			Type:           app.Type,
+			APIURL:         app.APIURL,
+			APIKeyRef:      app.APIKeyRef,
+			HasKey:         app.apiKey != "",
+			KeyFingerprint: keyFingerprint(app.apiKey),
+			Circuit:        a.appCircuit(orgID, app),
+		}
+		if len(app.Endpoints) > 1 {
+			s.Balance = app.Balance
+			for _, ep := range app.Endpoints {
+				s.Endpoints = append(s.Endpoints, endpointStatus{
+					Name:           ep.Name,
+					APIURL:         ep.APIURL,
+					APIKeyRef:      ep.APIKeyRef,
+					HasKey:         ep.apiKey != "",
+					KeyFingerprint: keyFingerprint(ep.apiKey),
+					Priority:       ep.Priority,
+					Weight:         ep.Weight,
+					Circuit:        a.breakers.state(breakerKey(orgID, app, ep)),
+					Down:           a.endpoints.downReason(app, ep),
+				})
+			}
+		}
+		if probe {
+			h := a.probeApp(req.Context(), orgID, app)
+			s.Probe = &h
+		}
+		status.Apps = append(status.Apps, s)
+	}
+	writeJSON(w, status)
+}
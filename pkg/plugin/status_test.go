@@ -0,0 +1,65 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestHandleConfigStatus tests that the status route reports the config
+// without returning secrets
+func TestHandleConfigStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(difyInfoMock))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	settings := &backend.AppInstanceSettings{
+		JSONData: []byte(`{"apps": [
+			{"name": "logs", "type": "chat", "apiUrl": "` + server.URL + `", "apiKeyRef": "logsKey"},
+			{"name": "triage", "type": "workflow", "apiUrl": "` + server.URL + `"}
+		]}`),
+		DecryptedSecureJSONData: map[string]string{"logsKey": "chat-key", "userIdentitySalt": "pepper"},
+	}
+
+	if resp := callResource(t, app, asUser("admin", roleAdmin, settings), http.MethodGet, "difyWorkflow", ""); resp.Status != http.StatusNotFound {
+		t.Errorf("Expected the old /difyWorkflow route to be gone, got %d", resp.Status)
+	}
+
+	resp := callResource(t, app, asUser("admin", roleAdmin, settings), http.MethodGet, "configStatus", "")
+	if resp.Status != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", resp.Status, resp.Body)
+	}
+	for _, secret := range []string{"chat-key", "pepper"} {
+		if strings.Contains(string(resp.Body), secret) {
+			t.Errorf("/configStatus must not return secrets, got %s", resp.Body)
+		}
+	}
+
+	var status configStatus
+	if err := json.Unmarshal(resp.Body, &status); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if strings.Join(status.SecureFields, ",") != "logsKey,userIdentitySalt" {
+		t.Errorf("Unexpected secure fields: %v", status.SecureFields)
+	}
+	if len(status.Apps) != 2 {
+		t.Fatalf("Expected 2 apps, got %+v", status.Apps)
+	}
+	logs, triage := status.Apps[0], status.Apps[1]
+	if logs.KeyFingerprint != keyFingerprint("chat-key") || logs.Probe == nil || !logs.Probe.OK {
+		t.Errorf("Unexpected status for logs: %+v %+v", logs, logs.Probe)
+	}
+	if triage.HasKey || triage.KeyFingerprint != "" || triage.Probe == nil || triage.Probe.Error != healthErrorConfig {
+		t.Errorf("Unexpected status for triage: %+v %+v", triage, triage.Probe)
+	}
+}
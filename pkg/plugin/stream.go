@@ -0,0 +1,267 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+)
+
+// stopTimeout bounds the stop call sent to Dify after a client went away.
+const stopTimeout = 10 * time.Second
+
+// errStreamStalled is reported when Dify stops sending events mid-stream.
+var errStreamStalled = errors.New("Dify stream stalled")
+
+// watchdog guards a streaming upstream call. Its context ends after the total
+// timeout, or earlier if the first event does not arrive within firstByte or
+// two events, pings included, are more than idle apart.
+type watchdog struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	idle    time.Duration
+	stalled atomic.Bool
+}
+
+func newWatchdog(parent context.Context, total, firstByte, idle time.Duration) *watchdog {
+	ctx, cancel := context.WithTimeout(parent, total)
+	wd := &watchdog{ctx: ctx, cancel: cancel, idle: idle}
+	wd.timer = time.AfterFunc(firstByte, func() {
+		wd.stalled.Store(true)
+		cancel()
+	})
+	return wd
+}
+
+// kick records progress on the stream.
+func (wd *watchdog) kick() {
+	if wd != nil {
+		wd.timer.Reset(wd.idle)
+	}
+}
+
+// close releases the watchdog once the call is over.
+func (wd *watchdog) close() {
+	wd.timer.Stop()
+	wd.cancel()
+}
+
+// err reports why the watchdog cut the call short, or nil if it did not.
+func (wd *watchdog) err() error {
+	if wd == nil {
+		return nil
+	}
+	if wd.stalled.Load() {
+		return errStreamStalled
+	}
+	if errors.Is(wd.ctx.Err(), context.DeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// streamOptions customizes how a Dify event stream is relayed to the client.
+type streamOptions struct {
+	// rewrite maps each event to the events relayed in its place, before
+	// they are recorded in the result. It is called with nil once the stream
+	// ended, to flush events it held back.
+	rewrite func(*dify.Event) []*dify.Event
+	// stop cancels the upstream task. It is called when the client goes away
+	// or the watchdog aborts the stream before it finished.
+	stop func(ctx context.Context, taskID string) error
+	// watchdog is kicked on every event.
+	watchdog *watchdog
+	// observer records stream metrics.
+	observer *streamObserver
+	// onResult sees the result of the stream once it ended.
+	onResult func(*dify.Result)
+}
+
+// relay returns the events to relay in place of ev, or the held back ones
+// once the stream ended, when ev is nil.
+func (o streamOptions) relay(ev *dify.Event) []*dify.Event {
+	if o.rewrite != nil {
+		return o.rewrite(ev)
+	}
+	if ev == nil {
+		return nil
+	}
+	return []*dify.Event{ev}
+}
+
+// stopAbandoned stops the upstream task of a stream whose client went away,
+// so that Dify does not keep generating (and billing) an unread answer.
+func (o streamOptions) stopAbandoned(result *dify.Result) {
+	if o.stop == nil || result.Done || result.TaskID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+	if err := o.stop(ctx, result.TaskID); err != nil {
+		log.DefaultLogger.Warn("Failed to stop abandoned Dify task", "task_id", result.TaskID, "error", err)
+		return
+	}
+	log.DefaultLogger.Debug("Stopped abandoned Dify task", "task_id", result.TaskID)
+}
+
+// streamEvents decodes a Dify event stream and forwards every event to the
+// client, flushing after each one so that tokens reach the browser as soon as
+// they arrive.
+func streamEvents(w http.ResponseWriter, req *http.Request, resp *http.Response, opts streamOptions) *dify.Result {
+	for k, vv := range resp.Header {
+		// Skip Content-Length to allow streaming
+		if k == "Content-Length" {
+			continue
+		}
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	// Ensure content-type is text/event-stream
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(resp.StatusCode)
+
+	var result dify.Result
+	flusher, _ := w.(http.Flusher)
+	send := func(events []*dify.Event) bool {
+		for _, ev := range events {
+			result.Add(ev)
+			n, err := w.Write(ev.Encode())
+			opts.observer.event(ev, n)
+			if err != nil {
+				loggerFrom(req.Context()).Debug("Error writing to client", "error", err)
+				opts.stopAbandoned(&result)
+				return false
+			}
+		}
+		if flusher != nil && len(events) > 0 {
+			flusher.Flush()
+		}
+		return true
+	}
+	decoder := dify.NewDecoder(resp.Body)
+	for {
+		ev, err := decoder.Next()
+		if err != nil {
+			if err == io.EOF {
+				send(opts.relay(nil))
+				return &result
+			}
+			if reason := opts.watchdog.err(); reason != nil {
+				loggerFrom(req.Context()).Warn("Aborted Dify stream", "reason", reason, "task_id", result.TaskID)
+				timeout := &dify.Event{
+					Event:   dify.EventError,
+					TaskID:  result.TaskID,
+					Status:  http.StatusGatewayTimeout,
+					Code:    "upstream_timeout",
+					Message: reason.Error(),
+				}
+				w.Write(timeout.Encode())
+				observeUpstreamError(req.Context(), reason)
+				opts.stopAbandoned(&result)
+			} else {
+				loggerFrom(req.Context()).Debug("Error reading from Dify", "error", err)
+				if req.Context().Err() != nil {
+					opts.stopAbandoned(&result)
+				}
+			}
+			return &result
+		}
+		opts.watchdog.kick()
+		if ev.Event == dify.EventError {
+			loggerFrom(req.Context()).Warn("Dify stream reported an error",
+				"status", ev.Status,
+				"code", ev.Code,
+				"message", ev.Message,
+				"task_id", ev.TaskID)
+		}
+		if !send(opts.relay(ev)) {
+			return &result
+		}
+	}
+}
+
+// wantsAggregate reports whether the client asked for a single JSON document
+// instead of the event stream, either with ?aggregate=true or by accepting
+// application/json but not text/event-stream.
+func wantsAggregate(req *http.Request) bool {
+	if v, err := strconv.ParseBool(req.URL.Query().Get("aggregate")); err == nil {
+		return v
+	}
+	accept := req.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/event-stream")
+}
+
+// aggregateEvents consumes a Dify event stream and writes its final result
+// as one JSON document. A stream that reported an error is answered with the
+// error's status, or 502 if it has none.
+func aggregateEvents(w http.ResponseWriter, req *http.Request, resp *http.Response, opts streamOptions) *dify.Result {
+	var result dify.Result
+	decoder := dify.NewDecoder(resp.Body)
+	for {
+		ev, err := decoder.Next()
+		if err == io.EOF {
+			for _, ev := range opts.relay(nil) {
+				result.Add(ev)
+			}
+			break
+		}
+		if err != nil {
+			if reason := opts.watchdog.err(); reason != nil {
+				observeUpstreamError(req.Context(), reason)
+				opts.stopAbandoned(&result)
+				http.Error(w, "Dify did not respond in time: "+reason.Error(), http.StatusGatewayTimeout)
+				return &result
+			}
+			if req.Context().Err() != nil {
+				opts.stopAbandoned(&result)
+			}
+			http.Error(w, "Failed to read Dify stream: "+err.Error(), http.StatusBadGateway)
+			return &result
+		}
+		opts.watchdog.kick()
+		opts.observer.event(ev, 0)
+		for _, ev := range opts.relay(ev) {
+			result.Add(ev)
+		}
+	}
+
+	status := http.StatusOK
+	if result.Error != nil {
+		status = http.StatusBadGateway
+		if result.Error.StatusCode >= 400 {
+			status = result.Error.StatusCode
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		loggerFrom(req.Context()).Debug("Error writing to client", "error", err)
+	}
+	return &result
+}
+
+// writeStream answers with the Dify event stream, or with its aggregated
+// result if the client asked for one.
+func writeStream(w http.ResponseWriter, req *http.Request, resp *http.Response, opts streamOptions) {
+	opts.observer = newStreamObserver(req)
+	var result *dify.Result
+	if wantsAggregate(req) {
+		result = aggregateEvents(w, req, resp, opts)
+	} else {
+		result = streamEvents(w, req, resp, opts)
+	}
+	opts.observer.done(result)
+	if opts.onResult != nil {
+		opts.onResult(result)
+	}
+}
@@ -0,0 +1,235 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// stopRecorder is a mock Dify that streams one chat event and then hangs
+// until the request is cancelled, recording stop calls. Workflow runs hang
+// without sending anything.
+type stopRecorder struct {
+	stops chan string
+}
+
+func (s *stopRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v1/chat-messages":
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: {\"event\": \"message\", \"task_id\": \"t1\", \"answer\": \"thinking\"}\n\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	case r.URL.Path == "/v1/workflows/run":
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	case strings.HasSuffix(r.URL.Path, "/stop"):
+		var body struct {
+			User string `json:"user"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		s.stops <- r.URL.Path + " " + body.User
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"result": "success"}`))
+	}
+}
+
+func withTestPluginContext(req *http.Request, serverURL string) *http.Request {
+	return req.WithContext(backend.WithPluginContext(req.Context(), backend.PluginContext{
+		OrgID: 1,
+		User:  &backend.User{Login: "admin"},
+		AppInstanceSettings: &backend.AppInstanceSettings{
+			JSONData:                []byte(`{"apiUrl": "` + serverURL + `"}`),
+			DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+		},
+	}))
+}
+
+// TestStopRoutes tests the explicit stop routes
+func TestStopRoutes(t *testing.T) {
+	mock := &stopRecorder{stops: make(chan string, 1)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	testCases := []struct {
+		name           string
+		path           string
+		body           string
+		handler        func(http.ResponseWriter, *http.Request)
+		expectedStatus int
+		expectedStop   string
+	}{
+		{
+			name:           "stop chat by body",
+			path:           "/difyChatStop",
+			body:           `{"task_id": "t1"}`,
+			handler:        app.handleDifyChatStop,
+			expectedStatus: http.StatusOK,
+			expectedStop:   "/v1/chat-messages/t1/stop org1:admin",
+		},
+		{
+			name:           "stop workflow by query",
+			path:           "/difyWorkflowStop?task_id=t2",
+			handler:        app.handleDifyWorkflowStop,
+			expectedStatus: http.StatusOK,
+			expectedStop:   "/v1/workflows/tasks/t2/stop org1:admin",
+		},
+		{
+			name:           "missing task_id",
+			path:           "/difyChatStop",
+			handler:        app.handleDifyChatStop,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := withTestPluginContext(httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body)), server.URL)
+			w := httptest.NewRecorder()
+
+			tc.handler(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+			if tc.expectedStop == "" {
+				return
+			}
+			select {
+			case got := <-mock.stops:
+				if got != tc.expectedStop {
+					t.Errorf("Expected stop %q, got %q", tc.expectedStop, got)
+				}
+			default:
+				t.Error("Expected a stop call")
+			}
+		})
+	}
+}
+
+// TestStopOnClientDisconnect tests that an abandoned stream stops its Dify task
+func TestStopOnClientDisconnect(t *testing.T) {
+	mock := &stopRecorder{stops: make(chan string, 1)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/difyChatProxy", strings.NewReader(`{"query": "hi"}`)).WithContext(ctx)
+	req = withTestPluginContext(req, server.URL)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		app.handleDifyChatProxy(w, req)
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case got := <-mock.stops:
+		if got != "/v1/chat-messages/t1/stop org1:admin" {
+			t.Errorf("Unexpected stop call %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the abandoned task to be stopped")
+	}
+	<-done
+}
+
+// TestStreamWatchdog tests that stalled streams are cut short and stopped
+func TestStreamWatchdog(t *testing.T) {
+	mock := &stopRecorder{stops: make(chan string, 1)}
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	testCases := []struct {
+		name           string
+		path           string
+		body           string
+		handler        func(http.ResponseWriter, *http.Request)
+		expectedStatus int
+		expectedBody   string
+		expectedStop   string
+	}{
+		{
+			name:           "idle stream",
+			path:           "/difyChatProxy",
+			body:           `{"query": "hi"}`,
+			handler:        app.handleDifyChatProxy,
+			expectedStatus: http.StatusOK,
+			expectedBody:   `"code":"upstream_timeout"`,
+			expectedStop:   "/v1/chat-messages/t1/stop org1:admin",
+		},
+		{
+			name:           "no first byte",
+			path:           "/difyWorkflowProxy",
+			body:           `{}`,
+			handler:        app.handleDifyWorkflowProxy,
+			expectedStatus: http.StatusGatewayTimeout,
+			expectedBody:   "did not respond in time",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(tc.body))
+			req = req.WithContext(backend.WithPluginContext(req.Context(), backend.PluginContext{
+				OrgID: 1,
+				User:  &backend.User{Login: "admin"},
+				AppInstanceSettings: &backend.AppInstanceSettings{
+					JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "timeouts": {"firstByte": 1, "idle": 1}}`),
+					DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+				},
+			}))
+			w := httptest.NewRecorder()
+
+			tc.handler(w, req)
+
+			if w.Code != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, w.Code, w.Body.String())
+			}
+			if !strings.Contains(w.Body.String(), tc.expectedBody) {
+				t.Errorf("Expected body to contain %q, got %q", tc.expectedBody, w.Body.String())
+			}
+			if tc.expectedStop == "" {
+				return
+			}
+			select {
+			case got := <-mock.stops:
+				if got != tc.expectedStop {
+					t.Errorf("Expected stop %q, got %q", tc.expectedStop, got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("Expected the stalled task to be stopped")
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// difyTarget bundles what a handler needs to call Dify on behalf of the
+// calling user.
+type difyTarget struct {
+	app      *difyApp
+	endpoint *difyEndpoint
+	// affinity pins the conversations and tasks the endpoint creates.
+	affinity *endpointAffinity
+	orgID    int64
+	user     string
+	settings *pluginSettings
+	client   *dify.Client
+	usage    *usageLedger
+	// redactor is nil unless redaction is enabled.
+	redactor *redactor
+	mappings *pseudonymStore
+	// pseudonyms are those of the request, see redactRequest. They are nil
+	// unless redaction runs in redactModePseudonymize.
+	pseudonyms *pseudonyms
+	// keys are the org's storage keys, nil without a storage key.
+	keys *keyring
+	// audit is the request's audit event, nil unless the route is audited.
+	audit *auditEvent
+	// store is nil unless the conversation store is enabled. transcript is
+	// the chat message of the request it records.
+	store      *conversationStore
+	transcript *transcript
+}
+
+// resolveTarget resolves the app, user and settings for a request. It writes
+// an error response and returns false if any of them is misconfigured.
+func (a *App) resolveTarget(w http.ResponseWriter, req *http.Request, appType string) (*difyTarget, bool) {
+	app, err := getPluginConfig(req, appType)
+	if err != nil {
+		writeConfigError(w, err)
+		return nil, false
+	}
+	settings, err := getSettings(req)
+	if err != nil {
+		writeConfigError(w, err)
+		return nil, false
+	}
+	user, err := getDifyUser(req)
+	if err != nil {
+		writeConfigError(w, err)
+		return nil, false
+	}
+	redactor, err := newRedactor(settings.Redaction)
+	if err != nil {
+		writeConfigError(w, err)
+		return nil, false
+	}
+	info := requestInfoFrom(req.Context())
+	info.app, info.user = app.Name, user
+	traceAttributes(req.Context(), attrApp, app.Name)
+	pluginConfig := backend.PluginConfigFromContext(req.Context())
+	orgID := pluginConfig.OrgID
+	keys, err := loadKeyring(pluginConfig.AppInstanceSettings)
+	if err != nil {
+		writeConfigError(w, err)
+		return nil, false
+	}
+	// An enabled store that cannot be opened fails the request rather than
+	// leave its chat messages unrecorded.
+	store, err := a.openConversationStore(req, settings)
+	if err != nil {
+		loggerFrom(req.Context()).Error("Failed to open the conversation store", "org_id", orgID, "error", err)
+		writeStoreError(w, err)
+		return nil, false
+	}
+	if store != nil {
+		a.maintainConversationStore(orgID, store, settings.ConversationStore)
+	}
+	t := &difyTarget{
+		app:      app,
+		affinity: a.affinity,
+		orgID:    orgID,
+		user:     user,
+		settings: settings,
+		usage:    a.usage,
+		redactor: redactor,
+		mappings: a.mappings,
+		keys:     keys,
+		audit:    info.audit,
+		store:    store,
+	}
+	a.useEndpoint(req, t, a.pickEndpoint(orgID, app))
+	return t, true
+}
+
+// useEndpoint makes t call Dify through ep.
+func (a *App) useEndpoint(req *http.Request, t *difyTarget, ep *difyEndpoint) {
+	if len(t.app.Endpoints) > 1 {
+		traceAttributes(req.Context(), attrEndpoint, ep.Name)
+	}
+	b := a.breakers.get(breakerKey(t.orgID, t.app, ep), t.app.endpointLabel(ep), t.settings.Circuit)
+	t.endpoint = ep
+	t.client = dify.NewClient(ep.APIURL, ep.apiKey, a.breakerClient(b)).WithRetry(t.settings.retryPolicy())
+}
+
+// callContext bounds a non-streaming upstream call by the total timeout. The
+// call also ends when the client request does.
+func (t *difyTarget) callContext(req *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), t.settings.totalTimeout())
+}
+
+// blockingContext bounds a blocking upstream call by the blocking timeout.
+func (t *difyTarget) blockingContext(req *http.Request) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(req.Context(), t.settings.blockingTimeout())
+}
+
+// streamWatchdog returns the watchdog guarding a streaming upstream call.
+func (t *difyTarget) streamWatchdog(req *http.Request) *watchdog {
+	return newWatchdog(req.Context(), t.settings.totalTimeout(), t.settings.firstByteTimeout(), t.settings.idleTimeout())
+}
+
+// writeCallError answers an upstream call that failed before any response
+// was relayed. Calls cut short by a timeout are answered with 504.
+func writeCallError(w http.ResponseWriter, ctx context.Context, wd *watchdog, err error) {
+	if reason := wd.err(); reason != nil {
+		observeUpstreamError(ctx, reason)
+		http.Error(w, "Dify did not respond in time: "+reason.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	observeUpstreamError(ctx, err)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		http.Error(w, "Dify did not respond in time", http.StatusGatewayTimeout)
+		return
+	}
+	writeDifyError(w, err)
+}
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Span attributes describing the Dify side of a request.
+const (
+	attrApp            = "dify.app"
+	attrEndpoint       = "dify.endpoint"
+	attrConversationID = "dify.conversation_id"
+	attrTaskID         = "dify.task_id"
+	attrMessageID      = "dify.message_id"
+	attrWorkflowRunID  = "dify.workflow_run_id"
+)
+
+// startRequestSpan starts the span of a resource request. The plugin SDK
+// configures the tracer, so spans are dropped unless Grafana enabled tracing
+// for the plugin.
+func startRequestSpan(req *http.Request, route string) (*http.Request, trace.Span) {
+	ctx, span := tracing.DefaultTracer().Start(req.Context(), "CallResource "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("http.route", route),
+		))
+	return req.WithContext(ctx), span
+}
+
+// endRequestSpan records the response status and ends the span.
+func endRequestSpan(span trace.Span, status int) {
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// traceAttributes adds string attributes to the request span, skipping
+// empty values. kv alternates keys and values.
+func traceAttributes(ctx context.Context, kv ...string) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if kv[i+1] != "" {
+			span.SetAttributes(attribute.String(kv[i], kv[i+1]))
+		}
+	}
+}
+
+// traceResult records the IDs of a blocking response on the request span.
+func traceResult(ctx context.Context, v interface{}) {
+	switch r := v.(type) {
+	case *dify.ChatResponse:
+		traceAttributes(ctx, attrTaskID, r.TaskID, attrConversationID, r.ConversationID, attrMessageID, r.MessageID)
+	case *dify.CompletionResponse:
+		traceAttributes(ctx, attrTaskID, r.TaskID, attrMessageID, r.MessageID)
+	case *dify.WorkflowRunResponse:
+		traceAttributes(ctx, attrTaskID, r.TaskID, attrWorkflowRunID, r.WorkflowRunID)
+	}
+}
+
+// traceEvent records a relayed stream event on the request span: the IDs it
+// carries, the first answer text and workflow node progress.
+func traceEvent(ctx context.Context, ev *dify.Event, firstAnswer bool) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	traceAttributes(ctx,
+		attrTaskID, ev.TaskID,
+		attrConversationID, ev.ConversationID,
+		attrMessageID, ev.MessageID,
+		attrWorkflowRunID, ev.WorkflowRunID)
+	if firstAnswer {
+		span.AddEvent("first_token")
+	}
+	switch ev.Event {
+	case dify.EventNodeStarted, dify.EventNodeFinished:
+		if ev.Data == nil {
+			return
+		}
+		attrs := []attribute.KeyValue{
+			attribute.String("dify.node_id", ev.Data.NodeID),
+			attribute.String("dify.node_type", ev.Data.NodeType),
+			attribute.String("dify.node_title", ev.Data.Title),
+		}
+		if ev.Event == dify.EventNodeFinished {
+			attrs = append(attrs,
+				attribute.String("dify.node_status", ev.Data.Status),
+				attribute.Float64("dify.elapsed_time", ev.Data.ElapsedTime))
+		}
+		span.AddEvent(ev.Event, trace.WithAttributes(attrs...))
+	case dify.EventError:
+		span.SetStatus(codes.Error, ev.Code+": "+ev.Message)
+	}
+}
+
+// startUpstreamSpan starts a client span for a Dify call and propagates the
+// trace context to Dify in the traceparent header. The request is cloned
+// because a RoundTripper must not modify it.
+func startUpstreamSpan(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracing.DefaultTracer().Start(req.Context(), "Dify "+req.Method+" "+req.URL.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("server.address", req.URL.Host),
+			attribute.String("url.path", req.URL.Path),
+		))
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
+
+// endUpstreamSpan records how a Dify call ended. For streams the span covers
+// the time until the response headers arrived.
+func endUpstreamSpan(span trace.Span, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case resp.StatusCode >= http.StatusBadRequest:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		span.SetStatus(codes.Error, "Dify answered "+strconv.Itoa(resp.StatusCode))
+	default:
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	span.End()
+}
@@ -0,0 +1,103 @@
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// TestTracing tests the spans of a streamed workflow run
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	tracing.InitDefaultTracer(provider.Tracer("test"))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		tracing.InitDefaultTracer(noop.NewTracerProvider().Tracer(""))
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	traceparent := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent <- r.Header.Get("traceparent")
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte(`data: {"event": "workflow_started", "task_id": "t1", "workflow_run_id": "r1"}
+
+data: {"event": "node_started", "task_id": "t1", "data": {"node_id": "n1", "node_type": "llm", "title": "LLM"}}
+
+data: {"event": "text_chunk", "task_id": "t1", "data": {"text": "hi"}}
+
+data: {"event": "node_finished", "task_id": "t1", "data": {"node_id": "n1", "node_type": "llm", "status": "succeeded"}}
+
+`))
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+
+	var r mockCallResourceResponseSender
+	err = app.CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{
+			OrgID: 1,
+			User:  &backend.User{Login: "editor", Role: roleEditor},
+			AppInstanceSettings: &backend.AppInstanceSettings{
+				JSONData:                []byte(`{"apiUrl": "` + server.URL + `"}`),
+				DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+			},
+		},
+		Method: http.MethodPost,
+		Path:   "difyWorkflowProxy",
+		Body:   []byte(`{}`),
+	}, &r)
+	if err != nil || r.response.Status != http.StatusOK {
+		t.Fatalf("Unexpected response %+v: %v", r.response, err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("Expected a request and a Dify span, got %d", len(spans))
+	}
+	upstream, request := spans[0], spans[1]
+	if request.Name() != "CallResource /difyWorkflowProxy" || upstream.Name() != "Dify POST /v1/workflows/run" {
+		t.Fatalf("Unexpected spans %q and %q", request.Name(), upstream.Name())
+	}
+	if upstream.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Error("Expected the Dify span to be a child of the request span")
+	}
+
+	want := "00-" + upstream.SpanContext().TraceID().String() + "-" + upstream.SpanContext().SpanID().String() + "-01"
+	if got := <-traceparent; got != want {
+		t.Errorf("Expected traceparent %q, got %q", want, got)
+	}
+
+	attrs := map[string]string{}
+	for _, kv := range request.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	for key, value := range map[string]string{attrApp: defaultAppName, attrTaskID: "t1", attrWorkflowRunID: "r1"} {
+		if attrs[key] != value {
+			t.Errorf("Expected attribute %s=%q, got %q", key, value, attrs[key])
+		}
+	}
+
+	var events []string
+	for _, ev := range request.Events() {
+		events = append(events, ev.Name)
+	}
+	if len(events) != 3 || events[0] != "node_started" || events[1] != "first_token" || events[2] != "node_finished" {
+		t.Errorf("Unexpected span events %v", events)
+	}
+}
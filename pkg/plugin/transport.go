@@ -0,0 +1,164 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"golang.org/x/net/http/httpproxy"
+)
+
+const (
+	defaultMaxIdleConns        = 100
+	defaultMaxIdleConnsPerHost = 10
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// tlsSettings configures how Dify's certificate is verified and how the
+// plugin authenticates itself. The CA bundle and the client certificate are
+// stored in secureJsonData as tlsCACert, tlsClientCert and tlsClientKey.
+type tlsSettings struct {
+	// SkipVerify disables certificate verification. Only meant for labs.
+	SkipVerify bool `json:"skipVerify"`
+	// ServerName overrides the name the certificate is verified against.
+	ServerName string `json:"serverName"`
+}
+
+// proxySettings routes Dify traffic through an HTTP(S) proxy. Without a URL
+// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables apply. The
+// proxy password is stored in secureJsonData as proxyPassword.
+type proxySettings struct {
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	// NoProxy lists hosts reached directly, in NO_PROXY syntax.
+	NoProxy string `json:"noProxy"`
+}
+
+// poolSettings limits the connections kept to Dify. Zero selects the default.
+type poolSettings struct {
+	MaxIdleConns        int `json:"maxIdleConns"`
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost"`
+	// MaxConnsPerHost caps all connections to one host; zero means no limit.
+	MaxConnsPerHost int `json:"maxConnsPerHost"`
+	// IdleConnTimeout closes idle connections after this many seconds.
+	IdleConnTimeout int `json:"idleConnTimeout"`
+	// DisableHTTP2 forces HTTP/1.1 even if Dify offers HTTP/2.
+	DisableHTTP2 bool `json:"disableHttp2"`
+}
+
+// newHTTPClient builds the client shared by all routes of an app instance.
+// Settings are only read once: Grafana creates a new instance when they
+// change.
+func newHTTPClient(instance *backend.AppInstanceSettings) (*http.Client, error) {
+	settings, err := loadSettings(instance)
+	if err != nil {
+		return nil, err
+	}
+	var secure map[string]string
+	if instance != nil {
+		secure = instance.DecryptedSecureJSONData
+	}
+
+	tlsConfig, err := newTLSConfig(settings.TLS, secure)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := newProxyFunc(settings.Proxy, secure["proxyPassword"])
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   settings.connectTimeout(),
+		KeepAlive: 30 * time.Second,
+	}
+	pool := settings.Pool
+	transport := &http.Transport{
+		Proxy:               proxy,
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: settings.connectTimeout(),
+		MaxIdleConns:        positive(pool.MaxIdleConns, defaultMaxIdleConns),
+		MaxIdleConnsPerHost: positive(pool.MaxIdleConnsPerHost, defaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:     pool.MaxConnsPerHost,
+		IdleConnTimeout:     seconds(pool.IdleConnTimeout, defaultIdleConnTimeout),
+		// A custom TLS config turns off HTTP/2 unless it is asked for.
+		ForceAttemptHTTP2: !pool.DisableHTTP2,
+	}
+	if pool.DisableHTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: &instrumentedTransport{next: transport}}, nil
+}
+
+// newTLSConfig builds the TLS configuration for Dify connections.
+func newTLSConfig(settings tlsSettings, secure map[string]string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.SkipVerify, // #nosec G402 -- opt-in for labs
+	}
+
+	if ca := secure["tlsCACert"]; ca != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(ca)) {
+			return nil, &ConfigError{"tlsCACert does not contain a PEM certificate"}
+		}
+		config.RootCAs = pool
+	}
+
+	cert, key := secure["tlsClientCert"], secure["tlsClientKey"]
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, &ConfigError{"tlsClientCert and tlsClientKey must be set together"}
+		}
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			return nil, &ConfigError{"invalid TLS client certificate: " + err.Error()}
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// newProxyFunc returns the proxy selection for Dify requests.
+func newProxyFunc(settings proxySettings, password string) (func(*http.Request) (*url.URL, error), error) {
+	if settings.URL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(settings.URL)
+	if err != nil || u.Host == "" {
+		return nil, &ConfigError{"invalid proxy url: " + settings.URL}
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, &ConfigError{"proxy url must use http or https"}
+	}
+	if settings.Username != "" {
+		u.User = url.UserPassword(settings.Username, password)
+	}
+
+	config := httpproxy.Config{
+		HTTPProxy:  u.String(),
+		HTTPSProxy: u.String(),
+		NoProxy:    settings.NoProxy,
+	}
+	proxyForURL := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxyForURL(req.URL)
+	}, nil
+}
+
+// positive returns v, or def when v is not set.
+func positive(v, def int) int {
+	if v > 0 {
+		return v
+	}
+	return def
+}
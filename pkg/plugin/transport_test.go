@@ -0,0 +1,167 @@
+package plugin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// testClientCert returns a self-signed client certificate and key in PEM.
+func testClientCert(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "grafana"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+}
+
+// TestNewHTTPClient tests the TLS and proxy options of the shared transport
+func TestNewHTTPClient(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	server := httptest.NewTLSServer(ok)
+	defer server.Close()
+	serverCA := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	clientCert, clientKey := testClientCert(t)
+	mtls := httptest.NewUnstartedServer(ok)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM([]byte(clientCert))
+	mtls.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	mtls.StartTLS()
+	defer mtls.Close()
+
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String() + " " + r.Header.Get("Proxy-Authorization")
+		w.Write([]byte("ok"))
+	}))
+	defer proxy.Close()
+
+	testCases := []struct {
+		name        string
+		jsonData    string
+		secure      map[string]string
+		url         string
+		expectError string
+		expectCall  string
+		expectProxy string
+	}{
+		{
+			name:       "unknown CA",
+			url:        server.URL,
+			expectCall: "certificate",
+		},
+		{
+			name:     "custom CA bundle",
+			secure:   map[string]string{"tlsCACert": serverCA},
+			url:      server.URL,
+			jsonData: `{"pool": {"disableHttp2": true}}`,
+		},
+		{
+			name:     "skip verify",
+			jsonData: `{"tls": {"skipVerify": true}}`,
+			url:      server.URL,
+		},
+		{
+			name:       "mTLS without client certificate",
+			jsonData:   `{"tls": {"skipVerify": true}}`,
+			url:        mtls.URL,
+			expectCall: "certificate",
+		},
+		{
+			name:     "mTLS with client certificate",
+			jsonData: `{"tls": {"skipVerify": true}}`,
+			secure:   map[string]string{"tlsClientCert": clientCert, "tlsClientKey": clientKey},
+			url:      mtls.URL,
+		},
+		{
+			name:        "proxy with credentials",
+			jsonData:    `{"proxy": {"url": "` + proxy.URL + `", "username": "grafana"}}`,
+			secure:      map[string]string{"proxyPassword": "secret"},
+			url:         "http://dify.internal/v1/parameters",
+			expectProxy: "http://dify.internal/v1/parameters Basic Z3JhZmFuYTpzZWNyZXQ=",
+		},
+		{
+			name:        "invalid CA bundle",
+			secure:      map[string]string{"tlsCACert": "not a certificate"},
+			expectError: "tlsCACert does not contain a PEM certificate",
+		},
+		{
+			name:        "client certificate without key",
+			secure:      map[string]string{"tlsClientCert": clientCert},
+			expectError: "tlsClientCert and tlsClientKey must be set together",
+		},
+		{
+			name:        "proxy with unsupported scheme",
+			jsonData:    `{"proxy": {"url": "socks5://proxy:1080"}}`,
+			expectError: "proxy url must use http or https",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			proxied = ""
+			client, err := newHTTPClient(&backend.AppInstanceSettings{
+				JSONData:                []byte(tc.jsonData),
+				DecryptedSecureJSONData: tc.secure,
+			})
+			if tc.expectError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectError) {
+					t.Fatalf("Expected error %q, got %v", tc.expectError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			defer client.CloseIdleConnections()
+
+			resp, err := client.Get(tc.url)
+			if tc.expectCall != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectCall) {
+					t.Fatalf("Expected call error %q, got %v", tc.expectCall, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected call error: %s", err)
+			}
+			resp.Body.Close()
+			if proxied != tc.expectProxy {
+				t.Errorf("Expected proxied request %q, got %q", tc.expectProxy, proxied)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// usageRetention is how long daily usage is kept. It covers the current and
+// the previous month.
+const usageRetention = 62 * 24 * time.Hour
+
+// usageFileName is the name of the usage ledger in the plugin's data
+// directory.
+const usageFileName = "usage.db"
+
+// usageBucket holds the totals of the ledger as JSON, keyed by usageKey.
+var usageBucket = []byte("usage")
+
+// sharedUsage is the usage ledger of all app instances, see App.
+var sharedUsage = newUsageLedger()
+
+// usageTotals sums the usage of a set of generations.
+type usageTotals struct {
+	Requests         int     `json:"requests"`
+	PromptTokens     int     `json:"promptTokens"`
+	CompletionTokens int     `json:"completionTokens"`
+	TotalTokens      int     `json:"totalTokens"`
+	Cost             float64 `json:"cost"`
+	Currency         string  `json:"currency,omitempty"`
+}
+
+func (t *usageTotals) add(o usageTotals) {
+	t.Requests += o.Requests
+	t.PromptTokens += o.PromptTokens
+	t.CompletionTokens += o.CompletionTokens
+	t.TotalTokens += o.TotalTokens
+	t.Cost += o.Cost
+	if t.Currency == "" {
+		t.Currency = o.Currency
+	}
+}
+
+// usageKey identifies the usage of one user of one app on one UTC day.
+type usageKey struct {
+	Day   string `json:"day"`
+	OrgID int64  `json:"orgId"`
+	User  string `json:"user"`
+	App   string `json:"app"`
+}
+
+// bytes encodes the key so that keys sort by day. Its parts are separated
+// by NUL, which no part contains.
+func (k usageKey) bytes() []byte {
+	return []byte(k.Day + "\x00" + strconv.FormatInt(k.OrgID, 10) + "\x00" + k.User + "\x00" + k.App)
+}
+
+func parseUsageKey(b []byte) (usageKey, bool) {
+	parts := strings.Split(string(b), "\x00")
+	if len(parts) != 4 {
+		return usageKey{}, false
+	}
+	orgID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return usageKey{}, false
+	}
+	return usageKey{Day: parts[0], OrgID: orgID, User: parts[2], App: parts[3]}, true
+}
+
+// usageLedger records the usage Dify reports per day, org, user and app.
+type usageLedger struct {
+	mu      sync.Mutex
+	entries map[usageKey]*usageTotals
+	now     func() time.Time
+	// db keeps the entries across restarts, so that quotas hold for their
+	// whole period. It is nil for a ledger kept in memory.
+	db *bolt.DB
+}
+
+func newUsageLedger() *usageLedger {
+	return &usageLedger{entries: map[usageKey]*usageTotals{}, now: time.Now}
+}
+
+// persist loads the entries stored at path, adds them to the ledger and
+// writes every later change there.
+func (l *usageLedger) persist(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+		err = b.ForEach(func(k, v []byte) error {
+			key, ok := parseUsageKey(k)
+			var totals usageTotals
+			if !ok || json.Unmarshal(v, &totals) != nil {
+				log.DefaultLogger.Warn("Skipping unreadable usage entry", "key", string(k))
+				return nil
+			}
+			if entry, ok := l.entries[key]; ok {
+				totals.add(*entry)
+			}
+			l.entries[key] = &totals
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, entry := range l.entries {
+			if err := putUsage(b, key, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	l.db = db
+	l.prune(l.now().UTC())
+	return nil
+}
+
+func putUsage(b *bolt.Bucket, key usageKey, entry *usageTotals) error {
+	v, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.Put(key.bytes(), v)
+}
+
+// usagePersistence makes sure the shared ledger is persisted once.
+var usagePersistence sync.Once
+
+// persistSharedUsage persists sharedUsage in the data directory. Without
+// one, quotas restart from zero with the plugin, which is logged loudly.
+func persistSharedUsage() {
+	usagePersistence.Do(func() {
+		dir, err := dataDir()
+		if err == nil {
+			err = sharedUsage.persist(filepath.Join(dir, usageFileName))
+		}
+		if err != nil {
+			log.DefaultLogger.Error("Usage quotas are kept in memory and reset when the plugin restarts", "error", err)
+		}
+	})
+}
+
+// record adds one generation's usage. A nil usage still counts the request.
+func (l *usageLedger) record(orgID int64, user, app string, usage *dify.Usage) {
+	totals := usageTotals{Requests: 1}
+	if usage != nil {
+		totals.PromptTokens = usage.PromptTokens
+		totals.CompletionTokens = usage.CompletionTokens
+		totals.TotalTokens = usage.TotalTokens
+		totals.Currency = usage.Currency
+		if price, err := strconv.ParseFloat(usage.TotalPrice, 64); err == nil {
+			totals.Cost = price
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now().UTC()
+	key := usageKey{Day: now.Format(time.DateOnly), OrgID: orgID, User: user, App: app}
+	entry, ok := l.entries[key]
+	if !ok {
+		entry = &usageTotals{}
+		l.entries[key] = entry
+		l.prune(now)
+	}
+	entry.add(totals)
+	if l.db == nil {
+		return
+	}
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		return putUsage(tx.Bucket(usageBucket), key, entry)
+	})
+	if err != nil {
+		log.DefaultLogger.Error("Failed to persist usage", "org_id", orgID, "user", user, "app", app, "error", err)
+	}
+}
+
+// prune drops days past the retention. The caller holds l.mu.
+func (l *usageLedger) prune(now time.Time) {
+	oldest := now.Add(-usageRetention).Format(time.DateOnly)
+	for key := range l.entries {
+		if key.Day < oldest {
+			delete(l.entries, key)
+		}
+	}
+	if l.db == nil {
+		return
+	}
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(usageBucket)
+		c := b.Cursor()
+		// Keys sort by day, so the expired ones come first. The cursor is
+		// moved back to the start after each deletion.
+		for k, _ := c.First(); k != nil && bytes.Compare(k, []byte(oldest)) < 0; k, _ = c.First() {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.DefaultLogger.Error("Failed to prune persisted usage", "error", err)
+	}
+}
+
+// sum adds up the entries of an org matching match for today and this month.
+func (l *usageLedger) sum(orgID int64, match func(usageKey) bool) (day, month usageTotals) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now().UTC()
+	today, thisMonth := now.Format(time.DateOnly), now.Format("2006-01")
+	for key, entry := range l.entries {
+		if key.OrgID != orgID || key.Day[:7] != thisMonth || !match(key) {
+			continue
+		}
+		month.add(*entry)
+		if key.Day == today {
+			day.add(*entry)
+		}
+	}
+	return day, month
+}
+
+// monthBy sums this month's entries of an org matching match, grouped by
+// the key group returns.
+func (l *usageLedger) monthBy(orgID int64, match func(usageKey) bool, group func(usageKey) string) map[string]usageTotals {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	thisMonth := l.now().UTC().Format("2006-01")
+	out := map[string]usageTotals{}
+	for key, entry := range l.entries {
+		if key.OrgID != orgID || key.Day[:7] != thisMonth || !match(key) {
+			continue
+		}
+		totals := out[group(key)]
+		totals.add(*entry)
+		out[group(key)] = totals
+	}
+	return out
+}
+
+// quotaLimits caps usage per day and month. Zero means unlimited. Costs are
+// compared in whatever currency Dify reports.
+type quotaLimits struct {
+	DailyTokens   int     `json:"dailyTokens,omitempty"`
+	MonthlyTokens int     `json:"monthlyTokens,omitempty"`
+	DailyCost     float64 `json:"dailyCost,omitempty"`
+	MonthlyCost   float64 `json:"monthlyCost,omitempty"`
+}
+
+// quotaSettings configures quotas per Grafana user and per org.
+type quotaSettings struct {
+	User quotaLimits `json:"user"`
+	Org  quotaLimits `json:"org"`
+}
+
+// exceeded describes the first limit that day or month usage has reached,
+// or returns "" if none has.
+func (q quotaLimits) exceeded(day, month usageTotals) string {
+	switch {
+	case q.DailyTokens > 0 && day.TotalTokens >= q.DailyTokens:
+		return fmt.Sprintf("daily token quota of %d", q.DailyTokens)
+	case q.MonthlyTokens > 0 && month.TotalTokens >= q.MonthlyTokens:
+		return fmt.Sprintf("monthly token quota of %d", q.MonthlyTokens)
+	case q.DailyCost > 0 && day.Cost >= q.DailyCost:
+		return fmt.Sprintf("daily cost quota of %g", q.DailyCost)
+	case q.MonthlyCost > 0 && month.Cost >= q.MonthlyCost:
+		return fmt.Sprintf("monthly cost quota of %g", q.MonthlyCost)
+	}
+	return ""
+}
+
+// checkQuota writes a 429 response and returns false if the calling user or
+// their org has used up a quota.
+func (a *App) checkQuota(w http.ResponseWriter, t *difyTarget) bool {
+	quotas := t.settings.Quotas
+	day, month := a.usage.sum(t.orgID, func(k usageKey) bool { return k.User == t.user })
+	limit := quotas.User.exceeded(day, month)
+	scope := "your"
+	if limit == "" {
+		day, month = a.usage.sum(t.orgID, func(usageKey) bool { return true })
+		limit = quotas.Org.exceeded(day, month)
+		scope = "your organization's"
+	}
+	if limit == "" {
+		return true
+	}
+	t.auditDenied("quota exceeded: " + scope + " " + limit)
+	http.Error(w, "Usage quota exceeded: "+scope+" "+limit+" is used up", http.StatusTooManyRequests)
+	return false
+}
+
+// recordUsage adds a generation of the target's user to the ledger.
+func (t *difyTarget) recordUsage(usage *dify.Usage) {
+	t.usage.record(t.orgID, t.user, t.app.Name, usage)
+	t.auditUsage(usage)
+}
+
+// recordResult records the usage of a finished stream and the conversation
+// and task it ran in.
+func (t *difyTarget) recordResult(r *dify.Result) {
+	t.recordUsage(r.Usage)
+	t.pin(r.ConversationID, r.TaskID)
+	t.saveTranscript(r.ConversationID, r.MessageID, r.Answer, r.Usage)
+	if t.audit != nil {
+		if t.audit.ConversationID == "" {
+			t.audit.ConversationID = r.ConversationID
+		}
+		t.audit.TaskID = r.TaskID
+	}
+}
+
+// usageReport is the response of /usage.
+type usageReport struct {
+	User usageScope `json:"user"`
+	Org  usageScope `json:"org"`
+	// Users breaks this month's org usage down per user. Only admins get it.
+	Users map[string]usageTotals `json:"users,omitempty"`
+}
+
+type usageScope struct {
+	Day   usageTotals `json:"day"`
+	Month usageTotals `json:"month"`
+	Quota quotaLimits `json:"quota"`
+	// Apps breaks this month's usage down per app.
+	Apps map[string]usageTotals `json:"apps"`
+}
+
+// handleUsage reports the calling user's and their org's usage of the
+// current UTC day and month, with the configured quotas.
+func (a *App) handleUsage(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	settings, err := getSettings(req)
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	user, err := getDifyUser(req)
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	pluginConfig := backend.PluginConfigFromContext(req.Context())
+	orgID := pluginConfig.OrgID
+
+	report := usageReport{
+		User: a.usageScope(orgID, func(k usageKey) bool { return k.User == user }),
+		Org:  a.usageScope(orgID, func(usageKey) bool { return true }),
+	}
+	report.User.Quota, report.Org.Quota = settings.Quotas.User, settings.Quotas.Org
+
+	if hasRole(pluginConfig.User, roleAdmin) {
+		report.Users = a.usage.monthBy(orgID, func(usageKey) bool { return true }, func(k usageKey) string { return k.User })
+	}
+	writeJSON(w, report)
+}
+
+func (a *App) usageScope(orgID int64, match func(usageKey) bool) usageScope {
+	day, month := a.usage.sum(orgID, match)
+	return usageScope{
+		Day:   day,
+		Month: month,
+		Apps:  a.usage.monthBy(orgID, match, func(k usageKey) string { return k.App }),
+	}
+}
@@ -0,0 +1,129 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud-org/dify-chatflow/pkg/dify"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// TestQuotas tests that usage is recorded per user and quotas are enforced
+func TestQuotas(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"answer": "ok", "metadata": {"usage": {"prompt_tokens": 40, "completion_tokens": 20, "total_tokens": 60, "total_price": "0.5", "currency": "USD"}}}`))
+	}))
+	defer server.Close()
+
+	inst, err := NewApp(context.Background(), backend.AppInstanceSettings{})
+	if err != nil {
+		t.Fatalf("new app: %s", err)
+	}
+	app := inst.(*App)
+	app.usage = newUsageLedger()
+
+	settings := &backend.AppInstanceSettings{
+		JSONData:                []byte(`{"apiUrl": "` + server.URL + `", "quotas": {"user": {"dailyTokens": 100}, "org": {"monthlyCost": 1.2}}}`),
+		DecryptedSecureJSONData: map[string]string{"apiKey": "test-api-key"},
+	}
+	chat := func(login string) *backend.CallResourceResponse {
+		return callResource(t, app, asUser(login, roleViewer, settings), http.MethodPost, "difyChatProxy", `{"query": "hi", "response_mode": "blocking"}`)
+	}
+
+	for i, expected := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if resp := chat("alice"); resp.Status != expected {
+			t.Fatalf("alice call %d: expected status %d, got %d: %s", i+1, expected, resp.Status, resp.Body)
+		}
+	}
+	// bob has tokens left, but the org has spent 1.0 of 1.2
+	if resp := chat("bob"); resp.Status != http.StatusOK {
+		t.Fatalf("bob: expected status 200, got %d: %s", resp.Status, resp.Body)
+	}
+	resp := chat("bob")
+	if resp.Status != http.StatusTooManyRequests || !strings.Contains(string(resp.Body), "organization's monthly cost quota") {
+		t.Fatalf("bob: expected the org quota to be exceeded, got %d: %s", resp.Status, resp.Body)
+	}
+
+	var report usageReport
+	resp = callResource(t, app, asUser("alice", roleViewer, settings), http.MethodGet, "usage", "")
+	if err := json.Unmarshal(resp.Body, &report); err != nil {
+		t.Fatalf("decode %s: %v", resp.Body, err)
+	}
+	if report.User.Day.TotalTokens != 120 || report.User.Day.Requests != 2 || report.User.Apps[defaultAppName].PromptTokens != 80 {
+		t.Errorf("Unexpected user usage: %+v", report.User)
+	}
+	if report.Org.Month.TotalTokens != 180 || report.Org.Quota.MonthlyCost != 1.2 || report.Users != nil {
+		t.Errorf("Unexpected org usage for a viewer: %+v %v", report.Org, report.Users)
+	}
+
+	report = usageReport{}
+	resp = callResource(t, app, asUser("admin", roleAdmin, settings), http.MethodGet, "usage", "")
+	if err := json.Unmarshal(resp.Body, &report); err != nil {
+		t.Fatalf("decode %s: %v", resp.Body, err)
+	}
+	if report.Users["org1:alice"].TotalTokens != 120 || report.Users["org1:bob"].TotalTokens != 60 {
+		t.Errorf("Unexpected per-user breakdown: %+v", report.Users)
+	}
+}
+
+// TestUsageLedgerPeriods tests that quotas reset with the UTC day and month
+func TestUsageLedgerPeriods(t *testing.T) {
+	ledger := newUsageLedger()
+	now := time.Date(2026, 1, 31, 23, 0, 0, 0, time.UTC)
+	ledger.now = func() time.Time { return now }
+	ledger.record(1, "u", "a", &dify.Usage{TotalTokens: 10})
+
+	all := func(usageKey) bool { return true }
+	if day, month := ledger.sum(1, all); day.TotalTokens != 10 || month.TotalTokens != 10 {
+		t.Errorf("Unexpected usage on the same day: %+v %+v", day, month)
+	}
+	if day, _ := ledger.sum(2, all); day.TotalTokens != 0 {
+		t.Errorf("Usage must not leak across orgs: %+v", day)
+	}
+	now = now.Add(2 * time.Hour)
+	if day, month := ledger.sum(1, all); day.TotalTokens != 0 || month.TotalTokens != 0 {
+		t.Errorf("Expected usage to reset in a new month: %+v %+v", day, month)
+	}
+	now = now.Add(usageRetention)
+	ledger.record(1, "u", "a", nil)
+	if len(ledger.entries) != 1 {
+		t.Errorf("Expected old days to be pruned, got %d entries", len(ledger.entries))
+	}
+}
+
+// TestUsageLedgerPersistence tests that usage survives a restart
+func TestUsageLedgerPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.db")
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	ledger := newUsageLedger()
+	ledger.now = func() time.Time { return now }
+	if err := ledger.persist(path); err != nil {
+		t.Fatalf("persist: %v", err)
+	}
+	ledger.record(1, "u", "a", &dify.Usage{TotalTokens: 10})
+	ledger.record(1, "u", "a", &dify.Usage{TotalTokens: 5})
+	ledger.now = func() time.Time { return now.Add(-usageRetention - 48*time.Hour) }
+	ledger.record(1, "u", "a", &dify.Usage{TotalTokens: 100})
+	ledger.db.Close()
+
+	restarted := newUsageLedger()
+	restarted.now = func() time.Time { return now }
+	if err := restarted.persist(path); err != nil {
+		t.Fatalf("persist after restart: %v", err)
+	}
+	defer restarted.db.Close()
+	if day, _ := restarted.sum(1, func(usageKey) bool { return true }); day.TotalTokens != 15 || day.Requests != 2 {
+		t.Errorf("Expected today's usage to be restored, got %+v", day)
+	}
+	if len(restarted.entries) != 1 {
+		t.Errorf("Expected expired days to be pruned on load, got %d entries", len(restarted.entries))
+	}
+}